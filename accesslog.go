@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// accessLogWriter remembers status code written by the handler
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// withAccessLog logs method, path, status and duration of every request.
+// Metrics and ping are polled all the time, so they are skipped unless --log.access-probes is set
+func withAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !*logAccessProbes && (r.URL.Path == *metricsPath || r.URL.Path == *listenBaseUrl+"ping") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		lw := &accessLogWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+
+		log.WithFields(log.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      lw.status,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		}).Info("http request")
+	})
+}
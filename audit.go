@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	auditResultOk = "ok"
+
+	auditApiTokenPrincipal = "api-token"
+)
+
+type auditEntry struct {
+	Timestamp string `json:"timestamp"`
+	Operation string `json:"operation"`
+	Username  string `json:"username"`
+	Result    string `json:"result"`
+	Principal string `json:"principal,omitempty"`
+	Actor     string `json:"actor"`
+}
+
+// AuditLogger appends JSON line per mutating operation to --audit.log-path.
+// File is reopened if it was moved away, so logrotate works without copytruncate
+type AuditLogger struct {
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func newAuditLogger(path string) (*AuditLogger, error) {
+	a := &AuditLogger{path: path}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLogger) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	a.file = file
+	return nil
+}
+
+// Append writes entry as a single line, it does nothing for nil logger
+func (a *AuditLogger) Append(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("audit: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.rotated() {
+		a.file.Close()
+		if err = a.open(); err != nil {
+			log.Errorf("audit: failed to reopen %s: %s", a.path, err)
+			return
+		}
+	}
+	if _, err = a.file.Write(line); err != nil {
+		log.Errorf("audit: failed to write %s: %s", a.path, err)
+	}
+}
+
+// rotated reports whether the open file is not at path anymore
+func (a *AuditLogger) rotated() bool {
+	current, err := a.file.Stat()
+	if err != nil {
+		return true
+	}
+	onDisk, err := os.Stat(a.path)
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(current, onDisk)
+}
+
+// auditOperation records result of operation on username requested by r, err is nil on success
+func (oAdmin *OvpnAdmin) auditOperation(r *http.Request, operation, username string, err error) {
+	if oAdmin.audit == nil {
+		return
+	}
+	entry := auditEntry{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Operation: operation,
+		Username:  username,
+		Result:    auditResultOk,
+		Actor:     requestActor(r),
+	}
+	if err != nil {
+		entry.Result = err.Error()
+	}
+	// there is a single api token, so it's the only principal that can be told apart
+	if *apiAuthToken != "" && checkApiToken(r) {
+		entry.Principal = auditApiTokenPrincipal
+	}
+	oAdmin.audit.Append(entry)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// withAdminAuth requires --api.auth-token for handler, every request is refused while it isn't set
+func (oAdmin *OvpnAdmin) withAdminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *apiAuthToken == "" {
+			log.Warnf("request from %s to %s refused, --api.auth-token isn't set", r.RemoteAddr, r.URL.Path)
+			http.Error(w, "forbidden: --api.auth-token isn't set", http.StatusForbidden)
+			return
+		}
+		if !checkApiToken(r) {
+			log.Warnf("unauthorized request from %s to %s", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// withAuth requires --api.auth-token for handler if it's set
+func (oAdmin *OvpnAdmin) withAuth(h http.HandlerFunc) http.HandlerFunc {
+	if *apiAuthToken == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkApiToken(r) {
+			log.Warnf("unauthorized request from %s to %s", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// withReadAuth requires --api.auth-token for read-only handler only if --api.auth-all is set
+func (oAdmin *OvpnAdmin) withReadAuth(h http.HandlerFunc) http.HandlerFunc {
+	if !*apiAuthAll {
+		return h
+	}
+	return oAdmin.withAuth(h)
+}
+
+// checkApiToken accepts token from "Authorization: Bearer" header or from "token" query parameter,
+// request body is left for the handler
+func checkApiToken(r *http.Request) bool {
+	token := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else {
+		token = r.URL.Query().Get("token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*apiAuthToken)) == 1
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUserShowChainAdminAuth(t *testing.T) {
+	oAdmin := &OvpnAdmin{}
+	handler := oAdmin.withAdminAuth(oAdmin.userShowChainHandler)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/user/chain?username=alice", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("chain without --api.auth-token answered %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	setFlag(t, apiAuthToken, "secret")
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/api/user/chain?username=alice", nil),
+		httptest.NewRequest("GET", "/api/user/chain?username=alice&token=wrong", nil),
+	} {
+		w = httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("chain of %s answered %d, want %d", r.URL, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	called := 0
+	handler = oAdmin.withAdminAuth(func(w http.ResponseWriter, r *http.Request) { called++ })
+	r := httptest.NewRequest("GET", "/api/user/chain?username=alice", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	handler(httptest.NewRecorder(), r)
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/user/chain?username=alice&token=secret", nil))
+	if called != 2 {
+		t.Errorf("handler is called %d times with valid token, want 2", called)
+	}
+}
+
+func TestCcdImportAuthSizeLimit(t *testing.T) {
+	setFlag(t, apiAuthToken, "secret")
+	oAdmin := &OvpnAdmin{role: "master"}
+	handler := oAdmin.withAuth(oAdmin.ccdImportHandler)
+
+	newImport := func(url string, size int) *http.Request {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		form.WriteField("token", "secret")
+		archive, _ := form.CreateFormFile("archive", "ccd.tar.gz")
+		archive.Write(make([]byte, size))
+		form.Close()
+		r := httptest.NewRequest("POST", url, body)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, newImport("/api/ccd/import", 1024))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("import with token in form body answered %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, newImport("/api/ccd/import?token=secret", ccdImportMaxSize+1024))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too large") {
+		t.Errorf("oversized import answered %d %q, want %d with size limit error", w.Code, w.Body.String(), http.StatusBadRequest)
+	}
+}
@@ -6,6 +6,6 @@ cd frontend && npm install && npm run build && cd ..
 
 packr2
 
-CGO_ENABLED=1 GOOS=linux GOARCH=${GOARCH:-amd64} go build -a -tags netgo -ldflags "-linkmode external -extldflags -static -s -w" $@
+CGO_ENABLED=1 GOOS=linux GOARCH=${GOARCH:-amd64} go build -a -tags netgo -ldflags "-linkmode external -extldflags -static -s -w ${VERSION:+-X main.version=${VERSION}}" $@
 
 packr2 clean
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const ccdImportMaxSize = 10 << 20
+
+type ccdAllocation struct {
+	User          string `json:"User"`
+	ClientAddress string `json:"ClientAddress"`
+}
+
+type ccdImportResult struct {
+	User          string `json:"User"`
+	ClientAddress string `json:"ClientAddress"`
+	Valid         bool   `json:"Valid"`
+	Error         string `json:"Error"`
+	Written       bool   `json:"Written"`
+}
+
+func (oAdmin *OvpnAdmin) ccdImportHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if oAdmin.role == "slave" {
+		writeJSONError(w, http.StatusLocked, "not available on slave")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, ccdImportMaxSize)
+	archive, _, err := r.FormFile("archive")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("please send tar.gz archive with ccd files in \"archive\" field: %s", err))
+		return
+	}
+	defer archive.Close()
+
+	files, err := readCcdArchive(archive)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	confirm := r.FormValue("confirm") == "true"
+	results := oAdmin.ccdImport(files, confirm)
+	if confirm {
+		for _, result := range results {
+			var err error
+			if !result.Written {
+				err = errors.New(result.Error)
+			}
+			oAdmin.auditOperation(r, "ccd-import", result.User, err)
+		}
+	}
+
+	writeJSON(w, struct {
+		Confirmed bool              `json:"Confirmed"`
+		Results   []ccdImportResult `json:"Results"`
+	}{confirm, results})
+}
+
+// readCcdArchive returns content of regular files from tar.gz archive keyed by file name
+func readCcdArchive(archive io.Reader) (map[string]string, error) {
+	files := make(map[string]string)
+
+	uncompressedStream, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("archive is not gzip compressed: %s", err)
+	}
+
+	tarReader := tar.NewReader(uncompressedStream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %s", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from archive: %s", header.Name, err)
+		}
+		files[filepath.Base(header.Name)] = string(content)
+	}
+
+	return files, nil
+}
+
+// ccdImport validates every ccd file and writes valid ones only when confirm is true
+func (oAdmin *OvpnAdmin) ccdImport(files map[string]string, confirm bool) []ccdImportResult {
+	var results []ccdImportResult
+	addressOwners := make(map[string]string)
+
+	for _, username := range sortedKeys(files) {
+		ccd := parseCcdText(username, files[username])
+		result := ccdImportResult{User: username, ClientAddress: ccd.ClientAddress}
+
+		if err := validateUsername(username); err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		if !oAdmin.users.Exists(username) {
+			result.Error = fmt.Sprintf("User \"%s\" not found", username)
+			results = append(results, result)
+			continue
+		}
+
+		if _, errMsg := validateCcd(ccd); errMsg != "" {
+			result.Error = errMsg
+			results = append(results, result)
+			continue
+		}
+
+		if ccd.ClientAddress != "dynamic" {
+			address := net.ParseIP(ccd.ClientAddress).String()
+			if owner, ok := addressOwners[address]; ok {
+				result.Error = fmt.Sprintf("ClientAddress \"%s\" already assigned to user %s in the same archive", ccd.ClientAddress, owner)
+				results = append(results, result)
+				continue
+			}
+			addressOwners[address] = username
+		}
+
+		result.Valid = true
+		results = append(results, result)
+	}
+
+	if !confirm {
+		return results
+	}
+
+	for i := range results {
+		if !results[i].Valid {
+			continue
+		}
+		username := results[i].User
+		err := writeCcdText(username, files[username])
+		if err != nil {
+			log.Errorf("ccdImport: fWrite(): %v", err)
+			results[i].Error = fmt.Sprintf("failed to write ccd: %s", err)
+			continue
+		}
+		results[i].Written = true
+		log.WithField("username", username).Info("ccd imported")
+	}
+
+	return results
+}
+
+func (oAdmin *OvpnAdmin) ccdAllocationsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	writeJSON(w, ccdAllocations())
+}
+
+// ccdAllocations returns static addresses of all users sorted by address
+func ccdAllocations() []ccdAllocation {
+	allocations := []ccdAllocation{}
+
+	for user, txt := range readCcdDir() {
+		ccd := parseCcdText(user, txt)
+		if ccd.ClientAddress == "dynamic" {
+			continue
+		}
+		allocations = append(allocations, ccdAllocation{User: user, ClientAddress: ccd.ClientAddress})
+	}
+
+	sort.Slice(allocations, func(i, j int) bool {
+		c := bytes.Compare(net.ParseIP(allocations[i].ClientAddress).To16(), net.ParseIP(allocations[j].ClientAddress).To16())
+		if c == 0 {
+			return allocations[i].User < allocations[j].User
+		}
+		return c < 0
+	})
+
+	return allocations
+}
+
+func (oAdmin *OvpnAdmin) ccdNextFreeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	address, err := nextFreeStaticAddress()
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, ccdAllocation{ClientAddress: address.String()})
+}
+
+// nextFreeStaticAddress returns the lowest address of the first openvpn server network
+// which is not assigned to any user. The network address and the first host address,
+// which openvpn server takes for itself in subnet topology, are never returned.
+func nextFreeStaticAddress() (net.IP, error) {
+	networks := openvpnNetworks()
+	if len(networks) == 0 {
+		return nil, errors.New("openvpn server network is not configured")
+	}
+	ovpnNet := networks[0]
+
+	taken := make(map[string]bool)
+	for _, allocation := range ccdAllocations() {
+		taken[net.ParseIP(allocation.ClientAddress).String()] = true
+	}
+
+	ip := nextIP(nextIP(ovpnNet.IP.Mask(ovpnNet.Mask)))
+	for ; ovpnNet.Contains(ip); ip = nextIP(ip) {
+		if ip.To4() != nil && isBroadcast(ip, ovpnNet) {
+			break
+		}
+		if !taken[ip.String()] {
+			return ip, nil
+		}
+	}
+
+	return nil, fmt.Errorf("there are no free addresses left in openvpn server network %s", ovpnNet)
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func isBroadcast(ip net.IP, network *net.IPNet) bool {
+	ip = ip.To4()
+	mask := network.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	for i := range ip {
+		if ip[i]|mask[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
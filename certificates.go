@@ -4,17 +4,28 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"math/big"
+	"strings"
+	"sync"
 	"time"
 )
 
+var oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
 // decode certificate from PEM to x509
 func decodeCert(certPEMBytes []byte) (cert *x509.Certificate, err error) {
 	certPem, _ := pem.Decode(certPEMBytes)
+	if certPem == nil {
+		err = errors.New("no PEM data found")
+		return
+	}
 	certPemBytes := certPem.Bytes
 
 	cert, err = x509.ParseCertificate(certPemBytes)
@@ -25,6 +36,75 @@ func decodeCert(certPEMBytes []byte) (cert *x509.Certificate, err error) {
 	return
 }
 
+// return SHA-256 of DER certificate as colon separated uppercase hex, the way openssl x509 -fingerprint prints it
+func sha256Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+type certCacheEntry struct {
+	modTime time.Time
+	size    int64
+	cert    *x509.Certificate
+}
+
+var certCache = struct {
+	sync.Mutex
+	entries map[string]certCacheEntry
+}{entries: make(map[string]certCacheEntry)}
+
+// return parsed PEM certificate at path, it's cached until modtime or size of the file changes
+func readCertCached(path string) (*x509.Certificate, error) {
+	info, err := pkiFS.Stat(path)
+	if err != nil {
+		certCache.Lock()
+		delete(certCache.entries, path)
+		certCache.Unlock()
+		return nil, err
+	}
+
+	certCache.Lock()
+	entry, ok := certCache.entries[path]
+	certCache.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.cert, nil
+	}
+
+	data, err := pkiFS.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := decodeCert(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parse certificate %s: %s", path, err)
+	}
+
+	certCache.Lock()
+	certCache.entries[path] = certCacheEntry{modTime: info.ModTime(), size: info.Size(), cert: cert}
+	certCache.Unlock()
+	return cert, nil
+}
+
+// return only CERTIFICATE blocks from PEM data, dropping keys and any text around them
+func pemCertificates(data []byte) []byte {
+	var out bytes.Buffer
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			_ = pem.Encode(&out, block)
+		}
+	}
+	return out.Bytes()
+}
+
 // decode private key from PEM to RSA format
 func decodePrivKey(privKey []byte) (key *rsa.PrivateKey, err error) {
 	privKeyPem, _ := pem.Decode(privKey)
@@ -164,8 +244,22 @@ func genClientCert(privKey, caPrivKey *rsa.PrivateKey, ca *x509.Certificate, cn
 func genCRL(certs []*RevokedCert, ca *x509.Certificate, caKey *rsa.PrivateKey) (crlPEM *bytes.Buffer, err error) {
 	var revokedCertificates []pkix.RevokedCertificate
 
+	crlValidityDays := 180
+	if *crlDays > 0 {
+		crlValidityDays = *crlDays
+	}
+
 	for _, cert := range certs {
-		revokedCertificates = append(revokedCertificates, pkix.RevokedCertificate{SerialNumber: cert.Cert.SerialNumber, RevocationTime: cert.RevokedTime})
+		revokedCertificate := pkix.RevokedCertificate{SerialNumber: cert.Cert.SerialNumber, RevocationTime: cert.RevokedTime}
+		// RFC 5280 recommends to omit reasonCode extension for unspecified reason
+		if code := revocationReasons[cert.Reason]; code != 0 {
+			reasonCode, err := asn1.Marshal(asn1.Enumerated(code))
+			if err != nil {
+				return nil, err
+			}
+			revokedCertificate.Extensions = []pkix.Extension{{Id: oidExtensionReasonCode, Value: reasonCode}}
+		}
+		revokedCertificates = append(revokedCertificates, revokedCertificate)
 	}
 
 	revocationList := &x509.RevocationList{
@@ -173,7 +267,7 @@ func genCRL(certs []*RevokedCert, ca *x509.Certificate, caKey *rsa.PrivateKey) (
 		RevokedCertificates: revokedCertificates,
 		Number:              big.NewInt(1),
 		ThisUpdate:          time.Now(),
-		NextUpdate:          time.Now().Add(180 * time.Hour * 24),
+		NextUpdate:          time.Now().Add(time.Duration(crlValidityDays) * time.Hour * 24),
 		//ExtraExtensions: []pkix.Extension{},
 	}
 
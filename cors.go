@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// withCORS answers CORS preflight and sets Access-Control-Allow-* headers on api/ requests from
+// --cors.allowed-origins, so the UI can be served from another origin. Nothing is set if the flag is empty
+func withCORS(h http.Handler) http.Handler {
+	origins := corsOrigins()
+	if len(origins) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !strings.HasPrefix(r.URL.Path, *listenBaseUrl+"api/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !corsOriginAllowed(origins, origin) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+
+		// preflight never reaches handlers, withAuth would reject it as browsers don't send credentials there
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// corsOrigins returns comma separated --cors.allowed-origins as a list
+func corsOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(*corsAllowedOrigins, ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+func corsOriginAllowed(origins []string, origin string) bool {
+	for _, allowed := range origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
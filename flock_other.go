@@ -0,0 +1,20 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var lockIndexTxtWarning sync.Once
+
+// lockIndexTxt does nothing where flock isn't available, index.txt is guarded by pkiMutex only
+func lockIndexTxt() func() {
+	lockIndexTxtWarning.Do(func() {
+		log.Warn("flock is not supported on this platform, index.txt changes made by other tools may be lost")
+	})
+	return func() {}
+}
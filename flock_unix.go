@@ -0,0 +1,33 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// lockIndexTxt takes advisory exclusive flock on index.txt, so changes of ovpn-admin don't interleave
+// with external tools locking the same file, e.g. `flock pki/index.txt easyrsa ...` in cron.
+// Returned func releases the lock, index.txt is left unlocked if it can't be locked
+func lockIndexTxt() func() {
+	file, err := os.Open(*indexTxtPath)
+	if err != nil {
+		log.Warnf("lockIndexTxt: %s", err)
+		return func() {}
+	}
+	if err = unix.Flock(int(file.Fd()), unix.LOCK_EX); err != nil {
+		log.Warnf("lockIndexTxt: flock %s: %s", *indexTxtPath, err)
+		file.Close()
+		return func() {}
+	}
+	return func() {
+		if err := unix.Flock(int(file.Fd()), unix.LOCK_UN); err != nil {
+			log.Warnf("lockIndexTxt: unlock %s: %s", *indexTxtPath, err)
+		}
+		file.Close()
+	}
+}
@@ -184,11 +184,14 @@ new Vue({
       hideRevoked: true,
     },
     serverRole: "master",
+    readOnly: false,
     lastSync: "unknown",
+    lastSyncMaster: "",
     modulesEnabled: [],
     u: {
       newUserName: '',
       newUserPassword: '',
+      newUserEmail: '',
       newUserCreateError: '',
       newPassword: '',
       passwordChangeStatus: '',
@@ -256,18 +259,18 @@ new Vue({
       data.append('username', _this.username);
       axios.request(axios_cfg('api/user/config/show', data, 'form'))
       .then(function(response) {
-        _this.u.openvpnConfig = response.data;
+        _this.u.openvpnConfig = response.data.data;
       });
     })
     _this.$root.$on('u-download-config', function () {
       var data = new URLSearchParams();
       data.append('username', _this.username);
-      axios.request(axios_cfg('api/user/config/show', data, 'form'))
+      axios.request(Object.assign(axios_cfg('api/user/config/download', data, 'form'), { responseType: 'blob' }))
       .then(function(response) {
-        const blob = new Blob([response.data], { type: 'text/plain' })
+        const blob = response.data
         const link = document.createElement('a')
         link.href = URL.createObjectURL(blob)
-        link.download = _this.username + ".ovpn"
+        link.download = _this.username + (blob.type == 'application/zip' ? ".zip" : ".ovpn")
         link.click()
         URL.revokeObjectURL(link.href)
       }).catch(console.error);
@@ -278,7 +281,7 @@ new Vue({
       data.append('username', _this.username);
       axios.request(axios_cfg('api/user/ccd', data, 'form'))
       .then(function(response) {
-        _this.u.ccd = response.data;
+        _this.u.ccd = response.data.data;
       });
     })
     _this.$root.$on('u-disconnect-user', function () {
@@ -287,7 +290,11 @@ new Vue({
       data.append('username', _this.username);
       axios.request(axios_cfg('api/user/disconnect', data, 'form'))
       .then(function(response) {
-        console.log(response.data);
+        _this.getUserData();
+        _this.$notify({title: 'User ' + _this.username + ' disconnected!', type: 'warn'})
+      })
+      .catch(function(error) {
+        _this.$notify({title: 'User ' + _this.username + ' not disconnected: ' + error.response.data.message, type: 'error'})
       });
     })
     _this.$root.$on('u-change-password', function () {
@@ -365,7 +372,7 @@ new Vue({
       var _this = this;
       axios.request(axios_cfg('api/users/list'))
         .then(function(response) {
-          _this.rows = Array.isArray(response.data) ? response.data : [];
+          _this.rows = Array.isArray(response.data.data) ? response.data.data : [];
         });
     },
 
@@ -373,13 +380,15 @@ new Vue({
       var _this = this;
       axios.request(axios_cfg('api/server/settings'))
       .then(function(response) {
-        _this.serverRole = response.data.serverRole;
-        _this.modulesEnabled = response.data.modules;
+        _this.serverRole = response.data.data.serverRole;
+        _this.readOnly = response.data.data.readOnly;
+        _this.modulesEnabled = response.data.data.modules;
 
         if (_this.serverRole == "slave") {
-          axios.request(axios_cfg('api/sync/last/successful'))
+          axios.request(axios_cfg('api/sync/status'))
           .then(function(response) {
-            _this.lastSync =  response.data;
+            _this.lastSync = response.data.data.LastSuccessfulSyncTime;
+            _this.lastSyncMaster = response.data.data.LastSuccessfulMaster;
           });
         }
       });
@@ -393,6 +402,7 @@ new Vue({
       var data = new URLSearchParams();
       data.append('username', _this.u.newUserName);
       data.append('password', _this.u.newUserPassword);
+      data.append('email', _this.u.newUserEmail);
 
       _this.username = _this.u.newUserName;
 
@@ -402,10 +412,11 @@ new Vue({
         _this.u.modalNewUserVisible = false;
         _this.u.newUserName = '';
         _this.u.newUserPassword = '';
+        _this.u.newUserEmail = '';
         _this.getUserData();
       })
       .catch(function(error) {
-        _this.u.newUserCreateError = error.response.data;
+        _this.u.newUserCreateError = error.response.data.message;
         _this.$notify({title: 'New user ' + _this.username + ' creation failed.', type: 'error'})
 
       });
@@ -420,12 +431,12 @@ new Vue({
       axios.request(axios_cfg('api/user/ccd/apply', JSON.stringify(_this.u.ccd), 'json'))
       .then(function(response) {
         _this.u.ccdApplyStatus = 200;
-        _this.u.ccdApplyStatusMessage = response.data;
+        _this.u.ccdApplyStatusMessage = response.data.message;
         _this.$notify({title: 'Ccd for user ' + _this.username + ' applied', type: 'success'})
       })
       .catch(function(error) {
         _this.u.ccdApplyStatus = error.response.status;
-        _this.u.ccdApplyStatusMessage = error.response.data;
+        _this.u.ccdApplyStatusMessage = error.response.data.message;
         _this.$notify({title: 'Ccd for user ' + _this.username + ' apply failed ', type: 'error'})
       });
     },
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fileSystem is the storage of pki, index.txt, ccd and state files of OvpnAdmin.
+// Paths are the same as used with os package, either absolute or relative to working dir
+type fileSystem interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	// ReadDir returns entries of dir sorted by name
+	ReadDir(name string) ([]os.FileInfo, error)
+	MkdirAll(name string, perm os.FileMode) error
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+}
+
+// pkiFS backs package level helpers fRead, fWrite, fExist, fCreate, fDelete and fCopy,
+// main points it to OvpnAdmin.fs, so they share the filesystem with the rest of OvpnAdmin
+var pkiFS fileSystem = osFileSystem{}
+
+type osFileSystem struct{}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (osFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (osFileSystem) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (osFileSystem) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+func (osFileSystem) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+// Link lets fCopy hard link files instead of copying them
+func (osFileSystem) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+var errReadOnlyFileSystem = errors.New("read-only file system")
+
+// readOnlyFileSystem serves pki from fs.FS, e.g. embed.FS or fstest.MapFS. Leading "/" and "./" of
+// paths are dropped as fs.FS takes unrooted slash-separated paths only. All writes fail
+type readOnlyFileSystem struct {
+	fsys fs.FS
+}
+
+func newReadOnlyFileSystem(fsys fs.FS) fileSystem {
+	return readOnlyFileSystem{fsys: fsys}
+}
+
+func (r readOnlyFileSystem) name(name string) string {
+	if name = strings.TrimPrefix(path.Clean("/"+name), "/"); name == "" {
+		return "."
+	}
+	return name
+}
+
+func (r readOnlyFileSystem) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(r.fsys, r.name(name))
+}
+
+func (r readOnlyFileSystem) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(r.fsys, r.name(name))
+}
+
+func (r readOnlyFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return &fs.PathError{Op: "write", Path: name, Err: errReadOnlyFileSystem}
+}
+
+func (r readOnlyFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(r.fsys, r.name(name))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (r readOnlyFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: errReadOnlyFileSystem}
+}
+
+func (r readOnlyFileSystem) Open(name string) (io.ReadCloser, error) {
+	return r.fsys.Open(r.name(name))
+}
+
+func (r readOnlyFileSystem) Create(name string) (io.WriteCloser, error) {
+	return nil, &fs.PathError{Op: "create", Path: name, Err: errReadOnlyFileSystem}
+}
+
+func (r readOnlyFileSystem) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errReadOnlyFileSystem}
+}
+
+func (r readOnlyFileSystem) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: errReadOnlyFileSystem}
+}
+
+func (r readOnlyFileSystem) RemoveAll(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: errReadOnlyFileSystem}
+}
+
+// walkFiles returns all regular files under dir in the order of filepath.Walk
+func walkFiles(fsys fileSystem, dir string) ([]string, error) {
+	info, err := fsys.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{dir}, nil
+	}
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			files = append(files, name)
+			continue
+		}
+		sub, err := walkFiles(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// tempName returns unused-looking name of a temp file or dir for name, it's hidden and put next to name,
+// so renaming it to name stays on the same filesystem
+func tempName(name string) string {
+	suffix := make([]byte, 8)
+	_, _ = rand.Read(suffix)
+	return filepath.Join(filepath.Dir(filepath.Clean(name)), "."+filepath.Base(name)+"-"+hex.EncodeToString(suffix))
+}
+
+// writeFileAtomic writes data through a temp file renamed to name, so a crash never leaves a truncated file behind
+func writeFileAtomic(fsys fileSystem, name string, data []byte, perm os.FileMode) error {
+	tmp := tempName(name)
+	if err := fsys.WriteFile(tmp, data, perm); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	if err := fsys.Rename(tmp, name); err != nil {
+		_ = fsys.Remove(tmp)
+		return err
+	}
+	return nil
+}
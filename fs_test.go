@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// memFileSystem is in-memory fileSystem for tests, it counts writes of every file
+type memFileSystem struct {
+	mutex   sync.Mutex
+	files   map[string][]byte
+	modTime map[string]time.Time
+	dirs    map[string]bool
+	writes  map[string]int
+	clock   int64
+}
+
+func newMemFileSystem(files map[string]string) *memFileSystem {
+	m := &memFileSystem{files: map[string][]byte{}, modTime: map[string]time.Time{}, dirs: map[string]bool{}, writes: map[string]int{}}
+	for name, content := range files {
+		m.put(filepath.Clean(name), []byte(content))
+	}
+	return m
+}
+
+// put stores file and makes its parent dirs, caller holds mutex unless m isn't shared yet
+func (m *memFileSystem) put(name string, data []byte) {
+	m.clock++
+	m.files[name] = data
+	m.modTime[name] = time.Unix(0, m.clock)
+	for dir := filepath.Dir(name); !m.dirs[dir]; dir = filepath.Dir(dir) {
+		m.dirs[dir] = true
+	}
+}
+
+func (m *memFileSystem) writeCount(name string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.writes[filepath.Clean(name)]
+}
+
+func (m *memFileSystem) content(name string) (string, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.files[filepath.Clean(name)]
+	return string(data), ok
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFileSystem) Stat(name string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	name = filepath.Clean(name)
+	if data, ok := m.files[name]; ok {
+		return memFileInfo{name: filepath.Base(name), size: int64(len(data)), modTime: m.modTime[name]}, nil
+	}
+	if m.dirs[name] {
+		return memDirInfo(filepath.Base(name)), nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (m *memFileSystem) ReadFile(name string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (m *memFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	name = filepath.Clean(name)
+	m.writes[name]++
+	m.put(name, append([]byte{}, data...))
+	return nil
+}
+
+func (m *memFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	name = filepath.Clean(name)
+	if !m.dirs[name] {
+		return nil, notExist("readdir", name)
+	}
+	var infos []os.FileInfo
+	for file, data := range m.files {
+		if filepath.Dir(file) == name {
+			infos = append(infos, memFileInfo{name: filepath.Base(file), size: int64(len(data)), modTime: m.modTime[file]})
+		}
+	}
+	for dir := range m.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			infos = append(infos, memDirInfo(filepath.Base(dir)))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *memFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for dir := filepath.Clean(name); !m.dirs[dir]; dir = filepath.Dir(dir) {
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *memFileSystem) Open(name string) (io.ReadCloser, error) {
+	data, err := m.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// memFile is stored on Close
+type memFile struct {
+	bytes.Buffer
+	m    *memFileSystem
+	name string
+}
+
+func (f *memFile) Close() error {
+	return f.m.WriteFile(f.name, f.Bytes(), 0644)
+}
+
+func (m *memFileSystem) Create(name string) (io.WriteCloser, error) {
+	return &memFile{m: m, name: name}, nil
+}
+
+func (m *memFileSystem) Rename(oldname, newname string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	data, ok := m.files[oldname]
+	if !ok {
+		return notExist("rename", oldname)
+	}
+	delete(m.files, oldname)
+	m.put(newname, data)
+	return nil
+}
+
+func (m *memFileSystem) Remove(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if m.dirs[name] {
+		delete(m.dirs, name)
+		return nil
+	}
+	return notExist("remove", name)
+}
+
+func (m *memFileSystem) RemoveAll(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	name = filepath.Clean(name)
+	for file := range m.files {
+		if file == name || strings.HasPrefix(file, name+"/") {
+			delete(m.files, file)
+		}
+	}
+	for dir := range m.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0644 }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+type memDirInfo string
+
+func (i memDirInfo) Name() string       { return string(i) }
+func (i memDirInfo) Size() int64        { return 0 }
+func (i memDirInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (i memDirInfo) ModTime() time.Time { return time.Time{} }
+func (i memDirInfo) IsDir() bool        { return true }
+func (i memDirInfo) Sys() interface{}   { return nil }
+
+const testIndexTxt = "V\t310101000000Z\t\t01\tunknown\t/CN=server\n" +
+	"V\t310101000000Z\t\t02\tunknown\t/CN=alice\n" +
+	"R\t310101000000Z\t210101000000Z,keyCompromise\t03\tunknown\t/CN=bob\n"
+
+func TestIndexTxtStoreInMemory(t *testing.T) {
+	mem := newMemFileSystem(map[string]string{"/pki/index.txt": testIndexTxt})
+	store := &indexTxtStore{fs: mem, path: "/pki/index.txt"}
+
+	if lines := store.List(); len(lines) != 3 {
+		t.Fatalf("List() returned %d lines, want 3", len(lines))
+	}
+	if line, ok := store.Get("bob"); !ok || line.Flag != "R" || line.RevocationReason != "keyCompromise" {
+		t.Errorf("Get(bob) = %+v, %t", line, ok)
+	}
+
+	if err := mem.WriteFile("/pki/index.txt", []byte(testIndexTxt+"V\t310101000000Z\t\t04\tunknown\t/CN=carol\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Exists("carol") {
+		t.Error("index.txt change isn't noticed")
+	}
+}
+
+func TestArchiveRoundTripInMemory(t *testing.T) {
+	pki := map[string]string{
+		"/master/pki/ca.crt":        "ca",
+		"/master/pki/index.txt":     testIndexTxt,
+		"/master/pki/issued/a.crt":  "cert of a",
+		"/master/pki/private/a.key": "key of a",
+	}
+	files := map[string]string{"/slave/pki/index.txt": "old"}
+	for name, content := range pki {
+		files[name] = content
+	}
+	mem := newMemFileSystem(files)
+	oAdmin := &OvpnAdmin{fs: mem}
+
+	w := httptest.NewRecorder()
+	oAdmin.serveArchive(w, httptest.NewRequest("GET", "/", nil), "/master/pki", certsArchiveFileName)
+	if w.Code != 200 || w.Header().Get("ETag") == "" {
+		t.Fatalf("serveArchive answered %d with ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	if err := mem.WriteFile("/tmp/certs.tar.gz", w.Body.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractFromArchiveSafely(mem, "/tmp/certs.tar.gz", "/slave/pki", "ca.crt", "index.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range pki {
+		got, _ := mem.content(strings.Replace(name, "/master/", "/slave/", 1))
+		if got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	entries, _ := mem.ReadDir("/slave")
+	if len(entries) != 1 {
+		t.Errorf("temp dir is left next to pki: %v", entries)
+	}
+}
+
+func TestReadOnlyFileSystem(t *testing.T) {
+	ro := newReadOnlyFileSystem(fstest.MapFS{
+		"pki/index.txt": {Data: []byte(testIndexTxt)},
+		"ccd/alice":     {Data: []byte("ifconfig-push 172.16.100.5 255.255.255.0\n")},
+	})
+
+	store := &indexTxtStore{fs: ro, path: "/pki/index.txt"}
+	if !store.Exists("alice") {
+		t.Error("alice isn't found in read-only index.txt")
+	}
+	if ccd := readCcdFiles(ro, "./ccd"); ccd["alice"] == "" {
+		t.Errorf("readCcdFiles() = %v", ccd)
+	}
+	if err := ro.WriteFile("/pki/index.txt", nil, 0644); err == nil {
+		t.Error("WriteFile() succeeded on read-only file system")
+	}
+}
@@ -4,7 +4,10 @@ go 1.17
 
 require (
 	github.com/gobuffalo/packr/v2 v2.8.3
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/prometheus/client_golang v1.11.0
+	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9
+	golang.org/x/time v0.0.0-20211116232009-f0f3c7e86c11
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	k8s.io/apimachinery v0.23.1
 	k8s.io/client-go v0.23.1
@@ -42,10 +45,8 @@ require (
 	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871 // indirect
 	golang.org/x/net v0.0.0-20220114011407-0dd24b26b47d // indirect
 	golang.org/x/oauth2 v0.0.0-20211104180415-d3ed0bb246c8 // indirect
-	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9 // indirect
 	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211 // indirect
 	golang.org/x/text v0.3.7 // indirect
-	golang.org/x/time v0.0.0-20211116232009-f0f3c7e86c11 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
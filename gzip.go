@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipMinSize is the smallest response compressed by withGzip, smaller ones fit in a packet anyway
+const gzipMinSize = 1400
+
+// gzipResponseWriter buffers response till gzipMinSize bytes are written and compresses it from then on.
+// Shorter responses are sent as is by Close
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	started bool
+	// gzipCached is set if the client has gzip encoded response cached, 304 to it keeps ETag of that response
+	gzipCached bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	if w.started {
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= gzipMinSize {
+		if err := w.start(!gzipCompressed(w.Header().Get("Content-Type"))); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start writes headers and buffered response, compressed or not
+func (w *gzipResponseWriter) start(compress bool) error {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if etag := w.Header().Get("ETag"); etag != "" && (compress || w.status == http.StatusNotModified && w.gzipCached) {
+		w.Header().Set("ETag", gzipETag(etag))
+	}
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.ResponseWriter.WriteHeader(w.status)
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+		_, err := w.gz.Write(w.buf)
+		return err
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf)
+	return err
+}
+
+func (w *gzipResponseWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	if !w.started {
+		return w.start(false)
+	}
+	return nil
+}
+
+// gzipETag tells gzip encoded response from identity one, so caches and If-None-Match don't mix them up
+func gzipETag(etag string) string {
+	if strings.HasSuffix(etag, `"`) {
+		return strings.TrimSuffix(etag, `"`) + `-gzip"`
+	}
+	return etag + "-gzip"
+}
+
+// gzipCompressed reports whether contentType is compressed already
+func gzipCompressed(contentType string) bool {
+	for _, t := range []string{"application/gzip", "application/x-gzip", "application/zip"} {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// withGzip compresses api/ responses larger than gzipMinSize for clients accepting gzip if --http.gzip is set.
+// Certs and ccd archives served to slaves are tar.gz already and are left alone
+func withGzip(h http.Handler) http.Handler {
+	if !*httpGzip {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, *listenBaseUrl+"api/") ||
+			r.URL.Path == *listenBaseUrl+downloadCertsApiUrl || r.URL.Path == *listenBaseUrl+downloadCcdApiUrl {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		// handlers compare If-None-Match with ETag of identity response
+		if inm := r.Header.Get("If-None-Match"); strings.Contains(inm, `-gzip"`) {
+			r.Header.Set("If-None-Match", strings.ReplaceAll(inm, `-gzip"`, `"`))
+			gw.gzipCached = true
+		}
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithGzipETag(t *testing.T) {
+	previous := *httpGzip
+	*httpGzip = true
+	defer func() { *httpGzip = previous }()
+
+	body := strings.Repeat("x", 2*gzipMinSize)
+	h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+
+	for _, tc := range []struct {
+		acceptEncoding, ifNoneMatch string
+		code                        int
+		encoding, etag              string
+	}{
+		{"", "", http.StatusOK, "", `"v1"`},
+		{"gzip", "", http.StatusOK, "gzip", `"v1-gzip"`},
+		{"gzip", `"v1-gzip"`, http.StatusNotModified, "", `"v1-gzip"`},
+		{"", `"v1"`, http.StatusNotModified, "", `"v1"`},
+	} {
+		r := httptest.NewRequest("GET", "/api/users/list", nil)
+		if tc.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		if tc.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", tc.ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.code || w.Header().Get("Content-Encoding") != tc.encoding || w.Header().Get("ETag") != tc.etag {
+			t.Errorf("Accept-Encoding %q, If-None-Match %q: answered %d with Content-Encoding %q and ETag %q, want %d, %q and %q",
+				tc.acceptEncoding, tc.ifNoneMatch, w.Code, w.Header().Get("Content-Encoding"), w.Header().Get("ETag"), tc.code, tc.encoding, tc.etag)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Vary = %q", tc.acceptEncoding, w.Header().Get("Vary"))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const healthMgmtDialTimeout = 2 * time.Second
+
+type healthCheck struct {
+	Name     string `json:"Name"`
+	Ok       bool   `json:"Ok"`
+	Critical bool   `json:"Critical"`
+	Message  string `json:"Message"`
+}
+
+// healthzHandler reports readiness: index.txt is present, at least one mgmt interface is reachable
+// and for slaves at least one sync with master succeeded
+func (oAdmin *OvpnAdmin) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug(r.RemoteAddr, " ", r.RequestURI)
+	checks := oAdmin.healthChecks()
+
+	resp := apiResponse{Status: "ok"}
+	code := http.StatusOK
+	for _, check := range checks {
+		if check.Critical && !check.Ok {
+			resp = apiResponse{Status: "error", Message: fmt.Sprintf("%s: %s", check.Name, check.Message)}
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	resp.Data = struct {
+		Ready  bool          `json:"Ready"`
+		Checks []healthCheck `json:"Checks"`
+	}{code == http.StatusOK, checks}
+	writeJSONResponse(w, code, resp)
+}
+
+func (oAdmin *OvpnAdmin) healthChecks() []healthCheck {
+	var checks []healthCheck
+
+	indexTxt := healthCheck{Name: "index.txt", Ok: true, Critical: true}
+	if !fExist(*indexTxtPath) {
+		indexTxt.Ok = false
+		indexTxt.Message = fmt.Sprintf("%s not found", *indexTxtPath)
+	}
+	checks = append(checks, indexTxt)
+
+	// a single unreachable mgmt interface doesn't stop status polling of the others
+	mgmtReachable := 0
+	for _, srv := range sortedKeys(oAdmin.mgmtInterfaces) {
+		mgmt := healthCheck{Name: "mgmt/" + srv, Ok: true}
+		conn, err := net.DialTimeout("tcp", oAdmin.mgmtInterfaces[srv], healthMgmtDialTimeout)
+		if err != nil {
+			mgmt.Ok = false
+			mgmt.Message = err.Error()
+		} else {
+			conn.Close()
+			mgmtReachable += 1
+		}
+		checks = append(checks, mgmt)
+	}
+	mgmt := healthCheck{Name: "mgmt", Ok: mgmtReachable > 0, Critical: true}
+	if !mgmt.Ok {
+		mgmt.Message = "no openvpn mgmt interface is reachable"
+	}
+	checks = append(checks, mgmt)
+
+	if oAdmin.role == "slave" {
+		masterSync := healthCheck{Name: "sync", Ok: true, Critical: true}
+		if oAdmin.getSyncStatus().LastSuccessfulSyncTime == "unknown" {
+			masterSync.Ok = false
+			masterSync.Message = fmt.Sprintf("no successful sync with %s yet", strings.Join(oAdmin.getSyncStatus().Masters, ", "))
+		}
+		checks = append(checks, masterSync)
+	}
+
+	return checks
+}
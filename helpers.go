@@ -2,7 +2,11 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -32,18 +37,62 @@ func parseDateToUnix(layout, datetime string) int64 {
 	return parseDate(layout, datetime).Unix()
 }
 
-func runBash(script string) string {
-	log.Debugln(script)
-	cmd := exec.Command("bash", "-c", script)
-	stdout, err := cmd.CombinedOutput()
+// expireDays returns number of whole days from now till expire, both in unix format
+func expireDays(expire, now int64) float64 {
+	return float64((expire - now) / 3600 / 24)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runCommand runs argv in dir without shell, so arguments are never interpreted, and returns its combined
+// stdout and stderr, err has exit status and output of a failed command.
+// Command is killed with all processes it started if it runs longer than --exec.timeout
+func runCommand(dir, stdin string, argv ...string) (string, error) {
+	log.Debugln(strings.Join(argv, " "))
+	ctx, cancel := context.WithTimeout(context.Background(), *execTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(stdin)
+	setProcessGroup(cmd)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	// CommandContext kills the command only, its children would keep running and holding output open
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return output.String(), fmt.Errorf("timed out after %s: %s", *execTimeout, strings.TrimSpace(output.String()))
+	}
 	if err != nil {
-		return fmt.Sprint(err) + " : " + string(stdout)
+		return output.String(), fmt.Errorf("%s: %s", err, strings.TrimSpace(output.String()))
 	}
-	return string(stdout)
+	return output.String(), nil
 }
 
 func fExist(path string) bool {
-	var _, err = os.Stat(path)
+	var _, err = pkiFS.Stat(path)
 
 	if os.IsNotExist(err) {
 		return false
@@ -56,7 +105,7 @@ func fExist(path string) bool {
 }
 
 func fRead(path string) string {
-	content, err := ioutil.ReadFile(path)
+	content, err := pkiFS.ReadFile(path)
 	if err != nil {
 		log.Warning(err)
 		return ""
@@ -66,9 +115,9 @@ func fRead(path string) string {
 }
 
 func fCreate(path string) error {
-	var _, err = os.Stat(path)
+	var _, err = pkiFS.Stat(path)
 	if os.IsNotExist(err) {
-		var file, err = os.Create(path)
+		var file, err = pkiFS.Create(path)
 		if err != nil {
 			log.Errorln(err)
 			return err
@@ -79,7 +128,7 @@ func fCreate(path string) error {
 }
 
 func fWrite(path, content string) error {
-	err := ioutil.WriteFile(path, []byte(content), 0644)
+	err := pkiFS.WriteFile(path, []byte(content), 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -87,7 +136,7 @@ func fWrite(path, content string) error {
 }
 
 func fDelete(path string) error {
-	err := os.Remove(path)
+	err := pkiFS.Remove(path)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -95,7 +144,12 @@ func fDelete(path string) error {
 }
 
 func fCopy(src, dst string) error {
-	sfi, err := os.Stat(src)
+	return copyFile(pkiFS, src, dst)
+}
+
+// copyFile is fCopy within fsys, files are hard linked if fsys can do that
+func copyFile(fsys fileSystem, src, dst string) error {
+	sfi, err := fsys.Stat(src)
 	if err != nil {
 		return err
 	}
@@ -103,7 +157,7 @@ func fCopy(src, dst string) error {
 		// cannot copy non-regular files (e.g., directories, symlinks, devices, etc.)
 		return fmt.Errorf("fCopy: non-regular source file %s (%q)", sfi.Name(), sfi.Mode().String())
 	}
-	dfi, err := os.Stat(dst)
+	dfi, err := fsys.Stat(dst)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return err
@@ -116,15 +170,17 @@ func fCopy(src, dst string) error {
 			return err
 		}
 	}
-	if err = os.Link(src, dst); err == nil {
-		return err
+	if linker, ok := fsys.(interface{ Link(string, string) error }); ok {
+		if err = linker.Link(src, dst); err == nil {
+			return err
+		}
 	}
-	in, err := os.Open(src)
+	in, err := fsys.Open(src)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
-	out, err := os.Create(dst)
+	out, err := fsys.Create(dst)
 	if err != nil {
 		return err
 	}
@@ -137,7 +193,9 @@ func fCopy(src, dst string) error {
 	if _, err = io.Copy(out, in); err != nil {
 		return err
 	}
-	err = out.Sync()
+	if syncer, ok := out.(interface{ Sync() error }); ok {
+		err = syncer.Sync()
+	}
 	return err
 }
 
@@ -156,108 +214,121 @@ func fMove(src, dst string) error {
 	return nil
 }
 
-func fDownload(path, url string, basicAuth bool) error {
+// fDownloadIfChanged downloads url to path of fsys unless its ETag still matches etag, basic auth is sent if user is set.
+// Returns ETag of the url and whether anything was downloaded
+func fDownloadIfChanged(fsys fileSystem, path, url, etag, user, password string) (string, bool, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
-	if basicAuth {
-		req.SetBasicAuth(*masterBasicAuthUser, *masterBasicAuthPassword)
+	if err != nil {
+		return etag, false, err
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return etag, false, err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		log.Warnf("WARNING: Download file operation for url %s finished with status code %d\n", url, resp.StatusCode)
+	if resp.StatusCode == http.StatusNotModified {
+		return etag, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return etag, false, fmt.Errorf("download file operation for url %s finished with status code %d", url, resp.StatusCode)
 	}
-	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return etag, false, err
 	}
 
-	fCreate(path)
-	fWrite(path, string(body))
+	// etag of a body which isn't saved must not be kept, otherwise it would never be downloaded again
+	if err = fsys.WriteFile(path, body, 0644); err != nil {
+		return etag, false, err
+	}
 
-	return nil
+	return resp.Header.Get("ETag"), true, nil
 }
 
-func createArchiveFromDir(dir, path string) error {
-
-	var files []string
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+// filesChecksum returns quoted sha256 of names and contents of files, suitable as ETag
+func filesChecksum(fsys fileSystem, dir string, files []string) (string, error) {
+	hash := sha256.New()
+	for _, filePath := range files {
+		file, err := fsys.Open(filePath)
 		if err != nil {
-			log.Warn(err)
-			return err
+			return "", err
 		}
-		if !info.IsDir() {
-			files = append(files, path)
+		fmt.Fprintf(hash, "%s\x00", strings.Replace(filePath, dir+"/", "", 1))
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return "", err
 		}
-		return nil
-	})
-	if err != nil {
-		log.Warn(err)
 	}
+	return fmt.Sprintf(`"%x"`, hash.Sum(nil)), nil
+}
 
-	out, err := os.Create(path)
-	if err != nil {
-		log.Errorf("Error writing archive %s: %s", path, err)
-		return err
-	}
-	defer out.Close()
-	gw := gzip.NewWriter(out)
-	defer gw.Close()
+// listArchiveFiles returns all regular files under dir for writeArchive
+func listArchiveFiles(fsys fileSystem, dir string) ([]string, error) {
+	return walkFiles(fsys, dir)
+}
+
+// writeArchive streams files as tar.gz with names relative to dir
+func writeArchive(fsys fileSystem, w io.Writer, dir string, files []string) error {
+	gw := gzip.NewWriter(w)
 	tw := tar.NewWriter(gw)
-	defer tw.Close()
 
-	// Iterate over files and add them to the tar archive
 	for _, filePath := range files {
-		file, err := os.Open(filePath)
-		if err != nil {
-			log.Warnf("Error writing archive %s: %s", path, err)
+		if err := writeArchiveFile(fsys, tw, dir, filePath); err != nil {
 			return err
 		}
+	}
 
-		// Get FileInfo about our file providing file size, mode, etc.
-		info, err := file.Stat()
-		if err != nil {
-			file.Close()
-			return err
-		}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
 
-		// Create a tar Header from the FileInfo data
-		header, err := tar.FileInfoHeader(info, info.Name())
-		if err != nil {
-			file.Close()
-			return err
-		}
+func writeArchiveFile(fsys fileSystem, tw *tar.Writer, dir, filePath string) error {
+	// Get FileInfo about our file providing file size, mode, etc.
+	info, err := fsys.Stat(filePath)
+	if err != nil {
+		return err
+	}
 
-		header.Name = strings.Replace(filePath, dir+"/", "", 1)
+	file, err := fsys.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-		// Write file header to the tar archive
-		err = tw.WriteHeader(header)
-		if err != nil {
-			file.Close()
-			return err
-		}
+	// Create a tar Header from the FileInfo data
+	header, err := tar.FileInfoHeader(info, info.Name())
+	if err != nil {
+		return err
+	}
 
-		// Copy file content to tar archive
-		_, err = io.Copy(tw, file)
-		if err != nil {
-			file.Close()
-			return err
-		}
-		file.Close()
+	header.Name = strings.Replace(filePath, dir+"/", "", 1)
+
+	// Write file header to the tar archive
+	if err = tw.WriteHeader(header); err != nil {
+		return err
 	}
 
-	return nil
+	// Copy file content to tar archive
+	_, err = io.Copy(tw, file)
+	return err
 }
 
-func extractFromArchive(archive, path string) error {
+func extractFromArchive(fsys fileSystem, archive, path string) error {
 	// Open the file which will be written into the archive
-	file, err := os.Open(archive)
+	file, err := fsys.Open(archive)
 	if err != nil {
 		return err
 	}
@@ -266,12 +337,13 @@ func extractFromArchive(archive, path string) error {
 	// Write file header to the tar archive
 	uncompressedStream, err := gzip.NewReader(file)
 	if err != nil {
-		log.Fatal("extractFromArchive(): NewReader failed")
+		return fmt.Errorf("extractFromArchive: NewReader() failed: %s", err)
 	}
 
 	tarReader := tar.NewReader(uncompressedStream)
+	root := filepath.Clean(path)
 
-	for true {
+	for {
 		header, err := tarReader.Next()
 
 		if err == io.EOF {
@@ -279,28 +351,153 @@ func extractFromArchive(archive, path string) error {
 		}
 
 		if err != nil {
-			log.Fatalf("extractFromArchive: Next() failed: %s", err.Error())
+			return fmt.Errorf("extractFromArchive: Next() failed: %s", err)
+		}
+
+		target := filepath.Join(path, header.Name)
+		// "./" entry of tar made with -C dir . is the root itself
+		if target != root && !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+			return fmt.Errorf("extractFromArchive: %s points outside of %s", header.Name, path)
 		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.Mkdir(path+"/"+header.Name, 0755); err != nil {
-				log.Fatalf("extractFromArchive: Mkdir() failed: %s", err.Error())
+			if err := fsys.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("extractFromArchive: MkdirAll() failed: %s", err)
 			}
 		case tar.TypeReg:
-			outFile, err := os.Create(path + "/" + header.Name)
-			if err != nil {
-				log.Fatalf("extractFromArchive: Create() failed: %s", err.Error())
+			if err := fsys.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("extractFromArchive: MkdirAll() failed: %s", err)
 			}
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				log.Fatalf("extractFromArchive: Copy() failed: %s", err.Error())
+			outFile, err := fsys.Create(target)
+			if err != nil {
+				return fmt.Errorf("extractFromArchive: Create() failed: %s", err)
 			}
+			_, err = io.Copy(outFile, tarReader)
 			outFile.Close()
+			if err != nil {
+				return fmt.Errorf("extractFromArchive: Copy() failed: %s", err)
+			}
 
 		default:
-			log.Fatalf(
-				"extractFromArchive: uknown type: %s in %s", header.Typeflag, header.Name)
+			return fmt.Errorf("extractFromArchive: unknown type: %c in %s", header.Typeflag, header.Name)
 		}
 	}
 	return nil
 }
+
+// extractFromArchiveSafely extracts archive into a temporary dir next to path first and moves files into path
+// only if the whole archive was extracted and has all of required files, so a broken download leaves path untouched
+func extractFromArchiveSafely(fsys fileSystem, archive, path string, required ...string) error {
+	tmpDir := tempName(path)
+	if err := fsys.MkdirAll(tmpDir, 0700); err != nil {
+		return err
+	}
+	defer fsys.RemoveAll(tmpDir)
+
+	if err := extractFromArchive(fsys, archive, tmpDir); err != nil {
+		return err
+	}
+
+	for _, name := range required {
+		if _, err := fsys.Stat(filepath.Join(tmpDir, name)); err != nil {
+			return fmt.Errorf("extractFromArchiveSafely: %s not found in %s", name, archive)
+		}
+	}
+
+	return moveDirContents(fsys, tmpDir, path)
+}
+
+// moveDirContents moves all files from src to dst keeping their relative paths
+func moveDirContents(fsys fileSystem, src, dst string) error {
+	files, err := walkFiles(fsys, src)
+	if err != nil {
+		return err
+	}
+	for _, filePath := range files {
+		target := filepath.Join(dst, strings.Replace(filePath, src+"/", "", 1))
+		if err = fsys.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err = fsys.Rename(filePath, target); err == nil {
+			continue
+		}
+		// src and dst may be on different filesystems when dst is a mount point
+		if err = copyFile(fsys, filePath, target); err != nil {
+			return err
+		}
+		if err = fsys.Remove(filePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apiResponse is the envelope of JSON replies of the API
+type apiResponse struct {
+	Status  string      `json:"status"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	// ReadOnly is set by slaves, their data is synced from master and can't be changed
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+func writeJSONResponse(w http.ResponseWriter, code int, resp apiResponse) {
+	resp.ReadOnly = *serverRole == "slave"
+	body, err := json.Marshal(resp)
+	if err != nil {
+		log.Errorf("writeJSONResponse: %s", err)
+		code = http.StatusInternalServerError
+		body = []byte(`{"status":"error","message":"failed to encode response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// writeJSON replies with {"status":"ok","data":...}
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONResponse(w, http.StatusOK, apiResponse{Status: "ok", Data: v})
+}
+
+// writeJSONCached is writeJSON answering 304 to conditional requests if the reply didn't change.
+// ETag is checksum of the reply and Last-Modified is modTime. If-Modified-Since is only checked if
+// If-None-Match isn't sent, since v may change while modTime stays the same
+func writeJSONCached(w http.ResponseWriter, r *http.Request, v interface{}, modTime time.Time) {
+	body, err := json.Marshal(apiResponse{Status: "ok", Data: v, ReadOnly: *serverRole == "slave"})
+	if err != nil {
+		writeJSON(w, v)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	notModified := false
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		notModified = match == etag
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.IsZero() {
+		notModified = !modTime.Truncate(time.Second).After(since)
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// writeJSONMessage replies with {"status":"ok","message":"..."} to requests having nothing else to return
+func writeJSONMessage(w http.ResponseWriter, msg string) {
+	writeJSONResponse(w, http.StatusOK, apiResponse{Status: "ok", Message: msg})
+}
+
+// writeJSONError replies with {"status":"error","message":"..."}
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSONResponse(w, code, apiResponse{Status: "error", Message: msg})
+}
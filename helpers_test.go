@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpireDays(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		expire time.Time
+		want   float64
+	}{
+		{now.AddDate(0, 0, 30), 30},
+		{now.AddDate(0, 0, 30).Add(-time.Second), 29},
+		{now.Add(time.Hour), 0},
+		{now.AddDate(0, 0, -2), -2},
+	} {
+		if got := expireDays(tc.expire.Unix(), now.Unix()); got != tc.want {
+			t.Errorf("expireDays(%s) = %v, want %v", tc.expire, got, tc.want)
+		}
+	}
+}
+
+// testArchive is tar.gz of files, names ending with "/" are dirs
+func testArchive(t *testing.T, files ...string) []byte {
+	var archive bytes.Buffer
+	gw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gw)
+	for _, name := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(name))}
+		if name[len(name)-1] == '/' {
+			header = &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			tw.Write([]byte(name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestExtractFromArchive(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		files   []string
+		wantErr bool
+	}{
+		{"plain", []string{"ca.crt", "issued/a.crt"}, false},
+		{"root entry of tar -C dir .", []string{"./", "./ca.crt", "./issued/", "./issued/a.crt"}, false},
+		{"parent dir", []string{"../ca.crt"}, true},
+		{"sibling with the same prefix", []string{"../pki2/ca.crt"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mem := newMemFileSystem(map[string]string{"/tmp/a.tar.gz": string(testArchive(t, tc.files...))})
+			err := extractFromArchive(mem, "/tmp/a.tar.gz", "/pki")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("extractFromArchive() = %v, want error %t", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			for _, name := range []string{"/pki/ca.crt", "/pki/issued/a.crt"} {
+				if _, ok := mem.content(name); !ok {
+					t.Errorf("%s isn't extracted", name)
+				}
+			}
+		})
+	}
+}
+
+func TestUnArchiveCertsTruncated(t *testing.T) {
+	pki := map[string]string{"/easyrsa/pki/ca.crt": "old ca", "/easyrsa/pki/index.txt": testIndexTxt}
+	oAdmin, mem := newTestOvpnAdmin(t, pki)
+	archive := testArchive(t, "ca.crt", "index.txt", "issued/a.crt", "private/a.key")
+	if err := mem.WriteFile(certsArchivePath, archive[:len(archive)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := oAdmin.unArchiveCerts(); err == nil {
+		t.Fatal("truncated archive is extracted")
+	}
+	for name, want := range pki {
+		if got, _ := mem.content(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if entries, _ := mem.ReadDir("/easyrsa"); len(entries) != 1 {
+		t.Errorf("temp dir is left next to pki: %v", entries)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep isn't available")
+	}
+	previous := *execTimeout
+	*execTimeout = time.Second
+	defer func() { *execTimeout = previous }()
+
+	for _, argv := range [][]string{
+		{"sleep", "5"},
+		// child keeping output open must be killed too
+		{"sh", "-c", "sleep 5 & wait"},
+	} {
+		start := time.Now()
+		_, err := runCommand("", "", argv...)
+		if err == nil || !strings.Contains(err.Error(), "timed out after 1s") {
+			t.Errorf("runCommand(%q) = %v, want timeout error", argv, err)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("runCommand(%q) returned after %s", argv, elapsed)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+const historyDefaultLimit = 100
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	common_name TEXT NOT NULL,
+	server TEXT NOT NULL,
+	real_address TEXT NOT NULL,
+	virtual_address TEXT NOT NULL DEFAULT '',
+	connected_since INTEGER NOT NULL,
+	disconnected_at INTEGER,
+	bytes_received INTEGER NOT NULL DEFAULT 0,
+	bytes_sent INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (common_name, server, real_address, connected_since)
+);
+CREATE INDEX IF NOT EXISTS sessions_common_name ON sessions (common_name);
+CREATE INDEX IF NOT EXISTS sessions_connected_since ON sessions (connected_since);
+CREATE INDEX IF NOT EXISTS sessions_real_address ON sessions (real_address);
+CREATE INDEX IF NOT EXISTS sessions_open ON sessions (disconnected_at);
+`
+
+type historySession struct {
+	CommonName     string `json:"CommonName"`
+	Server         string `json:"Server"`
+	RealAddress    string `json:"RealAddress"`
+	VirtualAddress string `json:"VirtualAddress"`
+	ConnectedSince string `json:"ConnectedSince"`
+	DisconnectedAt string `json:"DisconnectedAt"`
+	BytesReceived  int64  `json:"BytesReceived"`
+	BytesSent      int64  `json:"BytesSent"`
+}
+
+type historyFilter struct {
+	Username    string
+	RealAddress string
+	From        time.Time
+	To          time.Time
+	Limit       int
+	Offset      int
+}
+
+type connectionHistory struct {
+	db *sql.DB
+}
+
+func openConnectionHistory(path string) (*connectionHistory, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite doesn't support concurrent writers
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(historySchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &connectionHistory{db: db}, nil
+}
+
+// record stores active sessions and marks every open session missing from activeClients as disconnected
+func (h *connectionHistory) record(activeClients []clientStatus, timeFormat string, now time.Time) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TEMP TABLE IF NOT EXISTS active_sessions (id INTEGER PRIMARY KEY); DELETE FROM active_sessions`)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range activeClients {
+		connectedSince := parseDateToUnix(timeFormat, c.ConnectedSince)
+		bytesReceived, _ := strconv.ParseInt(c.BytesReceived, 10, 64)
+		bytesSent, _ := strconv.ParseInt(c.BytesSent, 10, 64)
+
+		_, err = tx.Exec(`INSERT INTO sessions (common_name, server, real_address, virtual_address, connected_since, bytes_received, bytes_sent)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (common_name, server, real_address, connected_since) DO UPDATE SET
+			virtual_address = excluded.virtual_address, bytes_received = excluded.bytes_received, bytes_sent = excluded.bytes_sent, disconnected_at = NULL`,
+			c.CommonName, c.ConnectedTo, c.RealAddress, c.VirtualAddress, connectedSince, bytesReceived, bytesSent)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT OR IGNORE INTO active_sessions (id) SELECT id FROM sessions WHERE common_name = ? AND server = ? AND real_address = ? AND connected_since = ?`,
+			c.CommonName, c.ConnectedTo, c.RealAddress, connectedSince)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE sessions SET disconnected_at = ? WHERE disconnected_at IS NULL AND id NOT IN (SELECT id FROM active_sessions)`, now.Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// likeEscaper makes wildcards of a LIKE pattern match literally, patterns are used with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// query returns sessions matching filter ordered from the newest one and total number of matching sessions
+func (h *connectionHistory) query(filter historyFilter) ([]historySession, int, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Username != "" {
+		conditions = append(conditions, "common_name = ?")
+		args = append(args, filter.Username)
+	}
+	if filter.RealAddress != "" {
+		// real address is stored along with the port
+		conditions = append(conditions, `(real_address = ? OR real_address LIKE ? ESCAPE '\')`)
+		args = append(args, filter.RealAddress, escapeLike(filter.RealAddress)+":%")
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "(disconnected_at IS NULL OR disconnected_at >= ?)")
+		args = append(args, filter.From.Unix())
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "connected_since <= ?")
+		args = append(args, filter.To.Unix())
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	err := h.db.QueryRow("SELECT COUNT(*) FROM sessions "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := h.db.Query(`SELECT common_name, server, real_address, virtual_address, connected_since, disconnected_at, bytes_received, bytes_sent
+		FROM sessions `+where+` ORDER BY connected_since DESC, id DESC LIMIT ? OFFSET ?`, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	sessions := []historySession{}
+	for rows.Next() {
+		var s historySession
+		var connectedSince int64
+		var disconnectedAt sql.NullInt64
+		err = rows.Scan(&s.CommonName, &s.Server, &s.RealAddress, &s.VirtualAddress, &connectedSince, &disconnectedAt, &s.BytesReceived, &s.BytesSent)
+		if err != nil {
+			return nil, 0, err
+		}
+		s.ConnectedSince = time.Unix(connectedSince, 0).Format(stringDateFormat)
+		if disconnectedAt.Valid {
+			s.DisconnectedAt = time.Unix(disconnectedAt.Int64, 0).Format(stringDateFormat)
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, total, rows.Err()
+}
+
+func (oAdmin *OvpnAdmin) historyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if oAdmin.history == nil {
+		writeJSONError(w, http.StatusNotImplemented, "connection history is not enabled")
+		return
+	}
+	_ = r.ParseForm()
+
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sessions, total, err := oAdmin.history.query(filter)
+	if err != nil {
+		log.Errorf("historyHandler: %s", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, struct {
+		Total    int              `json:"Total"`
+		Limit    int              `json:"Limit"`
+		Offset   int              `json:"Offset"`
+		Sessions []historySession `json:"Sessions"`
+	}{total, filter.Limit, filter.Offset, sessions})
+}
+
+func parseHistoryFilter(r *http.Request) (historyFilter, error) {
+	var err error
+	filter := historyFilter{Username: r.FormValue("username"), RealAddress: r.FormValue("ip")}
+
+	if v := r.FormValue("from"); v != "" {
+		filter.From, err = time.ParseInLocation(stringDateFormat, v, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("from must be in format %s", stringDateFormat)
+		}
+	}
+	if v := r.FormValue("to"); v != "" {
+		filter.To, err = time.ParseInLocation(stringDateFormat, v, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("to must be in format %s", stringDateFormat)
+		}
+	}
+	filter.Limit, filter.Offset, err = parsePaging(r, historyDefaultLimit)
+
+	return filter, err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryQueryRealAddressWildcards(t *testing.T) {
+	h, err := openConnectionHistory(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Close()
+
+	clients := []clientStatus{
+		{CommonName: "alice", ConnectedTo: "vpn", RealAddress: "10.0.0.1:1194", ConnectedSince: "2021-01-01 00:00:00"},
+		{CommonName: "bob", ConnectedTo: "vpn", RealAddress: "10.0.0.12:1194", ConnectedSince: "2021-01-01 00:00:00"},
+		{CommonName: "carol", ConnectedTo: "vpn", RealAddress: `10\0.0.1:1194`, ConnectedSince: "2021-01-01 00:00:00"},
+	}
+	if err = h.record(clients, "2006-01-02 15:04:05", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, want := range map[string]int{"10.0.0.1": 1, "10.0.0._": 0, "10.0.0.1%": 0, "%": 0, `10\0.0.1`: 1, "10.0.0.1:1194": 1} {
+		sessions, total, err := h.query(historyFilter{RealAddress: ip, Limit: historyDefaultLimit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != want || len(sessions) != want {
+			t.Errorf("query(ip=%q) matched %d sessions (total %d), want %d", ip, len(sessions), total, want)
+		}
+	}
+}
@@ -62,6 +62,7 @@ type RevokedCert struct {
 	RevokedTime time.Time         `json:"revokedTime"`
 	CommonName  string            `json:"commonName"`
 	Cert        *x509.Certificate `json:"cert"`
+	Reason      string            `json:"reason"`
 }
 
 func (openVPNPKI *OpenVPNPKI) run() (err error) {
@@ -235,7 +236,11 @@ func (openVPNPKI *OpenVPNPKI) indexTxtUpdate() (err error) {
 		} else if cert.NotAfter.Before(time.Now()) {
 			indexTxt += fmt.Sprintf("%s\t%s\t\t%s\t%s\t%s\n", "E", cert.NotAfter.Format(indexTxtDateFormat), fmt.Sprintf("%d", cert.SerialNumber), "unknown", "/CN="+secret.Labels["name"])
 		} else {
-			indexTxt += fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", "R", cert.NotAfter.Format(indexTxtDateFormat), secret.Annotations["revokedAt"], fmt.Sprintf("%d", cert.SerialNumber), "unknown", "/CN="+secret.Labels["name"])
+			revocation := secret.Annotations["revokedAt"]
+			if secret.Annotations["revocationReason"] != "" {
+				revocation += "," + secret.Annotations["revocationReason"]
+			}
+			indexTxt += fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", "R", cert.NotAfter.Format(indexTxtDateFormat), revocation, fmt.Sprintf("%d", cert.SerialNumber), "unknown", "/CN="+secret.Labels["name"])
 		}
 
 	}
@@ -280,7 +285,7 @@ func (openVPNPKI *OpenVPNPKI) easyrsaGenCRL() (err error) {
 				log.Warning(err)
 			}
 			cert, err := decodeCert(secret.Data[certFileName])
-			revoked = append(revoked, &RevokedCert{RevokedTime: revokedAt, Cert: cert})
+			revoked = append(revoked, &RevokedCert{RevokedTime: revokedAt, Cert: cert, Reason: secret.Annotations["revocationReason"]})
 		}
 	}
 
@@ -379,7 +384,7 @@ func (openVPNPKI *OpenVPNPKI) easyrsaGetClientCert(commonName string) (cert, key
 	return
 }
 
-func (openVPNPKI *OpenVPNPKI) easyrsaRevoke(commonName string) (err error) {
+func (openVPNPKI *OpenVPNPKI) easyrsaRevoke(commonName, reason string) (err error) {
 	secret, err := openVPNPKI.secretGetByLabels("name=" + commonName)
 	if err != nil {
 		log.Error(err)
@@ -391,6 +396,7 @@ func (openVPNPKI *OpenVPNPKI) easyrsaRevoke(commonName string) (err error) {
 	}
 
 	secret.Annotations["revokedAt"] = time.Now().Format(indexTxtDateFormat)
+	secret.Annotations["revocationReason"] = reason
 
 	_, err = openVPNPKI.KubeClient.CoreV1().Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
 	if err != nil {
@@ -424,6 +430,7 @@ func (openVPNPKI *OpenVPNPKI) easyrsaUnrevoke(commonName string) (err error) {
 	}
 
 	secret.Annotations["revokedAt"] = ""
+	secret.Annotations["revocationReason"] = ""
 
 	_, err = openVPNPKI.KubeClient.CoreV1().Secrets(namespace).Update(context.TODO(), secret, metav1.UpdateOptions{})
 	if err != nil {
@@ -522,6 +529,56 @@ func (openVPNPKI *OpenVPNPKI) easyrsaDelete(commonName string) (err error) {
 	return
 }
 
+// PKIBackend implementation
+
+func (openVPNPKI *OpenVPNPKI) CreateClient(username, passphrase string, opts clientCertOptions) error {
+	if passphrase != "" {
+		return errors.New("password protected certificates are not supported")
+	}
+	if !opts.empty() {
+		return errors.New("email and SAN of certificates are not supported")
+	}
+	return openVPNPKI.easyrsaBuildClient(username)
+}
+
+func (openVPNPKI *OpenVPNPKI) Revoke(username, reason string) error {
+	return openVPNPKI.easyrsaRevoke(username, reason)
+}
+
+func (openVPNPKI *OpenVPNPKI) RevokeActions(username, reason string) []string {
+	return []string{
+		fmt.Sprintf("mark secret of %s in namespace %s as revoked with reason %s", username, namespace, reason),
+		"regenerate CRL and update index.txt and crl.pem on disk",
+	}
+}
+
+func (openVPNPKI *OpenVPNPKI) Unrevoke(username string) error {
+	return openVPNPKI.easyrsaUnrevoke(username)
+}
+
+func (openVPNPKI *OpenVPNPKI) GenCRL() (err error) {
+	err = openVPNPKI.easyrsaGenCRL()
+	if err != nil {
+		return
+	}
+	err = openVPNPKI.updateCRLOnDisk()
+	return
+}
+
+func (openVPNPKI *OpenVPNPKI) ServerCertExpiry() (time.Time, error) {
+	if openVPNPKI.ServerCert == nil {
+		return time.Time{}, errors.New("server certificate not loaded")
+	}
+	return openVPNPKI.ServerCert.NotAfter, nil
+}
+
+func (openVPNPKI *OpenVPNPKI) ServerCertificate() (*x509.Certificate, error) {
+	if openVPNPKI.ServerCert == nil {
+		return nil, errors.New("server certificate not loaded")
+	}
+	return openVPNPKI.ServerCert, nil
+}
+
 func (openVPNPKI *OpenVPNPKI) secretGetClientCert(name string) (cert ClientCert, err error) {
 	secret, err := openVPNPKI.secretGetByName(name)
 	if err != nil {
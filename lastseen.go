@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loadLastSeen reads last seen times saved by saveLastSeen, missing file means nobody was seen yet
+func loadLastSeen(fsys fileSystem, path string) (map[string]time.Time, error) {
+	lastSeen := make(map[string]time.Time)
+	content, err := fsys.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lastSeen, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &lastSeen); err != nil {
+		return nil, err
+	}
+	return lastSeen, nil
+}
+
+// saveLastSeen writes last seen times through a temp file, so a crash never leaves a truncated file behind
+func saveLastSeen(fsys fileSystem, path string, lastSeen map[string]time.Time) error {
+	content, err := json.Marshal(lastSeen)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fsys, path, content, 0600)
+}
+
+// updateLastSeen remembers LastRef of every active client, or now if it's not in the routing table yet.
+// Must be called with stateMutex held. Returns whether anything changed
+func (oAdmin *OvpnAdmin) updateLastSeen(activeClients []clientStatus, now time.Time) bool {
+	changed := false
+	for _, c := range activeClients {
+		seen := now
+		if c.LastRef != "" {
+			seen = parseDate(oAdmin.mgmtStatusTimeFormat, c.LastRef)
+		}
+		if seen.After(oAdmin.lastSeen[c.CommonName]) {
+			oAdmin.lastSeen[c.CommonName] = seen
+			changed = true
+		}
+	}
+	return changed
+}
+
+// lastSeenPersistInterval limits how often LastRef updates of users staying connected are saved
+const lastSeenPersistInterval = 5 * time.Minute
+
+// lastSeenPersistDue tells whether last seen times have to be saved now: right away when a user connects
+// or disconnects, at most once per lastSeenPersistInterval while the same users stay connected.
+// Must be called with stateMutex held
+func (oAdmin *OvpnAdmin) lastSeenPersistDue(activeClients []clientStatus, changed bool, now time.Time) bool {
+	connected := make(map[string]bool)
+	for _, c := range activeClients {
+		connected[c.CommonName] = true
+	}
+	sameUsers := len(connected) == len(oAdmin.lastSeenConnected)
+	for name := range connected {
+		sameUsers = sameUsers && oAdmin.lastSeenConnected[name]
+	}
+	oAdmin.lastSeenConnected = connected
+	oAdmin.lastSeenUnsaved = oAdmin.lastSeenUnsaved || changed
+
+	if !sameUsers || oAdmin.lastSeenUnsaved && now.Sub(oAdmin.lastSeenSaved) >= lastSeenPersistInterval {
+		oAdmin.lastSeenUnsaved = false
+		oAdmin.lastSeenSaved = now
+		return true
+	}
+	return false
+}
+
+// persistLastSeen saves last seen times to --last-seen.path if it's set
+func (oAdmin *OvpnAdmin) persistLastSeen() {
+	if *lastSeenPath == "" {
+		return
+	}
+	oAdmin.stateMutex.RLock()
+	err := saveLastSeen(oAdmin.fs, *lastSeenPath, oAdmin.lastSeen)
+	oAdmin.stateMutex.RUnlock()
+	if err != nil {
+		log.Errorf("failed to save last seen times to %s: %s", *lastSeenPath, err)
+	}
+}
+
+func (oAdmin *OvpnAdmin) getLastSeen(username string) string {
+	oAdmin.stateMutex.RLock()
+	defer oAdmin.stateMutex.RUnlock()
+	seen, ok := oAdmin.lastSeen[username]
+	if !ok {
+		return ""
+	}
+	return seen.Format(stringDateFormat)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLastSeenPersistDue(t *testing.T) {
+	oAdmin := &OvpnAdmin{lastSeen: map[string]time.Time{}, mgmtStatusTimeFormat: "2006-01-02 15:04:05"}
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	alice := func(lastRef time.Time) []clientStatus {
+		return []clientStatus{{CommonName: "alice", LastRef: lastRef.Format("2006-01-02 15:04:05")}}
+	}
+
+	for _, step := range []struct {
+		name   string
+		now    time.Time
+		active []clientStatus
+		want   bool
+	}{
+		{"nobody connected", start, nil, false},
+		{"alice connects", start.Add(time.Minute), alice(start.Add(time.Minute)), true},
+		{"alice stays connected", start.Add(2 * time.Minute), alice(start.Add(2 * time.Minute)), false},
+		{"interval passed", start.Add(6 * time.Minute), alice(start.Add(6 * time.Minute)), true},
+		{"nothing changed since save", start.Add(12 * time.Minute), alice(start.Add(6 * time.Minute)), false},
+		{"alice disconnects", start.Add(13 * time.Minute), nil, true},
+		{"nobody connected again", start.Add(20 * time.Minute), nil, false},
+	} {
+		changed := oAdmin.updateLastSeen(step.active, step.now)
+		if got := oAdmin.lastSeenPersistDue(step.active, changed, step.now); got != step.want {
+			t.Errorf("%s: lastSeenPersistDue() = %t, want %t", step.name, got, step.want)
+		}
+	}
+}
@@ -1,26 +1,33 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"io/ioutil"
+	"io"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
 	"time"
 	"unicode/utf8"
@@ -34,50 +41,119 @@ import (
 )
 
 const (
-	usernameRegexp       = `^([a-zA-Z0-9_.-@])+$`
+	usernameRegexp       = `^([a-zA-Z0-9_.@-])+$`
+	usernameMaxLength    = 64
 	passwordMinLength    = 6
+	passphraseMinLength  = 4
 	certsArchiveFileName = "certs.tar.gz"
 	ccdArchiveFileName   = "ccd.tar.gz"
 	indexTxtDateLayout   = "060102150405Z"
 	stringDateFormat     = "2006-01-02 15:04:05"
 	downloadCertsApiUrl  = "api/data/certs/download"
 	downloadCcdApiUrl    = "api/data/ccd/download"
+	indexTxtApiUrl       = "api/data/index"
+	indexTxtAnomaliesUrl = "api/data/index/anomalies"
+
+	runModeFull     = "full"
+	runModeExporter = "exporter"
+
+	defaultMasterSyncToken = "VerySecureToken"
 
 	kubeNamespaceFilePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	shutdownTimeout = 10 * time.Second
+
+	mgmtPasswordPrompt = "ENTER PASSWORD:"
+	mgmtReadTimeout    = 10 * time.Second
+
+	// downloads from master are retried after 1s, 2s, ... up to syncRetryMaxDelay, halved by jitter
+	syncRetryBaseDelay = 1 * time.Second
+	syncRetryMaxDelay  = 30 * time.Second
+	// failed sync cycle is repeated after syncFailureBaseInterval, doubled with every failure up to --master.sync-frequency
+	syncFailureBaseInterval = 30 * time.Second
 )
 
 var (
 	listenHost               = kingpin.Flag("listen.host", "host for ovpn-admin").Default("0.0.0.0").Envar("OVPN_LISTEN_HOST").String()
 	listenPort               = kingpin.Flag("listen.port", "port for ovpn-admin").Default("8080").Envar("OVPN_LISTEN_PORT").String()
 	listenBaseUrl            = kingpin.Flag("listen.base-url", "base url for ovpn-admin").Default("/").Envar("OVPN_LISTEN_BASE_URL").String()
+	runMode                  = kingpin.Flag("mode", "full serves UI, API and metrics, exporter serves only metrics, ping and healthz").Default(runModeFull).Envar("OVPN_MODE").Enum(runModeFull, runModeExporter)
+	listenTLSCertFile        = kingpin.Flag("tls.cert-file", "path to PEM certificate of ovpn-admin web server; HTTPS is served if it's set along with tls.key-file").Default("").Envar("OVPN_TLS_CERT_FILE").String()
+	listenTLSKeyFile         = kingpin.Flag("tls.key-file", "path to PEM private key of tls.cert-file").Default("").Envar("OVPN_TLS_KEY_FILE").String()
+	listenTLSMinVersion      = kingpin.Flag("tls.min-version", "minimal TLS version accepted by HTTPS server").Default("1.2").Envar("OVPN_TLS_MIN_VERSION").Enum("1.0", "1.1", "1.2", "1.3")
 	serverRole               = kingpin.Flag("role", "server role, master or slave").Default("master").Envar("OVPN_ROLE").HintOptions("master", "slave").String()
-	masterHost               = kingpin.Flag("master.host", "URL for the master server").Default("http://127.0.0.1").Envar("OVPN_MASTER_HOST").String()
+	masterHosts              = kingpin.Flag("master.host", "URL for the master server, repeat for failover masters tried in order").Default("http://127.0.0.1").Envar("OVPN_MASTER_HOST").Strings()
 	masterBasicAuthUser      = kingpin.Flag("master.basic-auth.user", "user for master server's Basic Auth").Default("").Envar("OVPN_MASTER_USER").String()
 	masterBasicAuthPassword  = kingpin.Flag("master.basic-auth.password", "password for master server's Basic Auth").Default("").Envar("OVPN_MASTER_PASSWORD").String()
 	masterSyncFrequency      = kingpin.Flag("master.sync-frequency", "master host data sync frequency in seconds").Default("600").Envar("OVPN_MASTER_SYNC_FREQUENCY").Int()
-	masterSyncToken          = kingpin.Flag("master.sync-token", "master host data sync security token").Default("VerySecureToken").Envar("OVPN_MASTER_TOKEN").PlaceHolder("TOKEN").String()
-	openvpnNetwork           = kingpin.Flag("ovpn.network", "NETWORK/MASK_PREFIX for OpenVPN server").Default("172.16.100.0/24").Envar("OVPN_NETWORK").String()
-	openvpnServer            = kingpin.Flag("ovpn.server", "HOST:PORT:PROTOCOL for OpenVPN server; can have multiple values").Default("127.0.0.1:7777:tcp").Envar("OVPN_SERVER").PlaceHolder("HOST:PORT:PROTOCOL").Strings()
+	masterSyncToken          = kingpin.Flag("master.sync-token", "master host data sync security token").Default(defaultMasterSyncToken).Envar("OVPN_MASTER_TOKEN").PlaceHolder("TOKEN").String()
+	apiAuthToken             = kingpin.Flag("api.auth-token", "token required in \"Authorization: Bearer\" header or \"token\" query parameter by API endpoints changing users and by api/user/chain; API is open if not set, except api/user/chain which is refused").Default("").Envar("OVPN_API_AUTH_TOKEN").PlaceHolder("TOKEN").String()
+	syncBackend              = kingpin.Flag("sync.backend", "how slaves get data from master: http downloads it from master.host, s3 pulls archives master uploads to sync.s3.bucket").Default(syncBackendHttp).Envar("OVPN_SYNC_BACKEND").Enum(syncBackendHttp, syncBackendS3)
+	syncS3Bucket             = kingpin.Flag("sync.s3.bucket", "bucket for certs and ccd archives with s3 sync backend").Default("").Envar("OVPN_SYNC_S3_BUCKET").String()
+	syncS3Prefix             = kingpin.Flag("sync.s3.prefix", "prefix of archive object names in sync.s3.bucket").Default("ovpn-admin/").Envar("OVPN_SYNC_S3_PREFIX").String()
+	syncS3Region             = kingpin.Flag("sync.s3.region", "region of sync.s3.bucket").Default("us-east-1").Envar("OVPN_SYNC_S3_REGION").String()
+	syncS3Endpoint           = kingpin.Flag("sync.s3.endpoint", "URL of S3 compatible storage, AWS S3 endpoint of sync.s3.region if empty").Default("").Envar("OVPN_SYNC_S3_ENDPOINT").String()
+	syncS3PathStyle          = kingpin.Flag("sync.s3.path-style", "put bucket name in URL path instead of host name, as most S3 compatible storages want").Default("false").Envar("OVPN_SYNC_S3_PATH_STYLE").Bool()
+	syncS3AccessKey          = kingpin.Flag("sync.s3.access-key", "access key for sync.s3.bucket, AWS_ACCESS_KEY_ID is used if empty").Default("").Envar("OVPN_SYNC_S3_ACCESS_KEY").String()
+	syncS3SecretKey          = kingpin.Flag("sync.s3.secret-key", "secret key for sync.s3.bucket, AWS_SECRET_ACCESS_KEY is used if empty").Default("").Envar("OVPN_SYNC_S3_SECRET_KEY").String()
+	openvpnNetwork           = kingpin.Flag("ovpn.network", "NETWORK/MASK_PREFIX for OpenVPN server; IPv4 and IPv6 networks can be comma-separated for dual-stack setup").Default("172.16.100.0/24").Envar("OVPN_NETWORK").String()
+	openvpnServer            = kingpin.Flag("ovpn.server", "HOST[:PORT][:PROTOCOL] for OpenVPN server, PORT is 1194 and PROTOCOL is udp if omitted, IPv6 HOST goes in brackets; can have multiple values").Default("127.0.0.1:7777:tcp").Envar("OVPN_SERVER").PlaceHolder("HOST:PORT:PROTOCOL").Strings()
 	openvpnServerBehindLB    = kingpin.Flag("ovpn.server.behindLB", "enable if your OpenVPN server is behind Kubernetes Service having the LoadBalancer type").Default("false").Envar("OVPN_LB").Bool()
 	openvpnServiceName       = kingpin.Flag("ovpn.service", "the name of Kubernetes Service having the LoadBalancer type if your OpenVPN server is behind it").Default("openvpn-external").Envar("OVPN_LB_SERVICE").Strings()
-	mgmtAddress              = kingpin.Flag("mgmt", "ALIAS=HOST:PORT for OpenVPN server mgmt interface; can have multiple values").Default("main=127.0.0.1:8989").Envar("OVPN_MGMT").Strings()
+	mgmtAddress              = kingpin.Flag("mgmt", "ALIAS=HOST:PORT for OpenVPN server mgmt interface; can have multiple values, either repeated or comma-separated").Default("main=127.0.0.1:8989").Envar("OVPN_MGMT").Strings()
+	mgmtListener             = kingpin.Flag("mgmt.listener", "ALIAS=PROTOCOL:PORT of OpenVPN listener served by mgmt interface with the same alias; can have multiple values").Envar("OVPN_MGMT_LISTENER").PlaceHolder("ALIAS=PROTOCOL:PORT").Strings()
+	mgmtPassword             = kingpin.Flag("mgmt.password", "password of OpenVPN mgmt interfaces protected with pw-file").Default("").Envar("OVPN_MGMT_PASSWORD").String()
+	stateRefreshInterval     = kingpin.Flag("state.refresh-interval", "interval of refreshing users list and their connections status from index.txt and mgmt interfaces").Default("28s").Envar("OVPN_STATE_REFRESH_INTERVAL").Duration()
+	mgmtDisconnectGrace      = kingpin.Flag("mgmt.disconnect-grace", "number of consecutive status polls a client may be missing from mgmt interface before it's considered disconnected").Default("1").Envar("OVPN_MGMT_DISCONNECT_GRACE").Int()
+	maxConnectionsPerUser    = kingpin.Flag("max-connections-per-user", "maximum number of concurrent sessions of a user, 0 for unlimited").Default("0").Envar("OVPN_MAX_CONNECTIONS_PER_USER").Int()
+	maxConnectionsKill       = kingpin.Flag("max-connections-per-user.kill", "kill the oldest sessions of users exceeding --max-connections-per-user, otherwise they are only logged").Default("false").Envar("OVPN_MAX_CONNECTIONS_PER_USER_KILL").Bool()
 	metricsPath              = kingpin.Flag("metrics.path", "URL path for exposing collected metrics").Default("/metrics").Envar("OVPN_METRICS_PATH").String()
 	easyrsaDirPath           = kingpin.Flag("easyrsa.path", "path to easyrsa dir").Default("./easyrsa").Envar("EASYRSA_PATH").String()
 	indexTxtPath             = kingpin.Flag("easyrsa.index-path", "path to easyrsa index file").Default("").Envar("OVPN_INDEX_PATH").String()
+	caChainPath              = kingpin.Flag("easyrsa.ca-chain-path", "path to PEM file with intermediate CA certificates placed between client certificate and ca.crt in the chain").Default("").Envar("OVPN_CA_CHAIN_PATH").String()
+	serverCertPath           = kingpin.Flag("easyrsa.server-cert-path", "path to certificate of OpenVPN server shown by api/server/cert, pki/issued/<server.cert-cn>.crt of easyrsa.path if not set").Default("").Envar("OVPN_SERVER_CERT_PATH").String()
+	serverCertCN             = kingpin.Flag("server.cert-cn", "common name of OpenVPN server certificate, it drives ovpn_server_cert_expire and is hidden from users list").Default("server").Envar("OVPN_SERVER_CERT_CN").String()
 	easyrsaBinPath           = kingpin.Flag("easyrsa.bin-path", "path to easyrsa script").Default("easyrsa").Envar("EASYRSA_BIN_PATH").String()
+	easyrsaVersion           = kingpin.Flag("easyrsa.version", "major version of easyrsa: 3, or 2 with build-key and revoke-full scripts and ./vars in easyrsa.path").Default(easyrsaVersion3).Envar("OVPN_EASYRSA_VERSION").Enum(easyrsaVersion2, easyrsaVersion3)
+	execTimeout              = kingpin.Flag("exec.timeout", "timeout of easyrsa and openvpn-user runs, the process is killed along with its children when it expires").Default("30s").Envar("OVPN_EXEC_TIMEOUT").Duration()
+	crlDays                  = kingpin.Flag("crl.days", "CRL validity period in days; passed to easyrsa as EASYRSA_CRL_DAYS, 0 keeps easyrsa default").Default("0").Envar("OVPN_CRL_DAYS").Int()
 	ccdEnabled               = kingpin.Flag("ccd", "enable client-config-dir").Default("false").Envar("OVPN_CCD").Bool()
 	ccdDir                   = kingpin.Flag("ccd.path", "path to client-config-dir").Default("./ccd").Envar("OVPN_CCD_PATH").String()
+	ccdAllowedRoutes         = kingpin.Flag("ccd.allowed-routes", "NETWORK/MASK_PREFIX which custom ccd routes may target; can have multiple values, any network is allowed if not set").Envar("OVPN_CCD_ALLOWED_ROUTES").PlaceHolder("NETWORK/MASK_PREFIX").Strings()
+	ccdRulesPath             = kingpin.Flag("ccd.rules-path", "path to JSON file with rules mapping user metadata to ccd directives").Default("").Envar("OVPN_CCD_RULES_PATH").String()
+	templatesPath            = kingpin.Flag("templates.path", "path to dir with custom client.conf.tpl and ccd.tpl; built-in templates are used if not set").Default("").Envar("OVPN_TEMPLATES_PATH").String()
 	clientConfigTemplatePath = kingpin.Flag("templates.clientconfig-path", "path to custom client.conf.tpl").Default("").Envar("OVPN_TEMPLATES_CC_PATH").String()
 	ccdTemplatePath          = kingpin.Flag("templates.ccd-path", "path to custom ccd.tpl").Default("").Envar("OVPN_TEMPLATES_CCD_PATH").String()
+	tlsMode                  = kingpin.Flag("tls.mode", "TLS control channel protection in client config: tls-auth, tls-crypt with shared pki/ta.key or tls-crypt-v2 with per-client pki/private/<user>.pem").Default(tlsModeAuth).Envar("OVPN_TLS_MODE").Enum(tlsModeAuth, tlsModeCrypt, tlsModeCryptV2)
+	clientConfigMode         = kingpin.Flag("client.config-mode", "inline: certs and keys are inlined into client config, files: client config references them and config/download returns zip with all files").Default(clientConfigModeInline).Envar("OVPN_CLIENT_CONFIG_MODE").Enum(clientConfigModeInline, clientConfigModeFiles)
+	clientPushDNS            = kingpin.Flag("client.push-dns", "DNS server address added to client config as dhcp-option DNS; can have multiple values").Envar("OVPN_CLIENT_PUSH_DNS").PlaceHolder("ADDRESS").Strings()
+	clientRedirectGateway    = kingpin.Flag("client.redirect-gateway", "flags of redirect-gateway added to client config, e.g. \"def1 bypass-dhcp\"; not added if empty").Default("").Envar("OVPN_CLIENT_REDIRECT_GATEWAY").String()
+	clientExtraOptions       = kingpin.Flag("client.extra-option", "directive added to client config as is, e.g. \"cipher AES-256-GCM\"; can have multiple values").Envar("OVPN_CLIENT_EXTRA_OPTION").PlaceHolder("DIRECTIVE").Strings()
+	apiAuthAll               = kingpin.Flag("api.auth-all", "require api.auth-token by read-only API endpoints as well").Default("false").Envar("OVPN_API_AUTH_ALL").Bool()
+	corsAllowedOrigins       = kingpin.Flag("cors.allowed-origins", "comma separated origins allowed to call API from browser, e.g. \"https://ui.example.com\", \"*\" allows any; only same-origin requests work if not set").Default("").Envar("OVPN_CORS_ALLOWED_ORIGINS").String()
+	httpGzip                 = kingpin.Flag("http.gzip", "compress api/ responses with gzip for clients accepting it").Default("false").Envar("OVPN_HTTP_GZIP").Bool()
+	rateLimit                = kingpin.Flag("rate-limit", "requests per minute from one IP allowed to api/user/create, api/users/create/bulk, api/user/revoke and api/user/unrevoke, 0 for unlimited").Default("0").Envar("OVPN_RATE_LIMIT").Int()
 	authByPassword           = kingpin.Flag("auth.password", "enable additional password authentication").Default("false").Envar("OVPN_AUTH").Bool()
 	authDatabase             = kingpin.Flag("auth.db", "database path for password authentication").Default("./easyrsa/pki/users.db").Envar("OVPN_AUTH_DB_PATH").String()
+	historyDbPath            = kingpin.Flag("history.db-path", "path to SQLite database for connection history; history is disabled if not set").Default("").Envar("OVPN_HISTORY_DB_PATH").String()
+	lastSeenPath             = kingpin.Flag("last-seen.path", "path to JSON file keeping last seen time of users across restarts; it's kept in memory only if not set").Default("").Envar("OVPN_LAST_SEEN_PATH").String()
+	auditLogPath             = kingpin.Flag("audit.log-path", "path to file receiving JSON line for every operation changing users or ccd; audit log is disabled if not set").Default("").Envar("OVPN_AUDIT_LOG_PATH").String()
+	webhookUrl               = kingpin.Flag("webhook.url", "url receiving POST with JSON event after a user is created, revoked or unrevoked; webhooks are disabled if not set").Default("").Envar("OVPN_WEBHOOK_URL").String()
+	webhookSecret            = kingpin.Flag("webhook.secret", "secret for HMAC-SHA256 signature of webhook body sent in X-Ovpn-Admin-Signature header").Default("").Envar("OVPN_WEBHOOK_SECRET").String()
+	webhookTimeout           = kingpin.Flag("webhook.timeout", "timeout of webhook delivery").Default("5s").Envar("OVPN_WEBHOOK_TIMEOUT").Duration()
 	logLevel                 = kingpin.Flag("log.level", "set log level: trace, debug, info, warn, error (default info)").Default("info").Envar("LOG_LEVEL").String()
 	logFormat                = kingpin.Flag("log.format", "set log format: text, json (default text)").Default("text").Envar("LOG_FORMAT").String()
+	logAccessProbes          = kingpin.Flag("log.access-probes", "log requests to metrics and ping along with the rest of requests").Default("false").Envar("LOG_ACCESS_PROBES").Bool()
+	usernamePattern          = kingpin.Flag("username.regexp", "regexp usernames must match, \".\" and \"..\" are rejected regardless").Default(usernameRegexp).Envar("OVPN_USERNAME_REGEXP").String()
+	usernameLengthLimit      = kingpin.Flag("username.max-length", "maximum length of usernames in characters; 64 is the limit of certificate common name").Default(strconv.Itoa(usernameMaxLength)).Envar("OVPN_USERNAME_MAX_LENGTH").Int()
+	userStore                = kingpin.Flag("user-store", "where users list is read from: index.txt, or json sidecar of index.txt kept in sync with it").Default(userStoreIndexTxt).Envar("OVPN_USER_STORE").Enum(userStoreIndexTxt, userStoreJSON)
+	userStoreJSONPath        = kingpin.Flag("user-store.json-path", "path to json sidecar of index.txt (default easyrsa.path/pki/index.json)").Default("").Envar("OVPN_USER_STORE_JSON_PATH").String()
 	storageBackend           = kingpin.Flag("storage.backend", "storage backend: filesystem, kubernetes.secrets (default filesystem)").Default("filesystem").Envar("STORAGE_BACKEND").String()
 
 	certsArchivePath = "/tmp/" + certsArchiveFileName
 	ccdArchivePath   = "/tmp/" + ccdArchiveFileName
 
+	// version is overridden at build time with -ldflags "-X main.version=..."
 	version = "2.0.0"
 )
 
@@ -107,6 +183,12 @@ var (
 	},
 	)
 
+	ovpnCrlExpire = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ovpn_crl_expire",
+		Help: "openvpn CRL expire time in days",
+	},
+	)
+
 	ovpnClientsTotal = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ovpn_clients_total",
 		Help: "total openvpn users",
@@ -125,6 +207,12 @@ var (
 	},
 	)
 
+	ovpnClientsOther = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ovpn_clients_other",
+		Help: "lines of index.txt that are malformed or have unknown flag",
+	},
+	)
+
 	ovpnClientsConnected = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ovpn_clients_connected",
 		Help: "total connected openvpn clients",
@@ -144,6 +232,20 @@ var (
 		[]string{"client"},
 	)
 
+	ovpnClientConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ovpn_client_connected",
+		Help: "openvpn user connection status. value - 1 if user is connected, 0 otherwise",
+	},
+		[]string{"client"},
+	)
+
+	ovpnClientSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ovpn_client_sessions",
+		Help: "number of concurrent sessions of connected openvpn user",
+	},
+		[]string{"client"},
+	)
+
 	ovpnClientConnectionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "ovpn_client_connection_info",
 		Help: "openvpn user connection info. ip - assigned address from ovpn network. value - last time when connection was refreshed in unix format",
@@ -151,6 +253,13 @@ var (
 		[]string{"client", "ip"},
 	)
 
+	ovpnClientConnectionDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ovpn_client_connection_duration_seconds",
+		Help: "openvpn user connection duration. ip - from which address connection was initialized. value - seconds since connection was initialized",
+	},
+		[]string{"client", "ip"},
+	)
+
 	ovpnClientConnectionFrom = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "ovpn_client_connection_from",
 		Help: "openvpn user connection info. ip - from which address connection was initialized. value - time when connection was initialized in unix format",
@@ -171,22 +280,112 @@ var (
 	},
 		[]string{"client"},
 	)
+
+	ovpnClientConnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ovpn_client_connects_total",
+		Help: "total number of openvpn users connects",
+	},
+	)
+
+	ovpnClientDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ovpn_client_disconnects_total",
+		Help: "total number of openvpn users disconnects",
+	},
+	)
+
+	ovpnServerClientsConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ovpn_server_clients_connected",
+		Help: "connected openvpn clients per server mgmt interface and listener",
+	},
+		[]string{"server", "protocol", "port"},
+	)
+
+	ovpnSyncLastAttempt = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ovpn_sync_last_attempt_timestamp",
+		Help: "unix time of the last sync with master, slave only",
+	},
+	)
+
+	ovpnSyncLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ovpn_sync_last_success_timestamp",
+		Help: "unix time of the last successful sync with master, slave only",
+	},
+	)
+
+	ovpnSyncMaster = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ovpn_sync_master",
+		Help: "master the last successful sync was done with, slave only. master - master URL. value - 1 for the master in use, 0 otherwise",
+	},
+		[]string{"master"},
+	)
+
+	ovpnSyncFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ovpn_sync_failures_total",
+		Help: "total number of failed certs and ccd archive downloads from master, slave only",
+	},
+	)
+
+	ovpnAdminInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ovpn_admin_info",
+		Help: "ovpn-admin instance info. role - master or slave. version - ovpn-admin version. value is always 1",
+	},
+		[]string{"role", "version"},
+	)
+
+	ovpnAdminInsecureConfig = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ovpn_admin_insecure_config",
+		Help: "ovpn-admin configuration check. check - name of known-insecure default. value - 1 if it's active, 0 otherwise",
+	},
+		[]string{"check"},
+	)
 )
 
 type OvpnAdmin struct {
 	role                   string
 	lastSyncTime           string
 	lastSuccessfulSyncTime string
-	masterHostBasicAuth    bool
+	lastSyncError          string
+	syncRetryCount         int
+	certsArchiveEtag       string
+	ccdArchiveEtag         string
+	masters                []masterServer
+	rateLimiter            *ipRateLimiter
+	currentMaster          int
+	lastSuccessfulMaster   string
 	masterSyncToken        string
+	// s3 is set with --sync.backend=s3, master uploads archives there and slaves download them from there
+	s3                     *s3Client
 	clients                []OpenvpnClient
+	summary                usersSummary
+	indexTxtAnomalies      []indexTxtAnomaly
 	activeClients          []clientStatus
+	lastSeen               map[string]time.Time
+	lastSeenConnected      map[string]bool
+	lastSeenSaved          time.Time
+	lastSeenUnsaved        bool
 	promRegistry           *prometheus.Registry
 	mgmtInterfaces         map[string]string
+	mgmtListeners          map[string]OpenvpnServer
 	templates              *packr.Box
+	clientConfigTemplate   *template.Template
+	ccdTemplate            *template.Template
 	modules                []string
 	mgmtStatusTimeFormat   string
-	createUserMutex        *sync.Mutex
+	// pkiMutex is held by easyrsa runs and index.txt rewrites, easyrsa isn't safe to run concurrently
+	pkiMutex               *sync.Mutex
+	stateMutex             *sync.RWMutex
+	users                  UserStore
+	ccdRules               []ccdRule
+	pki                    PKIBackend
+	// newTicker makes ticker of updateState, tests replace it with a fake clock
+	newTicker              func(d time.Duration) (<-chan time.Time, func())
+	// fs is the storage of pki, ccd and state files, package level f* helpers use it through pkiFS
+	fs                     fileSystem
+	trackedClients         map[string][]clientStatus
+	missedPolls            map[string]int
+	history                *connectionHistory
+	webhooks               chan webhookEvent
+	audit                  *AuditLogger
 }
 
 type OpenvpnServer struct {
@@ -195,13 +394,61 @@ type OpenvpnServer struct {
 	Protocol string
 }
 
+const (
+	openvpnServerDefaultPort     = "1194"
+	openvpnServerDefaultProtocol = "udp"
+)
+
+// openvpnServerProtocols are accepted by remote directive of client config
+var openvpnServerProtocols = []string{"udp", "tcp", "udp4", "tcp4", "udp6", "tcp6"}
+
+const (
+	clientConfigModeInline = "inline"
+	clientConfigModeFiles  = "files"
+
+	tlsModeAuth    = "tls-auth"
+	tlsModeCrypt   = "tls-crypt"
+	tlsModeCryptV2 = "tls-crypt-v2"
+)
+
+// validUsername is compiled --username.regexp
+var validUsername *regexp.Regexp
+
+// listenTLSVersionIds maps --tls.min-version values to crypto/tls constants
+var listenTLSVersionIds = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 type openvpnClientConfig struct {
 	Hosts      []OpenvpnServer
 	CA         string
 	Cert       string
 	Key        string
 	TLS        string
+	TLSMode    string
 	PasswdAuth bool
+	Inline     bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	TLSFile    string
+	// directives from --client.push-dns, --client.redirect-gateway and --client.extra-option
+	DNS             []string
+	RedirectGateway string
+	ExtraOptions    []string
+}
+
+// usersSummary holds counters of users list, the same ones are exported as metrics
+type usersSummary struct {
+	TotalCerts        int `json:"totalCerts"`
+	ValidCerts        int `json:"validCerts"`
+	RevokedCerts      int `json:"revokedCerts"`
+	ExpiredCerts      int `json:"expiredCerts"`
+	ConnectedUsers    int `json:"connectedUsers"`
+	ActiveConnections int `json:"activeConnections"`
 }
 
 type OpenvpnClient struct {
@@ -209,34 +456,67 @@ type OpenvpnClient struct {
 	AccountStatus    string `json:"AccountStatus"`
 	ExpirationDate   string `json:"ExpirationDate"`
 	RevocationDate   string `json:"RevocationDate"`
+	RevocationReason string `json:"RevocationReason"`
 	ConnectionStatus string `json:"ConnectionStatus"`
 	Connections      int    `json:"Connections"`
+	SerialNumber     string `json:"SerialNumber"`
+	LastSeen         string `json:"LastSeen"`
+	Email            string `json:"Email"`
+}
+
+// userDetail is returned by api/user/detail, it's the users list entry along with everything else known
+// about the user. Certificate fields are empty if the certificate file is gone, e.g. for revoked users
+type userDetail struct {
+	OpenvpnClient
+	NotBefore   string         `json:"NotBefore"`
+	NotAfter    string         `json:"NotAfter"`
+	Fingerprint string         `json:"Fingerprint"`
+	Ccd         *Ccd           `json:"Ccd,omitempty"`
+	Sessions    []clientStatus `json:"Sessions"`
 }
 
 type ccdRoute struct {
 	Address     string `json:"Address"`
 	Mask        string `json:"Mask"`
 	Description string `json:"Description"`
+	// Type is either "push" (default) for routes pushed to client or "iroute" for subnets behind client
+	Type string `json:"Type"`
+}
+
+const (
+	ccdRouteTypePush   = "push"
+	ccdRouteTypeIroute = "iroute"
+)
+
+func (route ccdRoute) routeType() string {
+	if route.Type == "" {
+		return ccdRouteTypePush
+	}
+	return route.Type
 }
 
 type Ccd struct {
-	User          string     `json:"User"`
-	ClientAddress string     `json:"ClientAddress"`
-	CustomRoutes  []ccdRoute `json:"CustomRoutes"`
+	User          string            `json:"User"`
+	ClientAddress string            `json:"ClientAddress"`
+	CustomRoutes  []ccdRoute        `json:"CustomRoutes"`
+	Metadata      map[string]string `json:"Metadata,omitempty"`
 }
 
 type indexTxtLine struct {
 	Flag              string
 	ExpirationDate    string
 	RevocationDate    string
+	RevocationReason  string
 	SerialNumber      string
 	Filename          string
 	DistinguishedName string
 	Identity          string
+	Email             string
 }
 
 type clientStatus struct {
 	CommonName              string
+	ClientId                string
 	RealAddress             string
 	BytesReceived           string
 	BytesSent               string
@@ -246,127 +526,468 @@ type clientStatus struct {
 	ConnectedSinceFormatted string
 	LastRefFormatted        string
 	ConnectedTo             string
+	Protocol                string
+	Port                    string
+}
+
+// routingTableEntry is a line of ROUTING TABLE of openvpn status, ConnectedTo is the mgmt interface alias
+type routingTableEntry struct {
+	VirtualAddress string
+	CommonName     string
+	RealAddress    string
+	LastRef        string
+	ConnectedTo    string
+}
+
+func (oAdmin *OvpnAdmin) summaryHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug(r.RemoteAddr, " ", r.RequestURI)
+
+	if *storageBackend == "kubernetes.secrets" {
+		oAdmin.pkiMutex.Lock()
+		err := app.updateIndexTxtOnDisk()
+		oAdmin.pkiMutex.Unlock()
+		if err != nil {
+			log.Errorln(err)
+		}
+		oAdmin.refreshClients()
+	}
+
+	oAdmin.stateMutex.RLock()
+	summary := oAdmin.summary
+	oAdmin.stateMutex.RUnlock()
+	writeJSON(w, summary)
 }
 
 func (oAdmin *OvpnAdmin) userListHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 
 	if *storageBackend == "kubernetes.secrets" {
+		oAdmin.pkiMutex.Lock()
 		err := app.updateIndexTxtOnDisk()
+		oAdmin.pkiMutex.Unlock()
 		if err != nil {
 			log.Errorln(err)
 		}
-		oAdmin.clients = oAdmin.usersList()
+		oAdmin.refreshClients()
+	}
+
+	oAdmin.stateMutex.RLock()
+	clients := oAdmin.clients
+	oAdmin.stateMutex.RUnlock()
+
+	var modTime time.Time
+	if info, err := oAdmin.fs.Stat(*indexTxtPath); err == nil {
+		modTime = info.ModTime()
+	}
+
+	_ = r.ParseForm()
+	if sortBy := r.FormValue("sort"); sortBy != "" {
+		var err error
+		clients, err = sortClients(clients, sortBy, r.FormValue("order") == "desc")
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// full list is kept for clients not aware of paging
+	if r.FormValue("limit") == "" && r.FormValue("offset") == "" && r.FormValue("status") == "" && r.FormValue("search") == "" {
+		writeJSONCached(w, r, clients, modTime)
+		return
+	}
+
+	limit, offset, err := parsePaging(r, len(clients))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status := r.FormValue("status")
+	search := strings.ToLower(r.FormValue("search"))
+	users := []OpenvpnClient{}
+	for _, client := range clients {
+		if status == "Connected" && client.ConnectionStatus != "Connected" {
+			continue
+		}
+		if status != "" && status != "Connected" && client.AccountStatus != status {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(client.Identity), search) {
+			continue
+		}
+		users = append(users, client)
+	}
+
+	total := len(users)
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		users = users[offset : offset+limit]
+	} else {
+		users = users[offset:]
+	}
+
+	writeJSONCached(w, r, struct {
+		Total  int             `json:"Total"`
+		Limit  int             `json:"Limit"`
+		Offset int             `json:"Offset"`
+		Users  []OpenvpnClient `json:"Users"`
+	}{total, limit, offset, users}, modTime)
+}
+
+// sortClients returns sorted copy of clients, sortBy is one of identity, expiration or status
+func sortClients(clients []OpenvpnClient, sortBy string, desc bool) ([]OpenvpnClient, error) {
+	var less func(a, b OpenvpnClient) bool
+	switch sortBy {
+	case "identity":
+		less = func(a, b OpenvpnClient) bool { return a.Identity < b.Identity }
+	case "expiration":
+		less = func(a, b OpenvpnClient) bool {
+			return parseDate(stringDateFormat, a.ExpirationDate).Before(parseDate(stringDateFormat, b.ExpirationDate))
+		}
+	case "status":
+		less = func(a, b OpenvpnClient) bool { return a.AccountStatus < b.AccountStatus }
+	default:
+		return nil, fmt.Errorf("sort must be one of identity, expiration or status")
+	}
+
+	sorted := make([]OpenvpnClient, len(clients))
+	copy(sorted, clients)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if desc {
+			return less(sorted[j], sorted[i])
+		}
+		return less(sorted[i], sorted[j])
+	})
+	return sorted, nil
+}
+
+// parsePaging returns limit and offset form values, limit is defaultLimit if it's not set
+func parsePaging(r *http.Request, defaultLimit int) (int, int, error) {
+	var err error
+	limit := defaultLimit
+	offset := 0
+
+	if v := r.FormValue("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("limit must be a positive number")
+		}
+	}
+	if v := r.FormValue("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative number")
+		}
 	}
 
-	usersList, _ := json.Marshal(oAdmin.clients)
-	fmt.Fprintf(w, "%s", usersList)
+	return limit, offset, nil
 }
 
 func (oAdmin *OvpnAdmin) userStatisticHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	_ = r.ParseForm()
-	userStatistic, _ := json.Marshal(oAdmin.getUserStatistic(r.FormValue("username")))
-	fmt.Fprintf(w, "%s", userStatistic)
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, oAdmin.getUserStatistic(username))
+}
+
+func (oAdmin *OvpnAdmin) userDetailHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	_ = r.ParseForm()
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+
+	oAdmin.stateMutex.RLock()
+	clients := oAdmin.clients
+	oAdmin.stateMutex.RUnlock()
+
+	for _, client := range clients {
+		if client.Identity != username {
+			continue
+		}
+		writeJSON(w, oAdmin.getUserDetail(client))
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, fmt.Sprintf("User \"%s\" not found", username))
+}
+
+func (oAdmin *OvpnAdmin) getUserDetail(client OpenvpnClient) userDetail {
+	detail := userDetail{OpenvpnClient: client, Sessions: oAdmin.getUserStatistic(client.Identity)}
+	if detail.Sessions == nil {
+		detail.Sessions = []clientStatus{}
+	}
+	if *ccdEnabled {
+		ccd := oAdmin.getCcd(client.Identity)
+		detail.Ccd = &ccd
+	}
+
+	cert, err := userCert(client.Identity)
+	if err != nil {
+		log.WithField("username", client.Identity).Debugf("getUserDetail: %s", err)
+		return detail
+	}
+	detail.NotBefore = cert.NotBefore.Format(stringDateFormat)
+	detail.NotAfter = cert.NotAfter.Format(stringDateFormat)
+	detail.Fingerprint = sha256Fingerprint(cert.Raw)
+	return detail
+}
+
+// userCert returns the issued certificate of username
+func userCert(username string) (*x509.Certificate, error) {
+	if *storageBackend == "kubernetes.secrets" {
+		certPEM, _ := app.easyrsaGetClientCert(username)
+		return decodeCert([]byte(certPEM))
+	}
+	return readCertCached(*easyrsaDirPath + "/pki/issued/" + username + ".crt")
+}
+
+// userBySerialHandler looks up index.txt line by certificate serial, e.g. one found in CRL.
+// Rotated and deleted users are found under their REVOKED-<username>-<hash> name
+func (oAdmin *OvpnAdmin) userBySerialHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	_ = r.ParseForm()
+	serial, err := normalizeSerial(r.FormValue("serial"))
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	line, ok := findBySerial(oAdmin.users.List(), serial)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("certificate with serial %s not found", serial))
+		return
+	}
+	writeJSON(w, line)
 }
 
 func (oAdmin *OvpnAdmin) userCreateHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	if oAdmin.role == "slave" {
-		http.Error(w, `{"status":"error"}`, http.StatusLocked)
+		writeJSONError(w, http.StatusLocked, "not available on slave")
 		return
 	}
 	_ = r.ParseForm()
-	userCreated, userCreateStatus := oAdmin.userCreate(r.FormValue("username"), r.FormValue("password"))
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	opts, err := parseClientCertOptions(r.FormValue("email"), r.FormValue("san"))
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	userCreated, userCreateStatus := oAdmin.userCreate(username, r.FormValue("password"), opts)
 
 	if userCreated {
-		oAdmin.clients = oAdmin.usersList()
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, userCreateStatus)
+		oAdmin.refreshClients()
+		oAdmin.auditOperation(r, "create", username, nil)
+		oAdmin.notifyWebhook(webhookEventUserCreated, username, r)
+		writeJSONMessage(w, userCreateStatus)
 		return
 	} else {
-		http.Error(w, userCreateStatus, http.StatusUnprocessableEntity)
+		oAdmin.auditOperation(r, "create", username, errors.New(userCreateStatus))
+		writeJSONError(w, http.StatusUnprocessableEntity, userCreateStatus)
+	}
+}
+
+type bulkCreateResult struct {
+	Created bool   `json:"Created"`
+	Message string `json:"Message"`
+}
+
+// usersBulkCreateHandler creates users from JSON array of usernames. The whole batch is rejected
+// if any username is malformed unless best-effort=true is passed, then such users are just reported.
+// Usernames repeated in the array are always rejected, results are keyed by username so they couldn't be reported.
+func (oAdmin *OvpnAdmin) usersBulkCreateHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if oAdmin.role == "slave" {
+		writeJSONError(w, http.StatusLocked, "not available on slave")
+		return
+	}
+	if *authByPassword {
+		writeJSONError(w, http.StatusUnprocessableEntity, "Bulk user creation is not available with additional password authentication")
+		return
+	}
+
+	var usernames []string
+	if r.Body == nil {
+		writeJSONError(w, http.StatusBadRequest, "Please send a request body")
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&usernames)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Please send JSON array of usernames: %s", err))
+		return
+	}
+	bestEffort := r.URL.Query().Get("best-effort") == "true"
+
+	seen := make(map[string]bool)
+	for _, username := range usernames {
+		if seen[username] {
+			writeJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("User \"%s\": duplicate in request", username))
+			return
+		}
+		seen[username] = true
+	}
+
+	results := make(map[string]bulkCreateResult)
+	for _, username := range usernames {
+		if err := validateUsername(username); err != nil {
+			if !bestEffort {
+				writeJSONError(w, http.StatusUnprocessableEntity, fmt.Sprintf("User \"%s\": %s", username, err))
+				return
+			}
+			results[username] = bulkCreateResult{Message: err.Error()}
+		}
+	}
+
+	created := 0
+	for _, username := range usernames {
+		if _, ok := results[username]; ok {
+			continue
+		}
+		userCreated, userCreateStatus := oAdmin.userCreate(username, "", clientCertOptions{})
+		results[username] = bulkCreateResult{Created: userCreated, Message: strings.TrimSpace(userCreateStatus)}
+		if userCreated {
+			created += 1
+			oAdmin.auditOperation(r, "create", username, nil)
+			oAdmin.notifyWebhook(webhookEventUserCreated, username, r)
+		} else {
+			oAdmin.auditOperation(r, "create", username, errors.New(userCreateStatus))
+		}
+	}
+
+	if created > 0 {
+		oAdmin.refreshClients()
 	}
+
+	writeJSON(w, results)
 }
+
 func (oAdmin *OvpnAdmin) userRotateHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	if oAdmin.role == "slave" {
-		http.Error(w, `{"status":"error"}`, http.StatusLocked)
+		writeJSONError(w, http.StatusLocked, "not available on slave")
 		return
 	}
 	_ = r.ParseForm()
-	err, msg := oAdmin.userRotate(r.FormValue("username"), r.FormValue("password"))
+	username, ok := requestUsername(w, r)
+	if !ok || !oAdmin.requireUser(w, username) {
+		return
+	}
+	err, result := oAdmin.userRotate(username, r.FormValue("password"))
+	oAdmin.auditOperation(r, "rotate", username, err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 	} else {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, msg)
+		writeJSON(w, result)
 	}
 }
 
 func (oAdmin *OvpnAdmin) userDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	if oAdmin.role == "slave" {
-		http.Error(w, `{"status":"error"}`, http.StatusLocked)
+		writeJSONError(w, http.StatusLocked, "not available on slave")
 		return
 	}
 	_ = r.ParseForm()
-	err, msg := oAdmin.userDelete(r.FormValue("username"))
+	username, ok := requestUsername(w, r)
+	if !ok || !oAdmin.requireUser(w, username) {
+		return
+	}
+	err, result := oAdmin.userDelete(username)
+	oAdmin.auditOperation(r, "delete", username, err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 	} else {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, msg)
+		writeJSON(w, result)
 	}
 }
 
 func (oAdmin *OvpnAdmin) userRevokeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	if oAdmin.role == "slave" {
-		http.Error(w, `{"status":"error"}`, http.StatusLocked)
+		writeJSONError(w, http.StatusLocked, "not available on slave")
 		return
 	}
 	_ = r.ParseForm()
-	err, msg := oAdmin.userRevoke(r.FormValue("username"))
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = defaultRevocationReason
+	}
+	if err := validateRevocationReason(reason); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !oAdmin.requireUser(w, username) {
+		return
+	}
+	if r.FormValue("dry_run") == "true" {
+		err, plan := oAdmin.userRevokeDryRun(username, reason)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+		} else {
+			writeJSON(w, plan)
+		}
+		return
+	}
+	err, msg := oAdmin.userRevoke(username, reason)
+	oAdmin.auditOperation(r, "revoke", username, err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 	} else {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, msg)
+		oAdmin.notifyWebhook(webhookEventUserRevoked, username, r)
+		writeJSONMessage(w, msg)
 	}
 }
 
 func (oAdmin *OvpnAdmin) userUnrevokeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	if oAdmin.role == "slave" {
-		http.Error(w, `{"status":"error"}`, http.StatusLocked)
+		writeJSONError(w, http.StatusLocked, "not available on slave")
 		return
 	}
 	_ = r.ParseForm()
-	err, msg := oAdmin.userUnrevoke(r.FormValue("username"))
+	username, ok := requestUsername(w, r)
+	if !ok || !oAdmin.requireUser(w, username) {
+		return
+	}
+	err, msg := oAdmin.userUnrevoke(username)
+	oAdmin.auditOperation(r, "unrevoke", username, err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 	} else {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, msg)
+		oAdmin.notifyWebhook(webhookEventUserUnrevoked, username, r)
+		writeJSONMessage(w, msg)
 	}
 }
 
 func (oAdmin *OvpnAdmin) userChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	_ = r.ParseForm()
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
 	if *authByPassword {
-		err, msg := oAdmin.userChangePassword(r.FormValue("username"), r.FormValue("password"))
+		err, msg := oAdmin.userChangePassword(username, r.FormValue("password"))
+		oAdmin.auditOperation(r, "change-password", username, err)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, `{"status":"error", "message": "%s"}`, msg)
-
+			writeJSONError(w, http.StatusBadRequest, err.Error())
 		} else {
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, `{"status":"ok", "message": "%s"}`, msg)
+			writeJSONMessage(w, msg)
 		}
 	} else {
-		http.Error(w, `{"status":"error"}`, http.StatusNotImplemented)
+		writeJSONError(w, http.StatusNotImplemented, "password authentication is not enabled")
 	}
 
 }
@@ -374,32 +995,103 @@ func (oAdmin *OvpnAdmin) userChangePasswordHandler(w http.ResponseWriter, r *htt
 func (oAdmin *OvpnAdmin) userShowConfigHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	_ = r.ParseForm()
-	fmt.Fprintf(w, "%s", oAdmin.renderClientConfig(r.FormValue("username")))
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	config, err := oAdmin.renderClientConfig(username)
+	if err == errUserNotFound {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("user \"%s\" not found", username))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, config)
+}
+
+func (oAdmin *OvpnAdmin) userDownloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	_ = r.ParseForm()
+	username, ok := requestUsername(w, r)
+	if !ok || !oAdmin.requireUser(w, username) {
+		return
+	}
+	conf := newClientConfig(username)
+	config, err := oAdmin.executeClientConfig(username, conf)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !conf.Inline {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+".zip"))
+		if err = writeClientConfigZip(w, username, config, conf); err != nil {
+			log.WithField("username", username).Warnf("error writing config bundle: %s", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-openvpn-profile")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+".ovpn"))
+	fmt.Fprint(w, config)
+}
+
+func (oAdmin *OvpnAdmin) userShowChainHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	_ = r.ParseForm()
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	chain, err := oAdmin.getUserCertChain(username)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(chain)
 }
 
 func (oAdmin *OvpnAdmin) userDisconnectHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if oAdmin.role == "slave" {
+		writeJSONError(w, http.StatusLocked, "not available on slave")
+		return
+	}
 	_ = r.ParseForm()
-	// 	fmt.Fprintf(w, "%s", userDisconnect(r.FormValue("username")))
-	fmt.Fprintf(w, "%s", r.FormValue("username"))
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	err, msg := oAdmin.userDisconnect(username, r.FormValue("cid"))
+	oAdmin.auditOperation(r, "disconnect", username, err)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("%s: %s", err, msg))
+	} else {
+		writeJSONMessage(w, msg)
+	}
 }
 
 func (oAdmin *OvpnAdmin) userShowCcdHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	_ = r.ParseForm()
-	ccd, _ := json.Marshal(oAdmin.getCcd(r.FormValue("username")))
-	fmt.Fprintf(w, "%s", ccd)
+	username, ok := requestUsername(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, oAdmin.getCcd(username))
 }
 
 func (oAdmin *OvpnAdmin) userApplyCcdHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	if oAdmin.role == "slave" {
-		http.Error(w, `{"status":"error"}`, http.StatusLocked)
+		writeJSONError(w, http.StatusLocked, "not available on slave")
 		return
 	}
 	var ccd Ccd
 	if r.Body == nil {
-		http.Error(w, "Please send a request body", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "Please send a request body")
 		return
 	}
 
@@ -407,81 +1099,282 @@ func (oAdmin *OvpnAdmin) userApplyCcdHandler(w http.ResponseWriter, r *http.Requ
 	if err != nil {
 		log.Errorln(err)
 	}
+	if err = validateUsername(ccd.User); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
 
-	ccdApplied, applyStatus := oAdmin.modifyCcd(ccd)
+	dryRun := r.FormValue("dry_run") == "true"
+	ccdApplied, applyStatus := oAdmin.modifyCcd(ccd, dryRun)
 
 	if ccdApplied {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, applyStatus)
+		if dryRun {
+			writeJSON(w, struct {
+				DryRun   bool   `json:"DryRun"`
+				Rendered string `json:"Rendered"`
+			}{true, applyStatus})
+			return
+		}
+		oAdmin.auditOperation(r, "ccd-apply", ccd.User, nil)
+		writeJSONMessage(w, applyStatus)
 		return
 	} else {
-		http.Error(w, applyStatus, http.StatusUnprocessableEntity)
+		if !dryRun {
+			oAdmin.auditOperation(r, "ccd-apply", ccd.User, errors.New(applyStatus))
+		}
+		writeJSONError(w, http.StatusUnprocessableEntity, applyStatus)
 	}
 }
 
-func (oAdmin *OvpnAdmin) serverSettingsHandler(w http.ResponseWriter, r *http.Request) {
+func (oAdmin *OvpnAdmin) userPreviewCcdHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	var ccd Ccd
+	if r.Body == nil {
+		writeJSONError(w, http.StatusBadRequest, "Please send a request body")
+		return
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&ccd)
+	if err != nil {
+		log.Errorln(err)
+	}
+	if err = validateUsername(ccd.User); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	ccd = oAdmin.applyCcdRules(ccd)
+	_, validateStatus := validateCcd(ccd)
+
+	writeJSON(w, struct {
+		Ccd      Ccd    `json:"Ccd"`
+		Rendered string `json:"Rendered"`
+		Error    string `json:"Error"`
+	}{ccd, oAdmin.renderCcd(ccd), validateStatus})
+}
+
+func (oAdmin *OvpnAdmin) serverRoutesHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
-	enabledModules, enabledModulesErr := json.Marshal(oAdmin.modules)
-	if enabledModulesErr != nil {
-		log.Errorln(enabledModulesErr)
+	writeJSON(w, oAdmin.mgmtGetRoutingTable())
+}
+
+// serverCertInfo is returned by api/server/cert
+type serverCertInfo struct {
+	Subject      string  `json:"Subject"`
+	Issuer       string  `json:"Issuer"`
+	SerialNumber string  `json:"SerialNumber"`
+	NotBefore    string  `json:"NotBefore"`
+	NotAfter     string  `json:"NotAfter"`
+	DaysLeft     float64 `json:"DaysLeft"`
+}
+
+func (oAdmin *OvpnAdmin) serverCertHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	cert, err := oAdmin.pki.ServerCertificate()
+	if err != nil {
+		log.Errorf("serverCertHandler: %s", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	fmt.Fprintf(w, `{"status":"ok", "serverRole": "%s", "modules": %s }`, oAdmin.role, string(enabledModules))
+	writeJSON(w, serverCertInfo{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: fmt.Sprintf("%X", cert.SerialNumber),
+		NotBefore:    cert.NotBefore.Format(stringDateFormat),
+		NotAfter:     cert.NotAfter.Format(stringDateFormat),
+		DaysLeft:     expireDays(cert.NotAfter.Unix(), time.Now().Unix()),
+	})
+}
+
+func (oAdmin *OvpnAdmin) serverSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	writeJSON(w, struct {
+		ServerRole string   `json:"serverRole"`
+		Modules    []string `json:"modules"`
+		ReadOnly   bool     `json:"readOnly"`
+	}{oAdmin.role, oAdmin.modules, oAdmin.role == "slave"})
 }
 
 func (oAdmin *OvpnAdmin) lastSyncTimeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug(r.RemoteAddr, " ", r.RequestURI)
-	fmt.Fprint(w, oAdmin.lastSyncTime)
+	writeJSON(w, oAdmin.getSyncStatus().LastSyncTime)
 }
 
 func (oAdmin *OvpnAdmin) lastSuccessfulSyncTimeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug(r.RemoteAddr, " ", r.RequestURI)
-	fmt.Fprint(w, oAdmin.lastSuccessfulSyncTime)
+	writeJSON(w, oAdmin.getSyncStatus().LastSuccessfulSyncTime)
+}
+
+type syncStatus struct {
+	Role                   string   `json:"Role"`
+	Master                 string   `json:"Master"`
+	Masters                []string `json:"Masters"`
+	LastSuccessfulMaster   string   `json:"LastSuccessfulMaster"`
+	LastSyncTime           string   `json:"LastSyncTime"`
+	LastSuccessfulSyncTime string   `json:"LastSuccessfulSyncTime"`
+	LastError              string   `json:"LastError"`
+	RetryCount             int      `json:"RetryCount"`
+}
+
+func (oAdmin *OvpnAdmin) getSyncStatus() syncStatus {
+	oAdmin.stateMutex.RLock()
+	defer oAdmin.stateMutex.RUnlock()
+	status := syncStatus{
+		Role:                   oAdmin.role,
+		LastSyncTime:           oAdmin.lastSyncTime,
+		LastSuccessfulSyncTime: oAdmin.lastSuccessfulSyncTime,
+		LastError:              oAdmin.lastSyncError,
+		RetryCount:             oAdmin.syncRetryCount,
+	}
+	if oAdmin.role == "slave" {
+		status.Master = oAdmin.masters[oAdmin.currentMaster].url
+		status.LastSuccessfulMaster = oAdmin.lastSuccessfulMaster
+		for _, m := range oAdmin.masters {
+			status.Masters = append(status.Masters, m.url)
+		}
+	}
+	return status
+}
+
+func (oAdmin *OvpnAdmin) syncStatusHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug(r.RemoteAddr, " ", r.RequestURI)
+	writeJSON(w, oAdmin.getSyncStatus())
+}
+
+func (oAdmin *OvpnAdmin) syncResetHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if oAdmin.role != "slave" {
+		writeJSONError(w, http.StatusBadRequest, "sync reset is available on slave only")
+		return
+	}
+	oAdmin.resetSyncState()
+	writeJSONMessage(w, "sync state reset")
+}
+
+func (oAdmin *OvpnAdmin) crlRegenerateHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if oAdmin.role == "slave" {
+		writeJSONError(w, http.StatusLocked, "not available on slave")
+		return
+	}
+
+	oAdmin.pkiMutex.Lock()
+	err := oAdmin.pki.GenCRL()
+	if err == nil {
+		crlFix()
+	}
+	oAdmin.pkiMutex.Unlock()
+	if err != nil {
+		log.Errorf("crlRegenerateHandler: %s", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	_, nextUpdate, err := getCrlUpdateDates()
+	if err != nil {
+		log.Errorf("crlRegenerateHandler: %s", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ovpnCrlExpire.Set(expireDays(nextUpdate.Unix(), time.Now().Unix()))
+	log.Infof("CRL regenerated, next update at %s", nextUpdate.Format(stringDateFormat))
+
+	writeJSON(w, struct {
+		NextUpdate string `json:"NextUpdate"`
+	}{nextUpdate.Format(stringDateFormat)})
 }
 
 func (oAdmin *OvpnAdmin) downloadCertsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	if oAdmin.role == "slave" {
-		http.Error(w, `{"status":"error"}`, http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "not available on slave")
 		return
 	}
 	if *storageBackend == "kubernetes.secrets" {
-		http.Error(w, `{"status":"error"}`, http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "not available with kubernetes.secrets storage backend")
 		return
 	}
 	_ = r.ParseForm()
-	token := r.Form.Get("token")
+	if !oAdmin.checkSyncToken(r.Form.Get("token")) {
+		writeJSONError(w, http.StatusForbidden, "invalid sync token")
+		return
+	}
+
+	oAdmin.serveArchive(w, r, *easyrsaDirPath+"/pki", certsArchiveFileName)
+}
+
+// indexTxtHandler returns all lines of index.txt with flags, serials and DNs for debugging
+func (oAdmin *OvpnAdmin) indexTxtHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if !oAdmin.checkIndexTxtAccess(w, r) {
+		return
+	}
+
+	lines := indexTxtParser(fRead(*indexTxtPath))
+	if lines == nil {
+		lines = []indexTxtLine{}
+	}
+	writeJSON(w, lines)
+}
 
-	if token != oAdmin.masterSyncToken {
-		http.Error(w, `{"status":"error"}`, http.StatusForbidden)
+// indexTxtAnomaliesHandler returns lines of index.txt found by the last refreshClients that
+// users list doesn't show, they are counted by ovpn_clients_other
+func (oAdmin *OvpnAdmin) indexTxtAnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Info(r.RemoteAddr, " ", r.RequestURI)
+	if !oAdmin.checkIndexTxtAccess(w, r) {
 		return
 	}
 
-	archiveCerts()
-	w.Header().Set("Content-Disposition", "attachment; filename="+certsArchiveFileName)
-	http.ServeFile(w, r, certsArchivePath)
+	oAdmin.stateMutex.RLock()
+	anomalies := oAdmin.indexTxtAnomalies
+	oAdmin.stateMutex.RUnlock()
+	if anomalies == nil {
+		anomalies = []indexTxtAnomaly{}
+	}
+	writeJSON(w, anomalies)
+}
+
+// checkIndexTxtAccess replies with error unless index.txt may be shown to r, it's protected
+// by the sync token like archive downloads
+func (oAdmin *OvpnAdmin) checkIndexTxtAccess(w http.ResponseWriter, r *http.Request) bool {
+	if oAdmin.role == "slave" {
+		writeJSONError(w, http.StatusBadRequest, "not available on slave")
+		return false
+	}
+	// sync token may be left at the default value with kubernetes.secrets backend
+	if *storageBackend == "kubernetes.secrets" {
+		writeJSONError(w, http.StatusBadRequest, "not available with kubernetes.secrets storage backend")
+		return false
+	}
+	_ = r.ParseForm()
+	if !oAdmin.checkSyncToken(r.Form.Get("token")) {
+		writeJSONError(w, http.StatusForbidden, "invalid sync token")
+		return false
+	}
+	return true
 }
 
 func (oAdmin *OvpnAdmin) downloadCcdHandler(w http.ResponseWriter, r *http.Request) {
 	log.Info(r.RemoteAddr, " ", r.RequestURI)
 	if oAdmin.role == "slave" {
-		http.Error(w, `{"status":"error"}`, http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "not available on slave")
 		return
 	}
 	if *storageBackend == "kubernetes.secrets" {
-		http.Error(w, `{"status":"error"}`, http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "not available with kubernetes.secrets storage backend")
 		return
 	}
 	_ = r.ParseForm()
-	token := r.Form.Get("token")
-
-	if token != oAdmin.masterSyncToken {
-		http.Error(w, `{"status":"error"}`, http.StatusForbidden)
+	if !oAdmin.checkSyncToken(r.Form.Get("token")) {
+		writeJSONError(w, http.StatusForbidden, "invalid sync token")
 		return
 	}
 
-	archiveCcd()
-	w.Header().Set("Content-Disposition", "attachment; filename="+ccdArchiveFileName)
-	http.ServeFile(w, r, ccdArchivePath)
+	oAdmin.serveArchive(w, r, *ccdDir, ccdArchiveFileName)
+}
+
+func (oAdmin *OvpnAdmin) checkSyncToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(oAdmin.masterSyncToken)) == 1
 }
 
 var app OpenVPNPKI
@@ -490,8 +1383,20 @@ func main() {
 	kingpin.Version(version)
 	kingpin.Parse()
 
-	log.SetLevel(logLevels[*logLevel])
-	log.SetFormatter(logFormats[*logFormat])
+	level, ok := logLevels[*logLevel]
+	if !ok {
+		log.Fatalf("unknown log level %s, expected one of trace, debug, info, warn, error", *logLevel)
+	}
+	formatter, ok := logFormats[*logFormat]
+	if !ok {
+		log.Fatalf("unknown log format %s, expected one of text, json", *logFormat)
+	}
+	log.SetLevel(level)
+	log.SetFormatter(formatter)
+
+	if *stateRefreshInterval <= 0 {
+		log.Fatalf("--state.refresh-interval must be positive, got %s", *stateRefreshInterval)
+	}
 
 	if *storageBackend == "kubernetes.secrets" {
 		err := app.run()
@@ -504,33 +1409,156 @@ func main() {
 		*indexTxtPath = *easyrsaDirPath + "/pki/index.txt"
 	}
 
+	var err error
+	if validUsername, err = regexp.Compile(*usernamePattern); err != nil {
+		log.Fatalf("--username.regexp: %s", err)
+	}
+
+	if err = validateClientOptions(); err != nil {
+		log.Fatal(err)
+	}
+	for _, server := range *openvpnServer {
+		if _, err = parseOpenvpnServer(server); err != nil {
+			log.Fatalf("wrong ovpn.server value %s: %s", server, err)
+		}
+	}
+
+	if (*listenTLSCertFile == "") != (*listenTLSKeyFile == "") {
+		log.Fatal("--tls.cert-file and --tls.key-file must be set together")
+	}
+
+	if *crlDays > 0 {
+		os.Setenv("EASYRSA_CRL_DAYS", strconv.Itoa(*crlDays))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	ovpnAdmin := new(OvpnAdmin)
 
 	ovpnAdmin.lastSyncTime = "unknown"
 	ovpnAdmin.role = *serverRole
 	ovpnAdmin.lastSuccessfulSyncTime = "unknown"
 	ovpnAdmin.masterSyncToken = *masterSyncToken
+
+	// slaves download whole pki with this token, kubernetes.secrets backend doesn't serve sync downloads
+	if ovpnAdmin.role == "master" && *storageBackend != "kubernetes.secrets" && ovpnAdmin.masterSyncToken == defaultMasterSyncToken {
+		log.Fatal("--master.sync-token is left at the default value, please set a unique token with --master.sync-token or OVPN_MASTER_TOKEN")
+	}
+	ovpnAdmin.newTicker = newTimeTicker
+	ovpnAdmin.fs = osFileSystem{}
+	pkiFS = ovpnAdmin.fs
 	ovpnAdmin.promRegistry = prometheus.NewRegistry()
 	ovpnAdmin.modules = []string{}
-	ovpnAdmin.createUserMutex = &sync.Mutex{}
+	ovpnAdmin.pkiMutex = &sync.Mutex{}
+	ovpnAdmin.stateMutex = &sync.RWMutex{}
+	ovpnAdmin.users = newUserStore(ovpnAdmin.fs, *userStore)
 	ovpnAdmin.mgmtInterfaces = make(map[string]string)
+	ovpnAdmin.trackedClients = make(map[string][]clientStatus)
+	ovpnAdmin.missedPolls = make(map[string]int)
+
+	if *storageBackend == "kubernetes.secrets" {
+		ovpnAdmin.pki = &app
+	} else {
+		ovpnAdmin.pki = &easyrsaBackend{fs: ovpnAdmin.fs}
+	}
+
+	if *ccdRulesPath != "" {
+		var err error
+		ovpnAdmin.ccdRules, err = loadCcdRules(*ccdRulesPath)
+		if err != nil {
+			log.Fatalf("failed to load ccd rules from %s: %s", *ccdRulesPath, err)
+		}
+		log.Infof("Loaded %d ccd rules from %s", len(ovpnAdmin.ccdRules), *ccdRulesPath)
+	}
+
+	for _, mgmtValue := range *mgmtAddress {
+		for _, mgmtInterface := range strings.Split(mgmtValue, ",") {
+			mgmtInterface = strings.TrimSpace(mgmtInterface)
+			if mgmtInterface == "" {
+				continue
+			}
+			parts := strings.SplitN(mgmtInterface, "=", 2)
+			ovpnAdmin.mgmtInterfaces[parts[0]] = parts[len(parts)-1]
+		}
+	}
 
-	for _, mgmtInterface := range *mgmtAddress {
-		parts := strings.SplitN(mgmtInterface, "=", 2)
-		ovpnAdmin.mgmtInterfaces[parts[0]] = parts[len(parts)-1]
+	ovpnAdmin.mgmtListeners = make(map[string]OpenvpnServer)
+	for _, listener := range *mgmtListener {
+		parts := strings.SplitN(listener, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("wrong mgmt.listener value %s, expected ALIAS=PROTOCOL:PORT", listener)
+		}
+		listenerParts := strings.SplitN(parts[1], ":", 2)
+		l := OpenvpnServer{Protocol: listenerParts[0]}
+		if len(listenerParts) == 2 {
+			l.Port = listenerParts[1]
+		}
+		ovpnAdmin.mgmtListeners[parts[0]] = l
 	}
 
 	ovpnAdmin.mgmtSetTimeFormat()
 
+	if *historyDbPath != "" {
+		var err error
+		ovpnAdmin.history, err = openConnectionHistory(*historyDbPath)
+		if err != nil {
+			log.Fatalf("failed to open connection history database %s: %s", *historyDbPath, err)
+		}
+	}
+
+	ovpnAdmin.lastSeen = make(map[string]time.Time)
+	if *lastSeenPath != "" {
+		var err error
+		ovpnAdmin.lastSeen, err = loadLastSeen(ovpnAdmin.fs, *lastSeenPath)
+		if err != nil {
+			log.Fatalf("failed to load last seen times from %s: %s", *lastSeenPath, err)
+		}
+	}
+
 	ovpnAdmin.registerMetrics()
+	ovpnAdmin.checkInsecureConfig()
 	ovpnAdmin.setState()
 
-	go ovpnAdmin.updateState()
+	go ovpnAdmin.updateState(ctx)
 
-	if *masterBasicAuthPassword != "" && *masterBasicAuthUser != "" {
-		ovpnAdmin.masterHostBasicAuth = true
-	} else {
-		ovpnAdmin.masterHostBasicAuth = false
+	if *auditLogPath != "" {
+		var err error
+		ovpnAdmin.audit, err = newAuditLogger(*auditLogPath)
+		if err != nil {
+			log.Fatalf("failed to open audit log %s: %s", *auditLogPath, err)
+		}
+	}
+
+	if *webhookUrl != "" {
+		ovpnAdmin.webhooks = make(chan webhookEvent, webhookQueueSize)
+		go ovpnAdmin.deliverWebhooks(ctx)
+	}
+
+	if *rateLimit > 0 {
+		ovpnAdmin.rateLimiter = newIpRateLimiter(*rateLimit)
+	}
+
+	if *syncBackend == syncBackendS3 {
+		if ovpnAdmin.role == "master" && *storageBackend == "kubernetes.secrets" {
+			log.Fatalf("--sync.backend=%s is not available with kubernetes.secrets storage backend", syncBackendS3)
+		}
+		ovpnAdmin.s3, err = newS3Client()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if ovpnAdmin.role == "slave" {
+		if ovpnAdmin.s3 != nil {
+			// the bucket takes place of masters, so failover and sync status work the same way
+			ovpnAdmin.masters = []masterServer{{url: ovpnAdmin.s3.location()}}
+		} else {
+			ovpnAdmin.masters, err = parseMasterHosts(*masterHosts)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
 	ovpnAdmin.modules = append(ovpnAdmin.modules, "core")
@@ -548,42 +1576,119 @@ func main() {
 	}
 
 	if ovpnAdmin.role == "slave" {
-		ovpnAdmin.syncDataFromMaster()
-		go ovpnAdmin.syncWithMaster()
+		synced := ovpnAdmin.syncDataFromMaster(ctx)
+		go ovpnAdmin.syncWithMaster(ctx, synced)
+	} else {
+		go ovpnAdmin.refreshCrl(ctx)
+		if ovpnAdmin.s3 != nil {
+			go ovpnAdmin.uploadToS3(ctx)
+		}
 	}
 
 	ovpnAdmin.templates = packr.New("template", "./templates")
 
-	staticBox := packr.New("static", "./frontend/static")
-	static := CacheControlWrapper(http.FileServer(staticBox))
+	ovpnAdmin.clientConfigTemplate, err = ovpnAdmin.loadTemplate("client.conf.tpl", *clientConfigTemplatePath)
+	if err != nil {
+		log.Fatalf("failed to load client config template: %s", err)
+	}
+	ovpnAdmin.ccdTemplate, err = ovpnAdmin.loadTemplate("ccd.tpl", *ccdTemplatePath)
+	if err != nil {
+		log.Fatalf("failed to load ccd template: %s", err)
+	}
 
-	http.Handle(*listenBaseUrl, http.StripPrefix(strings.TrimRight(*listenBaseUrl, "/"), static))
-	http.HandleFunc(*listenBaseUrl + "api/server/settings", ovpnAdmin.serverSettingsHandler)
-	http.HandleFunc(*listenBaseUrl + "api/users/list", ovpnAdmin.userListHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/create", ovpnAdmin.userCreateHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/change-password", ovpnAdmin.userChangePasswordHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/rotate", ovpnAdmin.userRotateHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/delete", ovpnAdmin.userDeleteHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/revoke", ovpnAdmin.userRevokeHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/unrevoke", ovpnAdmin.userUnrevokeHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/config/show", ovpnAdmin.userShowConfigHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/disconnect", ovpnAdmin.userDisconnectHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/statistic", ovpnAdmin.userStatisticHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/ccd", ovpnAdmin.userShowCcdHandler)
-	http.HandleFunc(*listenBaseUrl + "api/user/ccd/apply", ovpnAdmin.userApplyCcdHandler)
-
-	http.HandleFunc(*listenBaseUrl + "api/sync/last/try", ovpnAdmin.lastSyncTimeHandler)
-	http.HandleFunc(*listenBaseUrl + "api/sync/last/successful", ovpnAdmin.lastSuccessfulSyncTimeHandler)
-	http.HandleFunc(*listenBaseUrl + downloadCertsApiUrl, ovpnAdmin.downloadCertsHandler)
-	http.HandleFunc(*listenBaseUrl + downloadCcdApiUrl, ovpnAdmin.downloadCcdHandler)
+	if *runMode == runModeFull {
+		ovpnAdmin.registerUIHandlers()
+	}
 
 	http.Handle(*metricsPath, promhttp.HandlerFor(ovpnAdmin.promRegistry, promhttp.HandlerOpts{}))
 	http.HandleFunc(*listenBaseUrl + "ping", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "pong")
 	})
+	http.HandleFunc(*listenBaseUrl + "healthz", ovpnAdmin.healthzHandler)
 
-	log.Printf("Bind: http://%s:%s%s", *listenHost, *listenPort, *listenBaseUrl)
-	log.Fatal(http.ListenAndServe(*listenHost+":"+*listenPort, nil))
+	server := &http.Server{Addr: *listenHost + ":" + *listenPort, Handler: withAccessLog(withCORS(withGzip(http.DefaultServeMux)))}
+	go func() {
+		var err error
+		if listenTLS() {
+			server.TLSConfig = &tls.Config{MinVersion: listenTLSVersionIds[*listenTLSMinVersion]}
+			log.Printf("Bind: https://%s:%s%s", *listenHost, *listenPort, *listenBaseUrl)
+			err = server.ListenAndServeTLS(*listenTLSCertFile, *listenTLSKeyFile)
+		} else {
+			log.Printf("Bind: http://%s:%s%s", *listenHost, *listenPort, *listenBaseUrl)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Errorf("failed to shut down http server gracefully: %s", err)
+	}
+
+	// LastRef updates of connected users are saved once per lastSeenPersistInterval only
+	ovpnAdmin.persistLastSeen()
+
+	if ovpnAdmin.history != nil {
+		ovpnAdmin.history.db.Close()
+	}
+}
+
+// registerUIHandlers registers static files of UI and all api/ endpoints, they are skipped in exporter mode
+func (oAdmin *OvpnAdmin) registerUIHandlers() {
+	staticBox := packr.New("static", "./frontend/static")
+	static := CacheControlWrapper(http.FileServer(staticBox))
+
+	http.Handle(*listenBaseUrl, http.StripPrefix(strings.TrimRight(*listenBaseUrl, "/"), static))
+	http.HandleFunc(*listenBaseUrl + "api/server/settings", oAdmin.withReadAuth(oAdmin.serverSettingsHandler))
+	http.HandleFunc(*listenBaseUrl + "api/server/routes", oAdmin.withReadAuth(oAdmin.serverRoutesHandler))
+	http.HandleFunc(*listenBaseUrl + "api/server/cert", oAdmin.withReadAuth(oAdmin.serverCertHandler))
+	http.HandleFunc(*listenBaseUrl + "api/users/list", oAdmin.withReadAuth(oAdmin.userListHandler))
+	http.HandleFunc(*listenBaseUrl + "api/summary", oAdmin.withReadAuth(oAdmin.summaryHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/create", oAdmin.withRateLimit(oAdmin.withAuth(oAdmin.userCreateHandler)))
+	http.HandleFunc(*listenBaseUrl + "api/users/create/bulk", oAdmin.withRateLimit(oAdmin.withAuth(oAdmin.usersBulkCreateHandler)))
+	http.HandleFunc(*listenBaseUrl + "api/user/change-password", oAdmin.withAuth(oAdmin.userChangePasswordHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/rotate", oAdmin.withAuth(oAdmin.userRotateHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/delete", oAdmin.withAuth(oAdmin.userDeleteHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/revoke", oAdmin.withRateLimit(oAdmin.withAuth(oAdmin.userRevokeHandler)))
+	http.HandleFunc(*listenBaseUrl + "api/user/unrevoke", oAdmin.withRateLimit(oAdmin.withAuth(oAdmin.userUnrevokeHandler)))
+	http.HandleFunc(*listenBaseUrl + "api/user/config/show", oAdmin.withAuth(oAdmin.userShowConfigHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/config/download", oAdmin.withAuth(oAdmin.userDownloadConfigHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/chain", oAdmin.withAdminAuth(oAdmin.userShowChainHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/disconnect", oAdmin.withAuth(oAdmin.userDisconnectHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/statistic", oAdmin.withReadAuth(oAdmin.userStatisticHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/by-serial", oAdmin.withReadAuth(oAdmin.userBySerialHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/detail", oAdmin.withReadAuth(oAdmin.userDetailHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/ccd", oAdmin.withReadAuth(oAdmin.userShowCcdHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/ccd/apply", oAdmin.withAuth(oAdmin.userApplyCcdHandler))
+	http.HandleFunc(*listenBaseUrl + "api/user/ccd/preview", oAdmin.withReadAuth(oAdmin.userPreviewCcdHandler))
+	http.HandleFunc(*listenBaseUrl + "api/ccd/import", oAdmin.withAuth(oAdmin.ccdImportHandler))
+	http.HandleFunc(*listenBaseUrl + "api/ccd/allocations", oAdmin.withReadAuth(oAdmin.ccdAllocationsHandler))
+	http.HandleFunc(*listenBaseUrl + "api/ccd/next-free", oAdmin.withReadAuth(oAdmin.ccdNextFreeHandler))
+
+	http.HandleFunc(*listenBaseUrl + "api/crl/regenerate", oAdmin.withAuth(oAdmin.crlRegenerateHandler))
+
+	http.HandleFunc(*listenBaseUrl + "api/history", oAdmin.withReadAuth(oAdmin.historyHandler))
+
+	http.HandleFunc(*listenBaseUrl + "api/sync/last/try", oAdmin.withReadAuth(oAdmin.lastSyncTimeHandler))
+	http.HandleFunc(*listenBaseUrl + "api/sync/last/successful", oAdmin.withReadAuth(oAdmin.lastSuccessfulSyncTimeHandler))
+	http.HandleFunc(*listenBaseUrl + "api/sync/status", oAdmin.withReadAuth(oAdmin.syncStatusHandler))
+	http.HandleFunc(*listenBaseUrl + "api/sync/reset", oAdmin.withAuth(oAdmin.syncResetHandler))
+	http.HandleFunc(*listenBaseUrl + downloadCertsApiUrl, oAdmin.downloadCertsHandler)
+	http.HandleFunc(*listenBaseUrl + downloadCcdApiUrl, oAdmin.downloadCcdHandler)
+	http.HandleFunc(*listenBaseUrl + indexTxtApiUrl, oAdmin.indexTxtHandler)
+	http.HandleFunc(*listenBaseUrl + indexTxtAnomaliesUrl, oAdmin.indexTxtAnomaliesHandler)
+}
+
+// listenTLS reports whether web server is served over HTTPS
+func listenTLS() bool {
+	return *listenTLSCertFile != "" && *listenTLSKeyFile != ""
 }
 
 func CacheControlWrapper(h http.Handler) http.Handler {
@@ -596,171 +1701,618 @@ func CacheControlWrapper(h http.Handler) http.Handler {
 func (oAdmin *OvpnAdmin) registerMetrics() {
 	oAdmin.promRegistry.MustRegister(ovpnServerCertExpire)
 	oAdmin.promRegistry.MustRegister(ovpnServerCaCertExpire)
+	oAdmin.promRegistry.MustRegister(ovpnCrlExpire)
 	oAdmin.promRegistry.MustRegister(ovpnClientsTotal)
 	oAdmin.promRegistry.MustRegister(ovpnClientsRevoked)
 	oAdmin.promRegistry.MustRegister(ovpnClientsConnected)
 	oAdmin.promRegistry.MustRegister(ovpnUniqClientsConnected)
 	oAdmin.promRegistry.MustRegister(ovpnClientsExpired)
+	oAdmin.promRegistry.MustRegister(ovpnClientsOther)
 	oAdmin.promRegistry.MustRegister(ovpnClientCertificateExpire)
+	oAdmin.promRegistry.MustRegister(ovpnClientConnected)
+	oAdmin.promRegistry.MustRegister(ovpnClientSessions)
 	oAdmin.promRegistry.MustRegister(ovpnClientConnectionInfo)
 	oAdmin.promRegistry.MustRegister(ovpnClientConnectionFrom)
+	oAdmin.promRegistry.MustRegister(ovpnClientConnectionDuration)
 	oAdmin.promRegistry.MustRegister(ovpnClientBytesReceived)
 	oAdmin.promRegistry.MustRegister(ovpnClientBytesSent)
+	oAdmin.promRegistry.MustRegister(ovpnServerClientsConnected)
+	oAdmin.promRegistry.MustRegister(ovpnClientConnects)
+	oAdmin.promRegistry.MustRegister(ovpnClientDisconnects)
+	oAdmin.promRegistry.MustRegister(ovpnAdminInsecureConfig)
+	oAdmin.promRegistry.MustRegister(ovpnAdminInfo)
+	ovpnAdminInfo.WithLabelValues(oAdmin.role, version).Set(1)
+	if oAdmin.role == "slave" {
+		oAdmin.promRegistry.MustRegister(ovpnSyncLastAttempt)
+		oAdmin.promRegistry.MustRegister(ovpnSyncLastSuccess)
+		oAdmin.promRegistry.MustRegister(ovpnSyncMaster)
+		oAdmin.promRegistry.MustRegister(ovpnSyncFailures)
+	}
+}
+
+// checkInsecureConfig sets ovpn_admin_insecure_config gauge for every known-insecure default and logs the active ones
+func (oAdmin *OvpnAdmin) checkInsecureConfig() {
+	checks := map[string]bool{
+		// master refuses the default token, slave sending it and master on kubernetes.secrets are still reported
+		"default_sync_token":        oAdmin.masterSyncToken == defaultMasterSyncToken,
+		"no_admin_auth":             *apiAuthToken == "",
+		"plain_http_all_interfaces": !listenTLS() && (*listenHost == "" || *listenHost == "0.0.0.0"),
+	}
+
+	for check, insecure := range checks {
+		if insecure {
+			log.Warnf("insecure configuration: %s", check)
+			ovpnAdminInsecureConfig.WithLabelValues(check).Set(1)
+		} else {
+			ovpnAdminInsecureConfig.WithLabelValues(check).Set(0)
+		}
+	}
 }
 
 func (oAdmin *OvpnAdmin) setState() {
-	oAdmin.activeClients = oAdmin.mgmtGetActiveClients()
-	oAdmin.clients = oAdmin.usersList()
+	polledClients := oAdmin.mgmtGetActiveClients()
+	oAdmin.stateMutex.Lock()
+	oAdmin.activeClients = oAdmin.debounceActiveClients(polledClients)
+	now := time.Now()
+	lastSeenChanged := oAdmin.updateLastSeen(oAdmin.activeClients, now)
+	lastSeenPersistDue := oAdmin.lastSeenPersistDue(oAdmin.activeClients, lastSeenChanged, now)
+	oAdmin.stateMutex.Unlock()
+	if lastSeenPersistDue {
+		oAdmin.persistLastSeen()
+	}
+	oAdmin.refreshClients()
+	oAdmin.setServerClientsMetrics()
+	oAdmin.enforceMaxConnections(polledClients)
+
+	if oAdmin.history != nil {
+		err := oAdmin.history.record(oAdmin.getActiveClients(), oAdmin.mgmtStatusTimeFormat, time.Now())
+		if err != nil {
+			log.Errorf("setState: failed to record connection history: %s", err)
+		}
+	}
+
+	ovpnServerCaCertExpire.Set(expireDays(getOvpnCaCertExpireDate().Unix(), time.Now().Unix()))
+
+	_, crlNextUpdate, err := getCrlUpdateDates()
+	if err != nil {
+		log.Debugf("setState: %s", err)
+	} else {
+		ovpnCrlExpire.Set(expireDays(crlNextUpdate.Unix(), time.Now().Unix()))
+	}
+
+	serverCertExpire, err := oAdmin.pki.ServerCertExpiry()
+	if err != nil {
+		log.Debugf("setState: %s", err)
+	} else {
+		ovpnServerCertExpire.Set(expireDays(serverCertExpire.Unix(), time.Now().Unix()))
+	}
+}
+
+// debounceActiveClients keeps clients missing from the status output for up to *mgmtDisconnectGrace
+// consecutive polls, so a client in the middle of reconnect isn't counted as disconnected.
+// Must be called with stateMutex locked.
+func (oAdmin *OvpnAdmin) debounceActiveClients(polled []clientStatus) []clientStatus {
+	present := make(map[string][]clientStatus)
+	for _, c := range polled {
+		present[c.CommonName] = append(present[c.CommonName], c)
+	}
+
+	for cn, sessions := range present {
+		if _, ok := oAdmin.trackedClients[cn]; !ok {
+			ovpnClientConnects.Inc()
+		}
+		oAdmin.trackedClients[cn] = sessions
+		oAdmin.missedPolls[cn] = 0
+	}
+
+	var activeClients []clientStatus
+	for cn, sessions := range oAdmin.trackedClients {
+		if _, ok := present[cn]; !ok {
+			oAdmin.missedPolls[cn] += 1
+			if oAdmin.missedPolls[cn] > *mgmtDisconnectGrace {
+				oAdmin.forgetClient(cn)
+				continue
+			}
+			log.Debugf("client %s missing in %d status polls", cn, oAdmin.missedPolls[cn])
+		}
+		activeClients = append(activeClients, sessions...)
+	}
 
-	ovpnServerCaCertExpire.Set(float64((getOvpnCaCertExpireDate().Unix() - time.Now().Unix()) / 3600 / 24))
+	return activeClients
 }
 
-func (oAdmin *OvpnAdmin) updateState() {
+// forgetClient must be called with stateMutex locked
+func (oAdmin *OvpnAdmin) forgetClient(commonName string) {
+	if _, ok := oAdmin.trackedClients[commonName]; ok {
+		ovpnClientDisconnects.Inc()
+	}
+	delete(oAdmin.trackedClients, commonName)
+	delete(oAdmin.missedPolls, commonName)
+}
+
+// enforceMaxConnections sets ovpn_client_sessions and finds users with more than --max-connections-per-user
+// sessions in polled. With --max-connections-per-user.kill their oldest sessions are killed by client ID,
+// so the user keeps the most recent ones
+func (oAdmin *OvpnAdmin) enforceMaxConnections(polled []clientStatus) {
+	sessions := make(map[string][]clientStatus)
+	for _, c := range polled {
+		sessions[c.CommonName] = append(sessions[c.CommonName], c)
+	}
+
+	ovpnClientSessions.Reset()
+	for cn, s := range sessions {
+		ovpnClientSessions.WithLabelValues(cn).Set(float64(len(s)))
+	}
+
+	if *maxConnectionsPerUser <= 0 {
+		return
+	}
+	for cn, s := range sessions {
+		if len(s) <= *maxConnectionsPerUser {
+			continue
+		}
+		if !*maxConnectionsKill {
+			log.WithField("username", cn).Warnf("%d sessions, limit is %d", len(s), *maxConnectionsPerUser)
+			continue
+		}
+
+		sort.SliceStable(s, func(i, j int) bool {
+			return parseDateToUnix(oAdmin.mgmtStatusTimeFormat, s[i].ConnectedSince) < parseDateToUnix(oAdmin.mgmtStatusTimeFormat, s[j].ConnectedSince)
+		})
+		for _, session := range s[:len(s)-*maxConnectionsPerUser] {
+			if session.ClientId == "" {
+				log.WithFields(log.Fields{"username": cn, "server": session.ConnectedTo}).Warn("Can't kill excess session: client ID is reported by status versions 2 and 3 only")
+				continue
+			}
+			if ok, reply := oAdmin.mgmtKillByCID(session.ClientId, session.ConnectedTo); ok {
+				log.WithFields(log.Fields{"username": cn, "server": session.ConnectedTo, "cid": session.ClientId}).Info("Excess session killed")
+			} else {
+				log.WithFields(log.Fields{"username": cn, "server": session.ConnectedTo, "cid": session.ClientId}).Warnf("Failed to kill excess session: %s", reply)
+			}
+		}
+	}
+}
+
+func (oAdmin *OvpnAdmin) setServerClientsMetrics() {
+	ovpnServerClientsConnected.Reset()
+	for srv := range oAdmin.mgmtInterfaces {
+		listener := oAdmin.mgmtListeners[srv]
+		ovpnServerClientsConnected.WithLabelValues(srv, listener.Protocol, listener.Port).Set(0)
+	}
+	for _, c := range oAdmin.getActiveClients() {
+		ovpnServerClientsConnected.WithLabelValues(c.ConnectedTo, c.Protocol, c.Port).Inc()
+	}
+}
+
+// newTimeTicker returns ticks of time.NewTicker and the function stopping it
+func newTimeTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// updateState refreshes the state every --state.refresh-interval till ctx is done
+func (oAdmin *OvpnAdmin) updateState(ctx context.Context) {
+	ticks, stop := oAdmin.newTicker(*stateRefreshInterval)
+	defer stop()
 	for {
-		time.Sleep(time.Duration(28) * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+		}
 		ovpnClientBytesSent.Reset()
 		ovpnClientBytesReceived.Reset()
 		ovpnClientConnectionFrom.Reset()
+		ovpnClientConnectionDuration.Reset()
 		ovpnClientConnectionInfo.Reset()
 		ovpnClientCertificateExpire.Reset()
+		ovpnClientConnected.Reset()
 		go oAdmin.setState()
 	}
 }
 
+var indexTxtCommonNameRegexp = regexp.MustCompile(`(?:^|/)CN=([^/]*)`)
+var indexTxtEmailRegexp = regexp.MustCompile(`(?:^|/)emailAddress=([^/]*)`)
+
 func indexTxtParser(txt string) []indexTxtLine {
 	var indexTxt []indexTxtLine
 
 	txtLinesArray := strings.Split(txt, "\n")
 
 	for _, v := range txtLinesArray {
-		str := strings.Fields(v)
-		if len(str) > 0 {
-			switch {
-			// case strings.HasPrefix(str[0], "E"):
-			case strings.HasPrefix(str[0], "V"):
-				indexTxt = append(indexTxt, indexTxtLine{Flag: str[0], ExpirationDate: str[1], SerialNumber: str[2], Filename: str[3], DistinguishedName: str[4], Identity: str[4][strings.Index(str[4], "=")+1:]})
-			case strings.HasPrefix(str[0], "R"):
-				indexTxt = append(indexTxt, indexTxtLine{Flag: str[0], ExpirationDate: str[1], RevocationDate: str[2], SerialNumber: str[3], Filename: str[4], DistinguishedName: str[5], Identity: str[5][strings.Index(str[5], "=")+1:]})
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		// flag, expiration date, revocation date (empty unless revoked), serial, filename and DN are tab separated,
+		// DN may have spaces in it
+		fields := strings.SplitN(strings.TrimRight(v, "\r"), "\t", 6)
+		if len(fields) < 6 {
+			log.Warnf("indexTxtParser: skipping malformed line %q", v)
+			continue
+		}
+		line := indexTxtLine{Flag: fields[0], ExpirationDate: fields[1], SerialNumber: fields[3], Filename: fields[4], DistinguishedName: fields[5]}
+		line.Identity = indexTxtCommonName(line.DistinguishedName)
+		line.Email = indexTxtEmail(line.DistinguishedName)
+		switch {
+		// expired certs keep the layout of valid ones
+		case strings.HasPrefix(line.Flag, "V"), strings.HasPrefix(line.Flag, "E"):
+			indexTxt = append(indexTxt, line)
+		case strings.HasPrefix(line.Flag, "R"):
+			// revocation date is followed by reason if it was set, e.g. 210101000000Z,keyCompromise
+			revocation := strings.SplitN(fields[2], ",", 2)
+			line.RevocationDate = revocation[0]
+			if len(revocation) == 2 {
+				line.RevocationReason = revocation[1]
 			}
+			indexTxt = append(indexTxt, line)
 		}
 	}
 
 	return indexTxt
 }
 
+// indexTxtAnomaly is a line of index.txt skipped by indexTxtParser or having flag usersList doesn't know
+type indexTxtAnomaly struct {
+	LineNumber int    `json:"LineNumber"`
+	Line       string `json:"Line"`
+	Reason     string `json:"Reason"`
+}
+
+// findIndexTxtAnomalies returns lines of index.txt which aren't shown as users as they are
+func findIndexTxtAnomalies(txt string) []indexTxtAnomaly {
+	var anomalies []indexTxtAnomaly
+	for i, v := range strings.Split(txt, "\n") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		anomaly := indexTxtAnomaly{LineNumber: i + 1, Line: v}
+		fields := strings.SplitN(strings.TrimRight(v, "\r"), "\t", 6)
+		if len(fields) < 6 {
+			anomaly.Reason = "malformed line, expected 6 tab separated fields"
+		} else if fields[0] != "V" && fields[0] != "R" && fields[0] != "E" {
+			anomaly.Reason = fmt.Sprintf("unknown flag \"%s\"", fields[0])
+		} else if _, err := time.Parse(indexTxtDateLayout, fields[1]); err != nil {
+			anomaly.Reason = fmt.Sprintf("malformed expiration date \"%s\"", fields[1])
+		} else {
+			continue
+		}
+		anomalies = append(anomalies, anomaly)
+	}
+	return anomalies
+}
+
+// indexTxtCommonName returns the last CN of DN, e.g. "user name" of /C=US/O=Acme/CN=user name
+func indexTxtCommonName(dn string) string {
+	matches := indexTxtCommonNameRegexp.FindAllStringSubmatch(dn, -1)
+	if len(matches) == 0 {
+		return dn[strings.Index(dn, "=")+1:]
+	}
+	return matches[len(matches)-1][1]
+}
+
+// indexTxtEmail returns emailAddress of DN, easyrsa adds it with EASYRSA_DN=org only
+func indexTxtEmail(dn string) string {
+	if matches := indexTxtEmailRegexp.FindStringSubmatch(dn); matches != nil {
+		return matches[1]
+	}
+	return ""
+}
+
+// indexTxtReplaceCommonName replaces the last CN of DN keeping the rest of it
+func indexTxtReplaceCommonName(dn, commonName string) string {
+	loc := indexTxtCommonNameRegexp.FindAllStringSubmatchIndex(dn, -1)
+	if len(loc) == 0 {
+		return "/CN=" + commonName
+	}
+	last := loc[len(loc)-1]
+	return dn[:last[2]] + commonName + dn[last[3]:]
+}
+
 func renderIndexTxt(data []indexTxtLine) string {
 	indexTxt := ""
 	for _, line := range data {
 		switch {
-		case line.Flag == "V":
+		case line.Flag == "V", line.Flag == "E":
 			indexTxt += fmt.Sprintf("%s\t%s\t\t%s\t%s\t%s\n", line.Flag, line.ExpirationDate, line.SerialNumber, line.Filename, line.DistinguishedName)
 		case line.Flag == "R":
-			indexTxt += fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", line.Flag, line.ExpirationDate, line.RevocationDate, line.SerialNumber, line.Filename, line.DistinguishedName)
-			// case line.flag == "E":
+			revocation := line.RevocationDate
+			if line.RevocationReason != "" {
+				revocation += "," + line.RevocationReason
+			}
+			indexTxt += fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", line.Flag, line.ExpirationDate, revocation, line.SerialNumber, line.Filename, line.DistinguishedName)
 		}
 	}
 	return indexTxt
 }
 
-func (oAdmin *OvpnAdmin) getClientConfigTemplate() *template.Template {
-	if *clientConfigTemplatePath != "" {
-		return template.Must(template.ParseFiles(*clientConfigTemplatePath))
-	} else {
-		clientConfigTpl, clientConfigTplErr := oAdmin.templates.FindString("client.conf.tpl")
-		if clientConfigTplErr != nil {
-			log.Error("clientConfigTpl not found in templates box")
+// loadTemplate parses template from path if it's set, from --templates.path dir if that one is set
+// and from the built-in templates box otherwise
+func (oAdmin *OvpnAdmin) loadTemplate(name, path string) (*template.Template, error) {
+	if path == "" && *templatesPath != "" {
+		path = filepath.Join(*templatesPath, name)
+	}
+	if path != "" {
+		return template.New(filepath.Base(path)).Funcs(templateFuncs).ParseFiles(path)
+	}
+
+	tpl, err := oAdmin.templates.FindString(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found in templates box", name)
+	}
+	return template.New(name).Funcs(templateFuncs).Parse(tpl)
+}
+
+var templateFuncs = template.FuncMap{
+	"isIPv6": func(address string) bool {
+		ip := net.ParseIP(address)
+		return ip != nil && ip.To4() == nil
+	},
+	// ipv4Netmask returns dotted mask of openvpn server network of address
+	"ipv4Netmask": func(address string) string {
+		return ipv4Netmask(openvpnNetworks(), address)
+	},
+	// ipv6PrefixLen returns prefix length of IPv6 openvpn server network
+	"ipv6PrefixLen": func() int {
+		for _, ovpnNet := range openvpnNetworks() {
+			if ovpnNet.IP.To4() == nil {
+				ones, _ := ovpnNet.Mask.Size()
+				return ones
+			}
 		}
-		return template.Must(template.New("client-config").Parse(clientConfigTpl))
+		return 64
+	},
+}
+
+// errUserNotFound is returned for usernames missing in index.txt, handlers answer 404 to it
+var errUserNotFound = errors.New("user not found")
+
+func (oAdmin *OvpnAdmin) renderClientConfig(username string) (string, error) {
+	if oAdmin.users.Exists(username) {
+		return oAdmin.executeClientConfig(username, newClientConfig(username))
 	}
+	log.WithField("username", username).Warn("user not found")
+	return "", errUserNotFound
 }
 
-func (oAdmin *OvpnAdmin) renderClientConfig(username string) string {
-	if checkUserExist(username) {
-		var hosts []OpenvpnServer
+// newClientConfig collects hosts, certs and keys of existing user for client config template
+func newClientConfig(username string) openvpnClientConfig {
+	var hosts []OpenvpnServer
 
-		for _, server := range *openvpnServer {
-			parts := strings.SplitN(server, ":", 3)
-			hosts = append(hosts, OpenvpnServer{Host: parts[0], Port: parts[1], Protocol: parts[2]})
+	for _, value := range *openvpnServer {
+		// values are checked on start
+		if server, err := parseOpenvpnServer(value); err == nil {
+			hosts = append(hosts, server)
 		}
+	}
 
-		if *openvpnServerBehindLB {
-			var err error
-			hosts, err = getOvpnServerHostsFromKubeApi()
-			if err != nil {
-				log.Error(err)
-			}
+	if *openvpnServerBehindLB {
+		var err error
+		hosts, err = getOvpnServerHostsFromKubeApi()
+		if err != nil {
+			log.Error(err)
 		}
+	}
 
-		log.Tracef("hosts for %s\n %v", username, hosts)
+	log.Tracef("hosts for %s\n %v", username, hosts)
 
-		conf := openvpnClientConfig{}
-		conf.Hosts = hosts
-		conf.CA = fRead(*easyrsaDirPath + "/pki/ca.crt")
+	conf := openvpnClientConfig{}
+	conf.Hosts = hosts
+	conf.CA = fRead(*easyrsaDirPath + "/pki/ca.crt")
+	conf.TLSMode = *tlsMode
+	conf.TLSFile = "ta.key"
+	if conf.TLSMode == tlsModeCryptV2 {
+		// tls-crypt-v2 client keys are per user and are kept on filesystem with any storage backend
+		conf.TLS = fRead(*easyrsaDirPath + "/pki/private/" + username + ".pem")
+		conf.TLSFile = username + "-tls-crypt-v2.key"
+	} else {
 		conf.TLS = fRead(*easyrsaDirPath + "/pki/ta.key")
+	}
 
-		if *storageBackend == "kubernetes.secrets" {
-			conf.Cert, conf.Key = app.easyrsaGetClientCert(username)
-		} else {
-			conf.Cert = fRead(*easyrsaDirPath + "/pki/issued/" + username + ".crt")
-			conf.Key = fRead(*easyrsaDirPath + "/pki/private/" + username + ".key")
+	if *storageBackend == "kubernetes.secrets" {
+		conf.Cert, conf.Key = app.easyrsaGetClientCert(username)
+	} else {
+		conf.Cert = fRead(*easyrsaDirPath + "/pki/issued/" + username + ".crt")
+		conf.Key = fRead(*easyrsaDirPath + "/pki/private/" + username + ".key")
+	}
+
+	conf.PasswdAuth = *authByPassword
+
+	conf.Inline = *clientConfigMode == clientConfigModeInline
+	conf.CAFile = "ca.crt"
+	conf.CertFile = username + ".crt"
+	conf.KeyFile = username + ".key"
+
+	conf.DNS = *clientPushDNS
+	conf.RedirectGateway = *clientRedirectGateway
+	conf.ExtraOptions = *clientExtraOptions
+
+	return conf
+}
+
+// parseOpenvpnServer parses HOST[:PORT][:PROTOCOL] of --ovpn.server, IPv6 HOST must be in brackets
+// like [2001:db8::1]:1194:udp, brackets are dropped as remote directive takes bare address
+func parseOpenvpnServer(value string) (OpenvpnServer, error) {
+	server := OpenvpnServer{Port: openvpnServerDefaultPort, Protocol: openvpnServerDefaultProtocol}
+
+	hostPort := value
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		for _, protocol := range openvpnServerProtocols {
+			if strings.ToLower(value[i+1:]) == protocol {
+				server.Protocol = protocol
+				hostPort = value[:i]
+				break
+			}
 		}
+	}
+
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		// net.SplitHostPort has no other way to tell a missing port
+		if addrErr, ok := err.(*net.AddrError); !ok || addrErr.Err != "missing port in address" {
+			return server, fmt.Errorf("expected HOST[:PORT][:PROTOCOL] with IPv6 HOST in brackets and PROTOCOL one of %s: %s", strings.Join(openvpnServerProtocols, ", "), err)
+		}
+		host = hostPort
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	} else {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return server, fmt.Errorf("invalid port %q", port)
+		}
+		server.Port = port
+	}
+
+	if host == "" {
+		return server, errors.New("HOST is empty")
+	}
+	if (strings.HasPrefix(hostPort, "[") || strings.Contains(host, ":")) && (net.ParseIP(host) == nil || strings.Contains(host, "[")) {
+		return server, fmt.Errorf("%q is not an IPv6 address", host)
+	}
+	server.Host = host
+	return server, nil
+}
+
+// validateClientOptions checks directives added to client config by flags, every value must fit a single line
+func validateClientOptions() error {
+	for _, dns := range *clientPushDNS {
+		if net.ParseIP(dns) == nil {
+			return fmt.Errorf("--client.push-dns: %q is not an IP address", dns)
+		}
+	}
+	if strings.ContainsAny(*clientRedirectGateway, "\r\n") {
+		return fmt.Errorf("--client.redirect-gateway must be a single line")
+	}
+	for _, option := range *clientExtraOptions {
+		if strings.TrimSpace(option) == "" || strings.ContainsAny(option, "\r\n") {
+			return fmt.Errorf("--client.extra-option: %q must be a single non-empty line", option)
+		}
+	}
+	return nil
+}
+
+func (oAdmin *OvpnAdmin) executeClientConfig(username string, conf openvpnClientConfig) (string, error) {
+	var tmp bytes.Buffer
+	err := oAdmin.clientConfigTemplate.Execute(&tmp, conf)
+	if err != nil {
+		log.Errorf("something goes wrong during rendering config for %s", username)
+		log.Debugf("rendering config for %s failed with error %v", username, err)
+		return "", fmt.Errorf("failed to render config for user \"%s\"", username)
+	}
 
-		conf.PasswdAuth = *authByPassword
+	// rendered config holds private key of the user, so it's never logged
+	log.WithField("username", username).Trace("rendered client config")
 
-		t := oAdmin.getClientConfigTemplate()
+	return tmp.String(), nil
+}
 
-		var tmp bytes.Buffer
-		err := t.Execute(&tmp, conf)
+// writeClientConfigZip writes zip with client config and all files it references in files mode
+func writeClientConfigZip(w io.Writer, username, config string, conf openvpnClientConfig) error {
+	zw := zip.NewWriter(w)
+	files := []struct{ name, content string }{
+		{username + ".ovpn", config},
+		{conf.CAFile, conf.CA},
+		{conf.CertFile, conf.Cert},
+		{conf.KeyFile, conf.Key},
+		{conf.TLSFile, conf.TLS},
+	}
+	for _, file := range files {
+		f, err := zw.Create(file.name)
 		if err != nil {
-			log.Errorf("something goes wrong during rendering config for %s", username)
-			log.Debugf("rendering config for %s failed with error %v", username, err)
+			return err
 		}
+		if _, err = io.WriteString(f, file.content); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// getUserCertChain returns PEM encoded client certificate followed by intermediate CAs and root CA.
+// Private key is never part of the chain.
+func (oAdmin *OvpnAdmin) getUserCertChain(username string) ([]byte, error) {
+	if !oAdmin.users.Exists(username) {
+		return nil, fmt.Errorf("user \"%s\" not found", username)
+	}
 
-		hosts = nil
+	var cert string
+	if *storageBackend == "kubernetes.secrets" {
+		cert, _ = app.easyrsaGetClientCert(username)
+	} else {
+		cert = fRead(*easyrsaDirPath + "/pki/issued/" + username + ".crt")
+	}
 
-		log.Tracef("Rendered config for user %s: %+v", username, tmp.String())
+	clientCert := pemCertificates([]byte(cert))
+	if len(clientCert) == 0 {
+		return nil, fmt.Errorf("certificate for user \"%s\" not found", username)
+	}
 
-		return fmt.Sprintf("%+v", tmp.String())
+	var chain bytes.Buffer
+	chain.Write(clientCert)
+	if *caChainPath != "" {
+		chain.Write(pemCertificates([]byte(fRead(*caChainPath))))
 	}
-	log.Warnf("user \"%s\" not found", username)
-	return fmt.Sprintf("user \"%s\" not found", username)
+	chain.Write(pemCertificates([]byte(fRead(*easyrsaDirPath + "/pki/ca.crt"))))
+
+	return chain.Bytes(), nil
 }
 
-func (oAdmin *OvpnAdmin) getCcdTemplate() *template.Template {
-	if *ccdTemplatePath != "" {
-		return template.Must(template.ParseFiles(*ccdTemplatePath))
-	} else {
-		ccdTpl, ccdTplErr := oAdmin.templates.FindString("ccd.tpl")
-		if ccdTplErr != nil {
-			log.Errorf("ccdTpl not found in templates box")
+func (oAdmin *OvpnAdmin) parseCcd(username string) Ccd {
+	return parseCcdText(username, readCcdText(username))
+}
+
+func readCcdText(username string) string {
+	if *storageBackend == "kubernetes.secrets" {
+		return app.secretGetCcd(username)
+	}
+	return readCcdFile(pkiFS, *ccdDir, username)
+}
+
+// readCcdFile returns ccd of username from ccdDir of fsys, it's empty if the user has no ccd file
+func readCcdFile(fsys fileSystem, ccdDir, username string) string {
+	content, err := fsys.ReadFile(ccdDir + "/" + username)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warning(err)
 		}
-		return template.Must(template.New("ccd").Parse(ccdTpl))
+		return ""
 	}
+	return string(content)
 }
 
-func (oAdmin *OvpnAdmin) parseCcd(username string) Ccd {
+func writeCcdText(username, txt string) error {
+	if *storageBackend == "kubernetes.secrets" {
+		app.secretUpdateCcd(username, []byte(txt))
+		return nil
+	}
+	return fWrite(*ccdDir+"/"+username, txt)
+}
+
+func parseCcdText(username, txt string) Ccd {
 	ccd := Ccd{}
 	ccd.User = username
 	ccd.ClientAddress = "dynamic"
 	ccd.CustomRoutes = []ccdRoute{}
 
-	var txtLinesArray []string
-	if *storageBackend == "kubernetes.secrets" {
-		txtLinesArray = strings.Split(app.secretGetCcd(ccd.User), "\n")
-	} else {
-		if fExist(*ccdDir + "/" + username) {
-			txtLinesArray = strings.Split(fRead(*ccdDir+"/"+username), "\n")
-		}
-	}
-
-	for _, v := range txtLinesArray {
+	for _, v := range strings.Split(txt, "\n") {
 		str := strings.Fields(v)
 		if len(str) > 0 {
 			switch {
-			case strings.HasPrefix(str[0], "ifconfig-push"):
+			case strings.HasPrefix(str[0], "ifconfig-push") && len(str) > 1:
 				ccd.ClientAddress = str[1]
-			case strings.HasPrefix(str[0], "push"):
-				ccd.CustomRoutes = append(ccd.CustomRoutes, ccdRoute{Address: strings.Trim(str[2], "\""), Mask: strings.Trim(str[3], "\""), Description: strings.Trim(strings.Join(str[4:], ""), "#")})
+			case str[0] == "ifconfig-ipv6-push" && len(str) > 1:
+				ccd.ClientAddress = strings.SplitN(str[1], "/", 2)[0]
+			case strings.HasPrefix(str[0], "push") && len(str) > 3:
+				ccd.CustomRoutes = append(ccd.CustomRoutes, ccdRoute{Address: strings.Trim(str[2], "\""), Mask: strings.Trim(str[3], "\""), Description: strings.Trim(strings.Join(str[4:], ""), "#"), Type: ccdRouteTypePush})
+			case str[0] == "iroute" && len(str) > 2:
+				ccd.CustomRoutes = append(ccd.CustomRoutes, ccdRoute{Address: str[1], Mask: str[2], Description: strings.Trim(strings.Join(str[3:], ""), "#"), Type: ccdRouteTypeIroute})
+			case str[0] == "#" && len(str) > 2 && str[1] == "meta":
+				parts := strings.SplitN(str[2], "=", 2)
+				if len(parts) == 2 {
+					if ccd.Metadata == nil {
+						ccd.Metadata = map[string]string{}
+					}
+					ccd.Metadata[parts[0]] = parts[1]
+				}
 			}
 		}
 	}
@@ -768,26 +2320,41 @@ func (oAdmin *OvpnAdmin) parseCcd(username string) Ccd {
 	return ccd
 }
 
-func (oAdmin *OvpnAdmin) modifyCcd(ccd Ccd) (bool, string) {
+func (oAdmin *OvpnAdmin) renderCcd(ccd Ccd) string {
+	var tmp bytes.Buffer
+	err := oAdmin.ccdTemplate.Execute(&tmp, ccd)
+	if err != nil {
+		log.Error(err)
+	}
+	return tmp.String()
+}
+
+// modifyCcd validates and writes ccd of the user. With dryRun nothing is written,
+// rendered ccd is returned in place of the status
+func (oAdmin *OvpnAdmin) modifyCcd(ccd Ccd, dryRun bool) (bool, string) {
+	// ccd is rendered from scratch, so routes missing in the request are removed from the file
+	if ccd.CustomRoutes == nil {
+		ccd.CustomRoutes = []ccdRoute{}
+	}
+	ccd = oAdmin.applyCcdRules(ccd)
+
+	// ccd.User is the name of the written file
+	if err := validateUsername(ccd.User); err != nil {
+		return false, err.Error()
+	}
+
 	ccdValid, err := validateCcd(ccd)
 	if err != "" {
 		return false, err
 	}
 
 	if ccdValid {
-		t := oAdmin.getCcdTemplate()
-		var tmp bytes.Buffer
-		err := t.Execute(&tmp, ccd)
-		if err != nil {
-			log.Error(err)
+		if dryRun {
+			return true, oAdmin.renderCcd(ccd)
 		}
-		if *storageBackend == "kubernetes.secrets" {
-			app.secretUpdateCcd(ccd.User, tmp.Bytes())
-		} else {
-			err = fWrite(*ccdDir+"/"+ccd.User, tmp.String())
-			if err != nil {
-				log.Errorf("modifyCcd: fWrite(): %v", err)
-			}
+		err := writeCcdText(ccd.User, oAdmin.renderCcd(ccd))
+		if err != nil {
+			log.Errorf("modifyCcd: fWrite(): %v", err)
 		}
 
 		return true, "ccd updated successfully"
@@ -797,35 +2364,47 @@ func (oAdmin *OvpnAdmin) modifyCcd(ccd Ccd) (bool, string) {
 }
 
 func validateCcd(ccd Ccd) (bool, string) {
+	var ccdFiles map[string]string
+	// ccd dir is read only when there is a static address to look for
+	if ccd.ClientAddress != "dynamic" {
+		ccdFiles = readCcdDir()
+	}
+	return validateCcdWith(ccd, openvpnNetworks(), *ccdAllowedRoutes, ccdFiles)
+}
+
+// validateCcdWith checks ccd against openvpn server networks, allowed routes CIDRs
+// and static addresses of ccdFiles keyed by user name
+func validateCcdWith(ccd Ccd, networks []*net.IPNet, allowedRoutes []string, ccdFiles map[string]string) (bool, string) {
 
 	ccdErr := ""
 
 	if ccd.ClientAddress != "dynamic" {
-		_, ovpnNet, err := net.ParseCIDR(*openvpnNetwork)
-		if err != nil {
-			log.Error(err)
-		}
-
-		if !checkStaticAddressIsFree(ccd.ClientAddress, ccd.User) {
-			ccdErr = fmt.Sprintf("ClientAddress \"%s\" already assigned to another user", ccd.ClientAddress)
+		if net.ParseIP(ccd.ClientAddress) == nil {
+			ccdErr = fmt.Sprintf("ClientAddress \"%s\" not a valid IP address", ccd.ClientAddress)
 			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
 			return false, ccdErr
 		}
 
-		if net.ParseIP(ccd.ClientAddress) == nil {
-			ccdErr = fmt.Sprintf("ClientAddress \"%s\" not a valid IP address", ccd.ClientAddress)
+		if networkFor(networks, net.ParseIP(ccd.ClientAddress)) == nil {
+			ccdErr = fmt.Sprintf("ClientAddress \"%s\" not belongs to openvpn server network", ccd.ClientAddress)
 			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
 			return false, ccdErr
 		}
 
-		if !ovpnNet.Contains(net.ParseIP(ccd.ClientAddress)) {
-			ccdErr = fmt.Sprintf("ClientAddress \"%s\" not belongs to openvpn server network", ccd.ClientAddress)
+		if !staticAddressIsFree(ccdFiles, ccd.ClientAddress, ccd.User) {
+			ccdErr = fmt.Sprintf("ClientAddress \"%s\" already assigned to another user", ccd.ClientAddress)
 			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
 			return false, ccdErr
 		}
 	}
 
 	for _, route := range ccd.CustomRoutes {
+		if route.routeType() != ccdRouteTypePush && route.routeType() != ccdRouteTypeIroute {
+			ccdErr = fmt.Sprintf("CustomRoute.Type \"%s\" must be either %s or %s", route.Type, ccdRouteTypePush, ccdRouteTypeIroute)
+			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
+			return false, ccdErr
+		}
+
 		if net.ParseIP(route.Address) == nil {
 			ccdErr = fmt.Sprintf("CustomRoute.Address \"%s\" must be a valid IP address", route.Address)
 			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
@@ -837,6 +2416,18 @@ func validateCcd(ccd Ccd) (bool, string) {
 			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
 			return false, ccdErr
 		}
+
+		if !isNetmask(route.Mask) {
+			ccdErr = fmt.Sprintf("CustomRoute.Mask \"%s\" is not a valid contiguous netmask", route.Mask)
+			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
+			return false, ccdErr
+		}
+
+		if !routeAllowed(route, allowedRoutes) {
+			ccdErr = fmt.Sprintf("CustomRoute \"%s %s\" is not within allowed networks %s", route.Address, route.Mask, strings.Join(allowedRoutes, ", "))
+			log.Debugf("modify ccd for user %s: %s", ccd.User, ccdErr)
+			return false, ccdErr
+		}
 	}
 
 	return true, ccdErr
@@ -853,21 +2444,152 @@ func (oAdmin *OvpnAdmin) getCcd(username string) Ccd {
 	return ccd
 }
 
-func checkStaticAddressIsFree(staticAddress string, username string) bool {
-	o := runBash(fmt.Sprintf("grep -rl ' %[1]s ' %[2]s | grep -vx %[2]s/%[3]s | wc -l", staticAddress, *ccdDir, username))
+// isNetmask returns true if mask is an IPv4 netmask with contiguous leading ones
+func isNetmask(mask string) bool {
+	ip := net.ParseIP(mask).To4()
+	if ip == nil {
+		return false
+	}
+	_, bits := net.IPMask(ip).Size()
+	return bits != 0
+}
 
-	if strings.TrimSpace(o) == "0" {
+// routeAllowed returns true if route network is inside one of allowedRoutes CIDRs or there are none
+func routeAllowed(route ccdRoute, allowedRoutes []string) bool {
+	if len(allowedRoutes) == 0 {
 		return true
 	}
+
+	routeMask := net.IPMask(net.ParseIP(route.Mask).To4())
+	routeOnes, _ := routeMask.Size()
+	routeIP := net.ParseIP(route.Address)
+
+	for _, allowed := range allowedRoutes {
+		_, allowedNet, err := net.ParseCIDR(allowed)
+		if err != nil {
+			log.Errorf("wrong ccd.allowed-routes value %s: %s", allowed, err)
+			continue
+		}
+		allowedOnes, _ := allowedNet.Mask.Size()
+		if allowedNet.Contains(routeIP) && routeOnes >= allowedOnes {
+			return true
+		}
+	}
 	return false
 }
 
+// openvpnNetworks returns all networks from *openvpnNetwork
+func openvpnNetworks() []*net.IPNet {
+	return parseOpenvpnNetworks(*openvpnNetwork)
+}
+
+// parseOpenvpnNetworks parses comma separated CIDRs, malformed ones are logged and skipped
+func parseOpenvpnNetworks(value string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, network := range strings.Split(value, ",") {
+		_, ovpnNet, err := net.ParseCIDR(strings.TrimSpace(network))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		networks = append(networks, ovpnNet)
+	}
+	return networks
+}
+
+// networkFor returns the first of networks containing ip or nil if there is no such network
+func networkFor(networks []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, ovpnNet := range networks {
+		if ovpnNet.Contains(ip) {
+			return ovpnNet
+		}
+	}
+	return nil
+}
+
+// ipv4Netmask returns dotted mask of the network of networks containing address,
+// 255.255.255.0 of the default --ovpn.network if there is no such network
+func ipv4Netmask(networks []*net.IPNet, address string) string {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return "255.255.255.0"
+	}
+	for _, ovpnNet := range networks {
+		if ovpnNet.IP.To4() != nil && ovpnNet.Contains(ip) {
+			return net.IP(ovpnNet.Mask).To4().String()
+		}
+	}
+	return "255.255.255.0"
+}
+
+// staticAddressIsFree returns false if any other user's ccd of ccdFiles has the same static address.
+// Addresses are compared as parsed IPs, so different notations of IPv6 address are the same address.
+func staticAddressIsFree(ccdFiles map[string]string, staticAddress string, username string) bool {
+	ip := net.ParseIP(staticAddress)
+
+	for user, txt := range ccdFiles {
+		if user == username {
+			continue
+		}
+		ccd := parseCcdText(user, txt)
+		if ccd.ClientAddress != "dynamic" && net.ParseIP(ccd.ClientAddress).Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// readCcdDir returns content of ccd files keyed by user name.
+// Hidden files (e.g. editor swap files) and directories are skipped.
+func readCcdDir() map[string]string {
+	return readCcdFiles(pkiFS, *ccdDir)
+}
+
+// readCcdFiles is readCcdDir of ccdDir in fsys
+func readCcdFiles(fsys fileSystem, ccdDir string) map[string]string {
+	files := make(map[string]string)
+
+	entries, err := fsys.ReadDir(ccdDir)
+	if err != nil {
+		log.Errorf("readCcdDir: %s", err)
+		return files
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		content, err := fsys.ReadFile(filepath.Join(ccdDir, entry.Name()))
+		if err != nil {
+			log.Warning(err)
+			continue
+		}
+		files[entry.Name()] = string(content)
+	}
+
+	return files
+}
+
+// requestUsername returns username parameter of r, it replies with 422 if username is malformed,
+// so it never reaches file paths or commands
+func requestUsername(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username := r.FormValue("username")
+	if err := validateUsername(username); err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return "", false
+	}
+	return username, true
+}
+
 func validateUsername(username string) error {
-	var validUsername = regexp.MustCompile(usernameRegexp)
-	if validUsername.MatchString(username) {
+	if utf8.RuneCountInString(username) > *usernameLengthLimit {
+		return fmt.Errorf("Username must be at most %d characters long", *usernameLengthLimit)
+	}
+	// "." and ".." match the regexp but point to directories when used as file names
+	if validUsername.MatchString(username) && username != "." && username != ".." {
 		return nil
 	} else {
-		return errors.New(fmt.Sprintf("Username can only contains %s", usernameRegexp))
+		return errors.New(fmt.Sprintf("Username can only contains %s", *usernamePattern))
 	}
 }
 
@@ -879,91 +2601,120 @@ func validatePassword(password string) error {
 	}
 }
 
-func checkUserExist(username string) bool {
-	for _, u := range indexTxtParser(fRead(*indexTxtPath)) {
-		if u.DistinguishedName == ("/CN=" + username) {
-			return true
-		}
+func validatePassphrase(passphrase string) error {
+	if utf8.RuneCountInString(passphrase) < passphraseMinLength {
+		return errors.New(fmt.Sprintf("Password too short, private key password length must be greater or equal %d", passphraseMinLength))
+	} else {
+		return nil
 	}
-	return false
 }
 
-func (oAdmin *OvpnAdmin) usersList() []OpenvpnClient {
+// requireUser answers 404 unless username is in index.txt
+func (oAdmin *OvpnAdmin) requireUser(w http.ResponseWriter, username string) bool {
+	if !oAdmin.users.Exists(username) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("user \"%s\" not found", username))
+		return false
+	}
+	return true
+}
+
+func (oAdmin *OvpnAdmin) getActiveClients() []clientStatus {
+	oAdmin.stateMutex.RLock()
+	defer oAdmin.stateMutex.RUnlock()
+	return oAdmin.activeClients
+}
+
+// refreshClients rebuilds users list and summary served by userListHandler and summaryHandler
+func (oAdmin *OvpnAdmin) refreshClients() {
+	clients, summary := oAdmin.usersList()
+	anomalies := findIndexTxtAnomalies(fRead(*indexTxtPath))
+	if len(anomalies) > 0 {
+		log.Warnf("index.txt has %d lines that are malformed or have unknown flag, see %s", len(anomalies), indexTxtAnomaliesUrl)
+	}
+	ovpnClientsOther.Set(float64(len(anomalies)))
+
+	oAdmin.stateMutex.Lock()
+	oAdmin.clients = clients
+	oAdmin.summary = summary
+	oAdmin.indexTxtAnomalies = anomalies
+	oAdmin.stateMutex.Unlock()
+}
+
+func (oAdmin *OvpnAdmin) usersList() ([]OpenvpnClient, usersSummary) {
 	var users []OpenvpnClient
+	var summary usersSummary
 
-	totalCerts := 0
-	validCerts := 0
-	revokedCerts := 0
-	expiredCerts := 0
-	connectedUniqUsers := 0
-	totalActiveConnections := 0
 	apochNow := time.Now().Unix()
 
-	for _, line := range indexTxtParser(fRead(*indexTxtPath)) {
-		if line.Identity != "server" && !strings.Contains(line.Identity, "REVOKED") {
-			totalCerts += 1
-			ovpnClient := OpenvpnClient{Identity: line.Identity, ExpirationDate: parseDateToString(indexTxtDateLayout, line.ExpirationDate, stringDateFormat)}
+	activeClients := oAdmin.getActiveClients()
+
+	for _, line := range oAdmin.users.List() {
+		if line.Identity != *serverCertCN && !strings.Contains(line.Identity, "REVOKED") {
+			summary.TotalCerts += 1
+			ovpnClient := OpenvpnClient{Identity: line.Identity, ExpirationDate: parseDateToString(indexTxtDateLayout, line.ExpirationDate, stringDateFormat), SerialNumber: line.SerialNumber, Email: line.Email}
 			switch {
 			case line.Flag == "V":
 				ovpnClient.AccountStatus = "Active"
-				validCerts += 1
+				summary.ValidCerts += 1
 			case line.Flag == "R":
 				ovpnClient.AccountStatus = "Revoked"
 				ovpnClient.RevocationDate = parseDateToString(indexTxtDateLayout, line.RevocationDate, stringDateFormat)
-				revokedCerts += 1
+				ovpnClient.RevocationReason = line.RevocationReason
+				if ovpnClient.RevocationReason == "" {
+					ovpnClient.RevocationReason = defaultRevocationReason
+				}
+				summary.RevokedCerts += 1
 			case line.Flag == "E":
 				ovpnClient.AccountStatus = "Expired"
-				expiredCerts += 1
+				summary.ExpiredCerts += 1
 			}
 
-			ovpnClientCertificateExpire.WithLabelValues(line.Identity).Set(float64((parseDateToUnix(indexTxtDateLayout, line.ExpirationDate) - apochNow) / 3600 / 24))
+			ovpnClientCertificateExpire.WithLabelValues(line.Identity).Set(expireDays(parseDateToUnix(indexTxtDateLayout, line.ExpirationDate), apochNow))
 
 			if (parseDateToUnix(indexTxtDateLayout, line.ExpirationDate) - apochNow) < 0 {
 				ovpnClient.AccountStatus = "Expired"
 			}
 			ovpnClient.Connections = 0
+			ovpnClient.LastSeen = oAdmin.getLastSeen(line.Identity)
+			ovpnClientConnected.WithLabelValues(line.Identity).Set(0)
 
-			userConnected, userConnectedTo := isUserConnected(line.Identity, oAdmin.activeClients)
+			userConnected, userConnectedTo := isUserConnected(line.Identity, activeClients)
 			if userConnected {
 				ovpnClient.ConnectionStatus = "Connected"
+				ovpnClientConnected.WithLabelValues(line.Identity).Set(1)
 				for range userConnectedTo {
 					ovpnClient.Connections += 1
-					totalActiveConnections += 1
+					summary.ActiveConnections += 1
 				}
-				connectedUniqUsers += 1
+				summary.ConnectedUsers += 1
 			}
 
 			users = append(users, ovpnClient)
-
-		} else {
-			ovpnServerCertExpire.Set(float64((parseDateToUnix(indexTxtDateLayout, line.ExpirationDate) - apochNow) / 3600 / 24))
 		}
 	}
 
-	otherCerts := totalCerts - validCerts - revokedCerts - expiredCerts
-
-	if otherCerts != 0 {
-		log.Warnf("there are %d otherCerts", otherCerts)
-	}
+	ovpnClientsTotal.Set(float64(summary.TotalCerts))
+	ovpnClientsRevoked.Set(float64(summary.RevokedCerts))
+	ovpnClientsExpired.Set(float64(summary.ExpiredCerts))
+	ovpnClientsConnected.Set(float64(summary.ActiveConnections))
+	ovpnUniqClientsConnected.Set(float64(summary.ConnectedUsers))
 
-	ovpnClientsTotal.Set(float64(totalCerts))
-	ovpnClientsRevoked.Set(float64(revokedCerts))
-	ovpnClientsExpired.Set(float64(expiredCerts))
-	ovpnClientsConnected.Set(float64(totalActiveConnections))
-	ovpnUniqClientsConnected.Set(float64(connectedUniqUsers))
+	return users, summary
+}
 
-	return users
+func (oAdmin *OvpnAdmin) userCreate(username, password string, opts clientCertOptions) (bool, string) {
+	oAdmin.pkiMutex.Lock()
+	defer oAdmin.pkiMutex.Unlock()
+	return oAdmin.createUser(username, password, opts)
 }
 
-func (oAdmin *OvpnAdmin) userCreate(username, password string) (bool, string) {
+// createUser issues certificate for the user, must be called with pkiMutex held
+func (oAdmin *OvpnAdmin) createUser(username, password string, opts clientCertOptions) (bool, string) {
 	ucErr := fmt.Sprintf("User \"%s\" created", username)
 
-	oAdmin.createUserMutex.Lock()
-	defer oAdmin.createUserMutex.Unlock()
-
-	if checkUserExist(username) {
-		ucErr = fmt.Sprintf("User \"%s\" already exists\n", username)
-		log.Debugf("userCreate: checkUserExist():  %s", ucErr)
+	if oAdmin.users.Exists(username) {
+		ucErr = fmt.Sprintf("User \"%s\" already exists", username)
+		log.Debugf("userCreate: users.Exists():  %s", ucErr)
 		return false, ucErr
 	}
 
@@ -972,39 +2723,70 @@ func (oAdmin *OvpnAdmin) userCreate(username, password string) (bool, string) {
 		return false, err.Error()
 	}
 
+	// without additional password authentication the password protects client private key
+	var passphrase string
 	if *authByPassword {
 		if err := validatePassword(password); err != nil {
 			log.Debugf("userCreate: authByPassword(): %s", err.Error())
 			return false, err.Error()
 		}
+	} else if password != "" {
+		if err := validatePassphrase(password); err != nil {
+			log.Debugf("userCreate: validatePassphrase(): %s", err.Error())
+			return false, err.Error()
+		}
+		if *storageBackend == "kubernetes.secrets" {
+			return false, "Password protected certificates are not supported with kubernetes.secrets storage backend"
+		}
+		if *easyrsaVersion == easyrsaVersion2 {
+			return false, "Password protected certificates are not supported with easyrsa v2"
+		}
+		passphrase = password
 	}
 
-	if *storageBackend == "kubernetes.secrets" {
-		err := app.easyrsaBuildClient(username)
-		if err != nil {
-			log.Error(err)
+	if !opts.empty() {
+		if *storageBackend == "kubernetes.secrets" {
+			return false, "Email and SAN of certificates are not supported with kubernetes.secrets storage backend"
 		}
-	} else {
-		o := runBash(fmt.Sprintf("cd %s && %s build-client-full %s nopass 1>/dev/null", *easyrsaDirPath, *easyrsaBinPath, username))
-		log.Debug(o)
+		if *easyrsaVersion == easyrsaVersion2 {
+			return false, "Email and SAN of certificates are not supported with easyrsa v2"
+		}
+	}
+
+	err := oAdmin.pki.CreateClient(username, passphrase, opts)
+	if err != nil {
+		log.WithField("username", username).Error(err)
+		return false, err.Error()
 	}
 
 	if *authByPassword {
-		o := runBash(fmt.Sprintf("openvpn-user create --db.path %s --user %s --password %s", *authDatabase, username, password))
+		o, err := runOpenvpnUser("create", "--db.path", *authDatabase, "--user", username, "--password", password)
 		log.Debug(o)
+		if err != nil {
+			log.WithField("username", username).Errorf("openvpn-user create failed: %s", err)
+			return false, fmt.Sprintf("openvpn-user create failed: %s", err)
+		}
 	}
 
-	log.Infof("Certificate for user %s issued", username)
+	log.WithField("username", username).Info("Certificate issued")
 
 	//oAdmin.clients = oAdmin.usersList()
 
 	return true, ucErr
 }
 
+// runOpenvpnUser runs openvpn-user with args for password authentication database
+func runOpenvpnUser(args ...string) (string, error) {
+	return runCommand("", "", append([]string{"openvpn-user"}, args...)...)
+}
+
 func (oAdmin *OvpnAdmin) userChangePassword(username, password string) (error, string) {
+	if err := validateUsername(username); err != nil {
+		return err, err.Error()
+	}
 
-	if checkUserExist(username) {
-		o := runBash(fmt.Sprintf("openvpn-user check --db.path %[1]s --user %[2]s | grep %[2]s | wc -l", *authDatabase, username))
+	if oAdmin.users.Exists(username) {
+		o, _ := runOpenvpnUser("check", "--db.path", *authDatabase, "--user", username)
 		log.Debug(o)
 
 		if err := validatePassword(password); err != nil {
@@ -1012,25 +2794,34 @@ func (oAdmin *OvpnAdmin) userChangePassword(username, password string) (error, s
 			return err, err.Error()
 		}
 
-		if strings.TrimSpace(o) == "0" {
-			o = runBash(fmt.Sprintf("openvpn-user create --db.path %s --user %s --password %s", *authDatabase, username, password))
+		var err error
+		if !strings.Contains(o, username) {
+			o, err = runOpenvpnUser("create", "--db.path", *authDatabase, "--user", username, "--password", password)
 			log.Debug(o)
+			if err != nil {
+				log.WithField("username", username).Errorf("openvpn-user create failed: %s", err)
+				return err, fmt.Sprintf("openvpn-user create failed: %s", err)
+			}
 		}
 
-		o = runBash(fmt.Sprintf("openvpn-user change-password --db.path %s --user %s --password %s", *authDatabase, username, password))
+		o, err = runOpenvpnUser("change-password", "--db.path", *authDatabase, "--user", username, "--password", password)
 		log.Debug(o)
+		if err != nil {
+			log.WithField("username", username).Errorf("openvpn-user change-password failed: %s", err)
+			return err, fmt.Sprintf("openvpn-user change-password failed: %s", err)
+		}
 
-		log.Infof("Password for user %s was changed", username)
+		log.WithField("username", username).Info("Password changed")
 
 		return nil, "Password changed"
 	}
 
-	return errors.New(fmt.Sprintf("User \"%s\" not found}", username)), fmt.Sprintf("{\"msg\":\"User \"%s\" not found\"}", username)
+	return errors.New(fmt.Sprintf("User \"%s\" not found", username)), fmt.Sprintf("User \"%s\" not found", username)
 }
 
 func (oAdmin *OvpnAdmin) getUserStatistic(username string) []clientStatus {
 	var userStatistic []clientStatus
-	for _, u := range oAdmin.activeClients {
+	for _, u := range oAdmin.getActiveClients() {
 		if u.CommonName == username {
 			userStatistic = append(userStatistic, u)
 		}
@@ -1038,108 +2829,203 @@ func (oAdmin *OvpnAdmin) getUserStatistic(username string) []clientStatus {
 	return userStatistic
 }
 
-func (oAdmin *OvpnAdmin) userRevoke(username string) (error, string) {
-	log.Infof("Revoke certificate for user %s", username)
-	if checkUserExist(username) {
-		// check certificate valid flag 'V'
-		if *storageBackend == "kubernetes.secrets" {
-			err := app.easyrsaRevoke(username)
-			if err != nil {
-				log.Error(err)
-			}
-		} else {
-			o := runBash(fmt.Sprintf("cd %[1]s && echo yes | %[2]s revoke %[3]s 1>/dev/null && %[2]s gen-crl 1>/dev/null", *easyrsaDirPath, *easyrsaBinPath, username))
-			log.Debugln(o)
-		}
+// userDisconnect kills all sessions of username, or only the session with client ID cid if it's set
+func (oAdmin *OvpnAdmin) userDisconnect(username, cid string) (error, string) {
+	if err := validateUsername(username); err != nil {
+		return err, err.Error()
+	}
+	if !oAdmin.users.Exists(username) {
+		return errors.New(fmt.Sprintf("User \"%s\" not found", username)), fmt.Sprintf("User \"%s\" not found", username)
+	}
+	if cid != "" {
+		return oAdmin.userDisconnectSession(username, cid)
+	}
 
-		if *authByPassword {
-			o := runBash(fmt.Sprintf("openvpn-user revoke --db-path %s --user %s", *authDatabase, username))
-			log.Debug(o)
+	killed := false
+	var replies []string
+	for srv := range oAdmin.mgmtInterfaces {
+		ok, reply := oAdmin.mgmtKillUserConnection(username, srv)
+		if ok {
+			killed = true
+			log.WithFields(log.Fields{"username": username, "server": srv}).Info("Session killed")
 		}
+		replies = append(replies, fmt.Sprintf("%s: %s", srv, reply))
+	}
 
-		crlFix()
-		userConnected, userConnectedTo := isUserConnected(username, oAdmin.activeClients)
-		log.Tracef("User %s connected: %t", username, userConnected)
-		if userConnected {
-			for _, connection := range userConnectedTo {
-				oAdmin.mgmtKillUserConnection(username, connection)
-				log.Infof("Session for user \"%s\" killed", username)
-			}
+	if !killed {
+		return errors.New(fmt.Sprintf("User \"%s\" is not connected", username)), strings.Join(replies, "; ")
+	}
+
+	polledClients := oAdmin.mgmtGetActiveClients()
+	oAdmin.stateMutex.Lock()
+	oAdmin.forgetClient(username)
+	oAdmin.activeClients = polledClients
+	oAdmin.stateMutex.Unlock()
+	oAdmin.refreshClients()
+
+	return nil, strings.Join(replies, "; ")
+}
+
+// userDisconnectSession kills session cid of username, cid must belong to one of the sessions of username
+// so it can't be used to kill sessions of other users
+func (oAdmin *OvpnAdmin) userDisconnectSession(username, cid string) (error, string) {
+	if _, err := strconv.ParseUint(cid, 10, 64); err != nil {
+		return errors.New(fmt.Sprintf("Invalid client ID \"%s\"", cid)), "client ID must be a number"
+	}
+
+	killed := false
+	var replies []string
+	for _, session := range oAdmin.getActiveClients() {
+		if session.CommonName != username || session.ClientId != cid {
+			continue
+		}
+		ok, reply := oAdmin.mgmtKillByCID(cid, session.ConnectedTo)
+		if ok {
+			killed = true
+			log.WithFields(log.Fields{"username": username, "server": session.ConnectedTo, "cid": cid}).Info("Session killed")
 		}
+		replies = append(replies, fmt.Sprintf("%s: %s", session.ConnectedTo, reply))
+	}
 
-		oAdmin.setState()
-		return nil, fmt.Sprintf("user \"%s\" revoked", username)
+	if replies == nil {
+		return errors.New(fmt.Sprintf("User \"%s\" has no session with client ID %s", username, cid)), "session not found"
+	}
+	if !killed {
+		return errors.New(fmt.Sprintf("Session %s of user \"%s\" is not killed", cid, username)), strings.Join(replies, "; ")
+	}
+
+	polledClients := oAdmin.mgmtGetActiveClients()
+	oAdmin.stateMutex.Lock()
+	oAdmin.activeClients = polledClients
+	oAdmin.stateMutex.Unlock()
+	oAdmin.refreshClients()
+
+	return nil, strings.Join(replies, "; ")
+}
+
+// revokeDryRun is returned by api/user/revoke with dry_run=true
+type revokeDryRun struct {
+	DryRun  bool     `json:"DryRun"`
+	Actions []string `json:"Actions"`
+}
+
+// userRevokeDryRun lists what userRevoke would do without changing anything
+func (oAdmin *OvpnAdmin) userRevokeDryRun(username, reason string) (error, revokeDryRun) {
+	plan := revokeDryRun{DryRun: true, Actions: []string{}}
+	if err := validateUsername(username); err != nil {
+		return err, plan
+	}
+	if !oAdmin.users.Exists(username) {
+		return fmt.Errorf("User \"%s\" not found", username), plan
+	}
+	plan.Actions = append(plan.Actions, oAdmin.pki.RevokeActions(username, reason)...)
+	if *authByPassword {
+		plan.Actions = append(plan.Actions, strings.Join([]string{"openvpn-user", "revoke", "--db-path", *authDatabase, "--user", username}, " "))
+	}
+	_, userConnectedTo := isUserConnected(username, oAdmin.getActiveClients())
+	for _, connection := range userConnectedTo {
+		plan.Actions = append(plan.Actions, fmt.Sprintf("kill %s via mgmt interface %s", username, connection))
 	}
-	log.Infof("user \"%s\" not found", username)
-	return errors.New(fmt.Sprintf("User \"%s\" not found}", username)), fmt.Sprintf("User \"%s\" not found", username)
+	return nil, plan
 }
 
-func (oAdmin *OvpnAdmin) userUnrevoke(username string) (error, string) {
-	if checkUserExist(username) {
-		if *storageBackend == "kubernetes.secrets" {
-			err := app.easyrsaUnrevoke(username)
+func (oAdmin *OvpnAdmin) userRevoke(username, reason string) (error, string) {
+	if err := validateUsername(username); err != nil {
+		return err, err.Error()
+	}
+	log.WithFields(log.Fields{"username": username, "reason": reason}).Info("Revoke certificate")
+	if oAdmin.users.Exists(username) {
+		oAdmin.pkiMutex.Lock()
+		// check certificate valid flag 'V'
+		err := oAdmin.pki.Revoke(username, reason)
+		if err != nil {
+			oAdmin.pkiMutex.Unlock()
+			log.WithField("username", username).Error(err)
+			return err, err.Error()
+		}
+
+		if *authByPassword {
+			o, err := runOpenvpnUser("revoke", "--db-path", *authDatabase, "--user", username)
+			log.Debug(o)
 			if err != nil {
-				log.Error(err)
+				log.WithField("username", username).Errorf("openvpn-user revoke failed: %s", err)
 			}
-		} else {
-			// check certificate revoked flag 'R'
-			usersFromIndexTxt := indexTxtParser(fRead(*indexTxtPath))
-			for i := range usersFromIndexTxt {
-				if usersFromIndexTxt[i].DistinguishedName == "/CN="+username {
-					if usersFromIndexTxt[i].Flag == "R" {
-
-						usersFromIndexTxt[i].Flag = "V"
-						usersFromIndexTxt[i].RevocationDate = ""
-
-						err := fMove(fmt.Sprintf("%s/pki/revoked/certs_by_serial/%s.crt", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber), fmt.Sprintf("%s/pki/issued/%s.crt", *easyrsaDirPath, username))
-						if err != nil {
-							log.Error(err)
-						}
-						err = fMove(fmt.Sprintf("%s/pki/revoked/certs_by_serial/%s.crt", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber), fmt.Sprintf("%s/pki/certs_by_serial/%s.pem", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber))
-						if err != nil {
-							log.Error(err)
-						}
-						err = fMove(fmt.Sprintf("%s/pki/revoked/private_by_serial/%s.key", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber), fmt.Sprintf("%s/pki/private/%s.key", *easyrsaDirPath, username))
-						if err != nil {
-							log.Error(err)
-						}
-						err = fMove(fmt.Sprintf("%s/pki/revoked/reqs_by_serial/%s.req", *easyrsaDirPath, usersFromIndexTxt[i].SerialNumber), fmt.Sprintf("%s/pki/reqs/%s.req", *easyrsaDirPath, username))
-						if err != nil {
-							log.Error(err)
-						}
-						err = fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
-						if err != nil {
-							log.Error(err)
-						}
-
-						_ = runBash(fmt.Sprintf("cd %s && %s gen-crl 1>/dev/null", *easyrsaDirPath, *easyrsaBinPath))
-
-						if *authByPassword {
-							o := runBash(fmt.Sprintf("openvpn-user restore --db-path %s --user %s", *authDatabase, username))
-							log.Debug(o)
-						}
-
-						crlFix()
+		}
 
-						break
-					}
+		crlFix()
+		oAdmin.pkiMutex.Unlock()
+		userConnected, userConnectedTo := isUserConnected(username, oAdmin.getActiveClients())
+		log.Tracef("User %s connected: %t", username, userConnected)
+		if userConnected {
+			for _, connection := range userConnectedTo {
+				if killed, _ := oAdmin.mgmtKillUserConnection(username, connection); killed {
+					log.WithFields(log.Fields{"username": username, "server": connection}).Info("Session killed")
 				}
 			}
-			err := fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
+		}
+
+		oAdmin.setState()
+		return nil, fmt.Sprintf("user \"%s\" revoked", username)
+	}
+	log.WithField("username", username).Info("user not found")
+	return errors.New(fmt.Sprintf("User \"%s\" not found", username)), fmt.Sprintf("User \"%s\" not found", username)
+}
+
+func (oAdmin *OvpnAdmin) userUnrevoke(username string) (error, string) {
+	if err := validateUsername(username); err != nil {
+		return err, err.Error()
+	}
+	if oAdmin.users.Exists(username) {
+		oAdmin.pkiMutex.Lock()
+		err := oAdmin.pki.Unrevoke(username)
+		if err != nil {
+			oAdmin.pkiMutex.Unlock()
+			log.WithField("username", username).Error(err)
+			return err, err.Error()
+		}
+
+		if *authByPassword {
+			o, err := runOpenvpnUser("restore", "--db-path", *authDatabase, "--user", username)
+			log.Debug(o)
 			if err != nil {
-				log.Error(err)
+				log.WithField("username", username).Errorf("openvpn-user restore failed: %s", err)
 			}
-			//fmt.Print(renderIndexTxt(usersFromIndexTxt))
 		}
+
 		crlFix()
-		oAdmin.clients = oAdmin.usersList()
-		return nil, fmt.Sprintf("{\"msg\":\"User %s successfully unrevoked\"}", username)
+		oAdmin.pkiMutex.Unlock()
+		oAdmin.refreshClients()
+		return nil, fmt.Sprintf("User %s successfully unrevoked", username)
 	}
-	return errors.New(fmt.Sprintf("user \"%s\" not found", username)), fmt.Sprintf("{\"msg\":\"User \"%s\" not found\"}", username)
+	log.WithField("username", username).Info("user not found")
+	return fmt.Errorf("User \"%s\" not found", username), fmt.Sprintf("User \"%s\" not found", username)
+}
+
+func (oAdmin *OvpnAdmin) getUserSerial(username string) string {
+	line, _ := oAdmin.users.Get(username)
+	return line.SerialNumber
+}
+
+// userRotateResult is returned by api/user/rotate
+type userRotateResult struct {
+	Username        string `json:"Username"`
+	OldSerialNumber string `json:"OldSerialNumber"`
+	NewSerialNumber string `json:"NewSerialNumber"`
 }
 
-func (oAdmin *OvpnAdmin) userRotate(username, newPassword string) (error, string) {
-	if checkUserExist(username) {
+func (oAdmin *OvpnAdmin) userRotate(username, newPassword string) (error, userRotateResult) {
+	oAdmin.pkiMutex.Lock()
+	defer oAdmin.pkiMutex.Unlock()
+
+	result := userRotateResult{Username: username}
+	if err := validateUsername(username); err != nil {
+		return err, result
+	}
+	if oAdmin.users.Exists(username) {
+		result.OldSerialNumber = oAdmin.getUserSerial(username)
+		// ccd of kubernetes.secrets backend is stored along with the certificate, keep it for the new one
+		ccd := readCcdText(username)
+
 		if *storageBackend == "kubernetes.secrets" {
 			err := app.easyrsaRotate(username, newPassword)
 			if err != nil {
@@ -1152,44 +3038,52 @@ func (oAdmin *OvpnAdmin) userRotate(username, newPassword string) (error, string
 
 			uniqHash := strings.Replace(uuid.New().String(), "-", "", -1)
 
+			unlock := lockIndexTxt()
 			usersFromIndexTxt := indexTxtParser(fRead(*indexTxtPath))
 			for i := range usersFromIndexTxt {
-				if usersFromIndexTxt[i].DistinguishedName == "/CN="+username {
+				if usersFromIndexTxt[i].Identity == username {
 					oldUserSerial = usersFromIndexTxt[i].SerialNumber
-					usersFromIndexTxt[i].DistinguishedName = "/CN=REVOKED-" + username + "-" + uniqHash
+					usersFromIndexTxt[i].DistinguishedName = indexTxtReplaceCommonName(usersFromIndexTxt[i].DistinguishedName, "REVOKED-"+username+"-"+uniqHash)
 					oldUserIndex = i
 					break
 				}
 			}
 			err := fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
+			unlock()
 			if err != nil {
 				log.Error(err)
 			}
 
 			if *authByPassword {
-				o := runBash(fmt.Sprintf("openvpn-user delete --force --db.path %s --user %s", *authDatabase, username))
+				o, err := runOpenvpnUser("delete", "--force", "--db.path", *authDatabase, "--user", username)
 				log.Debug(o)
+				if err != nil {
+					log.WithField("username", username).Errorf("openvpn-user delete failed: %s", err)
+				}
 			}
 
-			userCreated, userCreateMessage := oAdmin.userCreate(username, newPassword)
+			userCreated, userCreateMessage := oAdmin.createUser(username, newPassword, clientCertOptions{})
 			if !userCreated {
+				unlock = lockIndexTxt()
 				usersFromIndexTxt = indexTxtParser(fRead(*indexTxtPath))
 				for i := range usersFromIndexTxt {
 					if usersFromIndexTxt[i].SerialNumber == oldUserSerial {
-						usersFromIndexTxt[i].DistinguishedName = "/CN=" + username
+						usersFromIndexTxt[i].DistinguishedName = indexTxtReplaceCommonName(usersFromIndexTxt[i].DistinguishedName, username)
 						break
 					}
 				}
 				err = fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
+				unlock()
 				if err != nil {
 					log.Error(err)
 				}
-				return errors.New(fmt.Sprintf("error rotaing user due:  %s", userCreateMessage)), userCreateMessage
+				return errors.New(fmt.Sprintf("error rotating user due: %s", userCreateMessage)), result
 			}
 
+			unlock = lockIndexTxt()
 			usersFromIndexTxt = indexTxtParser(fRead(*indexTxtPath))
 			for i := range usersFromIndexTxt {
-				if usersFromIndexTxt[i].DistinguishedName == "/CN="+username {
+				if usersFromIndexTxt[i].Identity == username {
 					newUserIndex = i
 				}
 				if usersFromIndexTxt[i].SerialNumber == oldUserSerial {
@@ -1199,72 +3093,270 @@ func (oAdmin *OvpnAdmin) userRotate(username, newPassword string) (error, string
 			usersFromIndexTxt[oldUserIndex], usersFromIndexTxt[newUserIndex] = usersFromIndexTxt[newUserIndex], usersFromIndexTxt[oldUserIndex]
 
 			err = fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
+			unlock()
 			if err != nil {
 				log.Error(err)
 			}
 
-			_ = runBash(fmt.Sprintf("cd %s && %s gen-crl 1>/dev/null", *easyrsaDirPath, *easyrsaBinPath))
+			err = oAdmin.pki.GenCRL()
+			if err != nil {
+				log.Error(err)
+			}
 		}
 		crlFix()
-		oAdmin.clients = oAdmin.usersList()
-		return nil, fmt.Sprintf("{\"msg\":\"User %s successfully rotated\"}", username)
+
+		if ccd != "" {
+			err := writeCcdText(username, ccd)
+			if err != nil {
+				log.Errorf("userRotate: restore ccd: %v", err)
+			}
+		}
+
+		oAdmin.refreshClients()
+		result.NewSerialNumber = oAdmin.getUserSerial(username)
+		return nil, result
 	}
-	return errors.New(fmt.Sprintf("user \"%s\" not found", username)), fmt.Sprintf("{\"msg\":\"User \"%s\" not found\"}", username)
+	return errors.New(fmt.Sprintf("user \"%s\" not found", username)), result
+}
+
+// userDeleteResult is returned by api/user/delete
+type userDeleteResult struct {
+	Username string   `json:"Username"`
+	Removed  []string `json:"Removed"`
+	// IndexTxt is "removed" or "kept": entry of revoked cert which is not expired yet is kept under
+	// REVOKED-<username>-<hash> name, otherwise the cert would drop out of CRL and become usable again
+	IndexTxt string `json:"IndexTxt"`
 }
 
-func (oAdmin *OvpnAdmin) userDelete(username string) (error, string) {
-	if checkUserExist(username) {
+// userDelete revokes user certificate if it's still valid and purges all files of the user
+func (oAdmin *OvpnAdmin) userDelete(username string) (error, userDeleteResult) {
+	result := userDeleteResult{Username: username, Removed: []string{}, IndexTxt: "kept"}
+	if username == *serverCertCN {
+		return errors.New("server certificate can't be deleted"), result
+	}
+	if err := validateUsername(username); err != nil {
+		return err, result
+	}
+	oAdmin.pkiMutex.Lock()
+	defer oAdmin.pkiMutex.Unlock()
+	if oAdmin.users.Exists(username) {
+		log.WithField("username", username).Info("Delete user")
 		if *storageBackend == "kubernetes.secrets" {
 			err := app.easyrsaDelete(username)
 			if err != nil {
 				log.Error(err)
 			}
 		} else {
+			line, _ := oAdmin.users.Get(username)
+			if line.Flag == "V" {
+				err := oAdmin.pki.Revoke(username, defaultRevocationReason)
+				if err != nil {
+					log.Error(err)
+				}
+				line, _ = oAdmin.users.Get(username)
+				if line.Flag != "R" {
+					log.WithField("username", username).Error("user is not deleted: revoke failed")
+					return fmt.Errorf("user \"%s\" is not deleted: revoke failed", username), result
+				}
+			}
+
+			result.Removed = purgeUserFiles(oAdmin.fs, username, line.SerialNumber)
+
+			if *authByPassword {
+				if _, err := runOpenvpnUser("delete", "--force", "--db.path", *authDatabase, "--user", username); err != nil {
+					log.WithField("username", username).Errorf("openvpn-user delete failed: %s", err)
+				}
+			}
+
 			uniqHash := strings.Replace(uuid.New().String(), "-", "", -1)
+			unlock := lockIndexTxt()
 			usersFromIndexTxt := indexTxtParser(fRead(*indexTxtPath))
 			for i := range usersFromIndexTxt {
-				if usersFromIndexTxt[i].DistinguishedName == "/CN="+username {
-					usersFromIndexTxt[i].DistinguishedName = "/CN=REVOKED-" + username + "-" + uniqHash
+				if usersFromIndexTxt[i].Identity == username {
+					if parseDateToUnix(indexTxtDateLayout, usersFromIndexTxt[i].ExpirationDate) < time.Now().Unix() {
+						usersFromIndexTxt = append(usersFromIndexTxt[:i], usersFromIndexTxt[i+1:]...)
+						result.IndexTxt = "removed"
+					} else {
+						usersFromIndexTxt[i].DistinguishedName = indexTxtReplaceCommonName(usersFromIndexTxt[i].DistinguishedName, "REVOKED-"+username+"-"+uniqHash)
+					}
 					break
 				}
 			}
-			if *authByPassword {
-				_ = runBash(fmt.Sprintf("openvpn-user delete --force --db.path %s --user %s", *authDatabase, username))
-			}
 			err := fWrite(*indexTxtPath, renderIndexTxt(usersFromIndexTxt))
+			unlock()
+			if err != nil {
+				log.Error(err)
+			}
+			err = oAdmin.pki.GenCRL()
 			if err != nil {
 				log.Error(err)
 			}
-			_ = runBash(fmt.Sprintf("cd %s && %s gen-crl 1>/dev/null ", *easyrsaDirPath, *easyrsaBinPath))
 		}
 		crlFix()
-		oAdmin.clients = oAdmin.usersList()
-		return nil, fmt.Sprintf("{\"msg\":\"User %s successfully deleted\"}", username)
+		oAdmin.refreshClients()
+		return nil, result
+	}
+	return errors.New(fmt.Sprintf("User \"%s\" not found", username)), result
+}
+
+// purgeUserFiles removes certificate, key and request of the user from fsys, wherever easyrsa keeps them, and its ccd.
+// Returns removed files relative to pki dir, ccd is reported as ccd/<username>
+func purgeUserFiles(fsys fileSystem, username, serial string) []string {
+	pki := *easyrsaDirPath + "/pki/"
+	files := []string{
+		pki + "issued/" + username + ".crt",
+		pki + "private/" + username + ".key",
+		pki + "reqs/" + username + ".req",
+		pki + "private/" + username + ".pem",
+	}
+	if serial != "" {
+		files = append(files,
+			pki+"certs_by_serial/"+serial+".pem",
+			pki+"revoked/certs_by_serial/"+serial+".crt",
+			pki+"revoked/private_by_serial/"+serial+".key",
+			pki+"revoked/reqs_by_serial/"+serial+".req",
+		)
+	}
+	files = append(files, *ccdDir+"/"+username)
+
+	removed := []string{}
+	for _, file := range files {
+		err := fsys.Remove(file)
+		if err == nil {
+			removed = append(removed, strings.Replace(strings.TrimPrefix(file, pki), *ccdDir+"/", "ccd/", 1))
+		} else if !os.IsNotExist(err) {
+			log.WithField("username", username).Warnf("failed to remove %s: %s", file, err)
+		}
 	}
-	return errors.New(fmt.Sprintf("User \"%s\" not found}", username)), fmt.Sprintf("{\"msg\":\"User \"%s\" not found\"}", username)
+	return removed
 }
 
+// mgmtRead reads reply of mgmt interface chunk by chunk till any of its lines completes the reply,
+// so replies longer than a single read are never truncated
 func (oAdmin *OvpnAdmin) mgmtRead(conn net.Conn) string {
 	recvData := make([]byte, 32768)
-	var out string
-	var n int
-	var err error
+	var out strings.Builder
 	for {
-		n, err = conn.Read(recvData)
-		if n <= 0 || err != nil {
+		conn.SetReadDeadline(time.Now().Add(mgmtReadTimeout))
+		n, err := conn.Read(recvData)
+		out.Write(recvData[:n])
+		if mgmtReplyComplete(out.String()) {
 			break
-		} else {
-			out += string(recvData[:n])
-			if strings.Contains(out, "type 'help' for more info") || strings.Contains(out, "END") || strings.Contains(out, "SUCCESS:") || strings.Contains(out, "ERROR:") {
-				break
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				log.Warnf("mgmtRead: no complete reply from %s in %s", conn.RemoteAddr(), mgmtReadTimeout)
 			}
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return out.String()
+}
+
+// mgmtReplyComplete reports whether text has a line finishing mgmt reply: END of multiline replies,
+// SUCCESS or ERROR of commands, welcome message or password prompt which has no line break after it
+func mgmtReplyComplete(text string) bool {
+	if strings.HasSuffix(text, mgmtPasswordPrompt) {
+		return true
+	}
+	// the last line may be incomplete yet
+	completeLines := text[:strings.LastIndex(text, "\n")+1]
+	reader := bufio.NewReader(strings.NewReader(completeLines))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		line = strings.TrimSpace(line)
+		if line == "END" || strings.HasPrefix(line, "SUCCESS:") || strings.HasPrefix(line, "ERROR:") || strings.Contains(line, "type 'help' for more info") {
+			return true
 		}
 	}
-	return out
 }
 
+// mgmtWelcome reads welcome message of a new mgmt connection, sending --mgmt.password first if mgmt interface asks for it
+func (oAdmin *OvpnAdmin) mgmtWelcome(conn net.Conn) error {
+	out := oAdmin.mgmtRead(conn)
+	if !strings.Contains(out, mgmtPasswordPrompt) {
+		return nil
+	}
+	if *mgmtPassword == "" {
+		return errors.New("mgmt interface asks for password, but --mgmt.password is not set")
+	}
+
+	conn.Write([]byte(*mgmtPassword + "\n"))
+	out = oAdmin.mgmtRead(conn)
+	if strings.Contains(out, "ERROR:") {
+		return errors.New("mgmt interface rejected --mgmt.password")
+	}
+	if !strings.Contains(out, "SUCCESS:") {
+		return fmt.Errorf("unexpected reply to password from mgmt interface: %s", strings.TrimSpace(out))
+	}
+	// welcome message follows the password confirmation and may come in a separate read
+	if !strings.Contains(out, "type 'help' for more info") {
+		oAdmin.mgmtRead(conn)
+	}
+	return nil
+}
+
+// mgmtConnectedUsersParser returns clients from status output of serverName and updates their metrics
 func (oAdmin *OvpnAdmin) mgmtConnectedUsersParser(text, serverName string) []clientStatus {
+	u := parseConnectedUsers(text, serverName, oAdmin.mgmtListeners[serverName])
+
+	for i := range u {
+		bytesSent, _ := strconv.Atoi(u[i].BytesSent)
+		bytesReceive, _ := strconv.Atoi(u[i].BytesReceived)
+		connectedSince := parseDateToUnix(oAdmin.mgmtStatusTimeFormat, u[i].ConnectedSince)
+		ovpnClientConnectionFrom.WithLabelValues(u[i].CommonName, u[i].RealAddress).Set(float64(connectedSince))
+		ovpnClientConnectionDuration.WithLabelValues(u[i].CommonName, u[i].RealAddress).Set(float64(time.Now().Unix() - connectedSince))
+		ovpnClientBytesSent.WithLabelValues(u[i].CommonName).Set(float64(bytesSent))
+		ovpnClientBytesReceived.WithLabelValues(u[i].CommonName).Set(float64(bytesReceive))
+		// user may be missing in the routing table right after connect, so don't wait for it
+		ovpnClientConnected.WithLabelValues(u[i].CommonName).Set(1)
+		if u[i].VirtualAddress != "" && u[i].LastRef != "" {
+			ovpnClientConnectionInfo.WithLabelValues(u[i].CommonName, u[i].VirtualAddress).Set(float64(parseDateToUnix(oAdmin.mgmtStatusTimeFormat, u[i].LastRef)))
+		}
+	}
+	return u
+}
+
+// parseConnectedUsers returns clients of status text of listener named serverName, routes are applied to them
+func parseConnectedUsers(text, serverName string, listener OpenvpnServer) []clientStatus {
+	u, routes := mgmtStatusParser(text)
+	applyRoutes(u, routes)
+
+	for i := range u {
+		u[i].ConnectedTo = serverName
+		u[i].Protocol = listener.Protocol
+		u[i].Port = listener.Port
+	}
+	return u
+}
+
+// mgmtStatusVersion detects status format version from the first non-empty line
+func mgmtStatusVersion(text string) int {
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		txt := strings.TrimSpace(scanner.Text())
+		if txt == "" || strings.HasPrefix(txt, ">INFO:") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(txt, "TITLE\t"), strings.HasPrefix(txt, "HEADER\t"):
+			return 3
+		case strings.HasPrefix(txt, "TITLE,"), strings.HasPrefix(txt, "HEADER,"):
+			return 2
+		default:
+			return 1
+		}
+	}
+	return 1
+}
+
+func mgmtStatusV1Parser(text string) ([]clientStatus, []routingTableEntry) {
 	var u []clientStatus
+	var routes []routingTableEntry
 	isClientList := false
 	isRouteTable := false
 	scanner := bufio.NewScanner(strings.NewReader(text))
@@ -1288,6 +3380,10 @@ func (oAdmin *OvpnAdmin) mgmtConnectedUsersParser(text, serverName string) []cli
 		}
 		if isClientList {
 			user := strings.Split(txt, ",")
+			if len(user) < 5 {
+				log.Debugf("mgmtStatusV1Parser: skipping malformed client list line %q", txt)
+				continue
+			}
 
 			userName := user[0]
 			userAddress := user[1]
@@ -1295,39 +3391,154 @@ func (oAdmin *OvpnAdmin) mgmtConnectedUsersParser(text, serverName string) []cli
 			userBytesSent := user[3]
 			userConnectedSince := user[4]
 
-			userStatus := clientStatus{CommonName: userName, RealAddress: userAddress, BytesReceived: userBytesReceived, BytesSent: userBytesSent, ConnectedSince: userConnectedSince, ConnectedTo: serverName}
+			userStatus := clientStatus{CommonName: userName, RealAddress: userAddress, BytesReceived: userBytesReceived, BytesSent: userBytesSent, ConnectedSince: userConnectedSince}
 			u = append(u, userStatus)
-			bytesSent, _ := strconv.Atoi(userBytesSent)
-			bytesReceive, _ := strconv.Atoi(userBytesReceived)
-			ovpnClientConnectionFrom.WithLabelValues(userName, userAddress).Set(float64(parseDateToUnix(oAdmin.mgmtStatusTimeFormat, userConnectedSince)))
-			ovpnClientBytesSent.WithLabelValues(userName).Set(float64(bytesSent))
-			ovpnClientBytesReceived.WithLabelValues(userName).Set(float64(bytesReceive))
 		}
 		if isRouteTable {
-			user := strings.Split(txt, ",")
-			for i := range u {
-				if u[i].CommonName == user[1] {
-					u[i].VirtualAddress = user[0]
-					u[i].LastRef = user[3]
-					ovpnClientConnectionInfo.WithLabelValues(user[1], user[0]).Set(float64(parseDateToUnix(oAdmin.mgmtStatusTimeFormat, user[3])))
-					break
+			route := strings.Split(txt, ",")
+			if len(route) < 4 {
+				log.Debugf("mgmtStatusV1Parser: skipping malformed routing table line %q", txt)
+				continue
+			}
+			routes = append(routes, routingTableEntry{VirtualAddress: route[0], CommonName: route[1], RealAddress: route[2], LastRef: route[3]})
+		}
+	}
+	return u, routes
+}
+
+// mgmtStatusV2Parser parses status versions 2 and 3 which differ only by separator.
+// Columns are looked up by names from HEADER lines because their set depends on OpenVPN version.
+func mgmtStatusV2Parser(text, separator string) ([]clientStatus, []routingTableEntry) {
+	var u []clientStatus
+	var routes []routingTableEntry
+	headers := make(map[string]map[string]int)
+
+	column := func(fields []string, section, name string) string {
+		i, ok := headers[section][name]
+		if !ok || i >= len(fields) {
+			return ""
+		}
+		return fields[i]
+	}
+	// lines may be cut during reconnects, those missing any column of their HEADER are skipped
+	malformed := func(fields []string, section string) bool {
+		if _, ok := headers[section]["Common Name"]; !ok || len(fields) <= len(headers[section]) {
+			log.Debugf("mgmtStatusV2Parser: skipping malformed %s line %q", section, strings.Join(fields, separator))
+			return true
+		}
+		return false
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimRight(scanner.Text(), "\r"), separator)
+		switch fields[0] {
+		case "HEADER":
+			if len(fields) < 2 {
+				continue
+			}
+			// values lines start with section name in place of HEADER, so columns keep their indexes
+			columns := make(map[string]int)
+			for i, name := range fields[2:] {
+				columns[name] = i + 1
+			}
+			headers[fields[1]] = columns
+		case "CLIENT_LIST":
+			if malformed(fields, "CLIENT_LIST") {
+				continue
+			}
+			u = append(u, clientStatus{
+				CommonName:     column(fields, "CLIENT_LIST", "Common Name"),
+				ClientId:       column(fields, "CLIENT_LIST", "Client ID"),
+				RealAddress:    column(fields, "CLIENT_LIST", "Real Address"),
+				VirtualAddress: column(fields, "CLIENT_LIST", "Virtual Address"),
+				BytesReceived:  column(fields, "CLIENT_LIST", "Bytes Received"),
+				BytesSent:      column(fields, "CLIENT_LIST", "Bytes Sent"),
+				ConnectedSince: column(fields, "CLIENT_LIST", "Connected Since"),
+			})
+		case "ROUTING_TABLE":
+			if malformed(fields, "ROUTING_TABLE") {
+				continue
+			}
+			routes = append(routes, routingTableEntry{
+				VirtualAddress: column(fields, "ROUTING_TABLE", "Virtual Address"),
+				CommonName:     column(fields, "ROUTING_TABLE", "Common Name"),
+				RealAddress:    column(fields, "ROUTING_TABLE", "Real Address"),
+				LastRef:        column(fields, "ROUTING_TABLE", "Last Ref"),
+			})
+		case "END":
+			return u, routes
+		}
+	}
+	return u, routes
+}
+
+// mgmtStatusParser parses status output of any version: legacy CSV (1),
+// CSV with HEADER/CLIENT_LIST prefixes (2) or the same tab separated (3)
+func mgmtStatusParser(text string) ([]clientStatus, []routingTableEntry) {
+	switch mgmtStatusVersion(text) {
+	case 3:
+		return mgmtStatusV2Parser(text, "\t")
+	case 2:
+		return mgmtStatusV2Parser(text, ",")
+	default:
+		return mgmtStatusV1Parser(text)
+	}
+}
+
+// applyRoutes fills virtual address and last ref of clients from routes of the same session.
+// Virtual address reported by CLIENT_LIST is kept, iroute subnets of the client are in routes too
+func applyRoutes(u []clientStatus, routes []routingTableEntry) {
+	for _, route := range routes {
+		for i := range u {
+			if u[i].CommonName == route.CommonName && u[i].RealAddress == route.RealAddress {
+				if u[i].VirtualAddress == "" {
+					u[i].VirtualAddress = route.VirtualAddress
 				}
+				u[i].LastRef = route.LastRef
+				break
 			}
 		}
 	}
-	return u
 }
 
-func (oAdmin *OvpnAdmin) mgmtKillUserConnection(username, serverName string) {
+// mgmtKillUserConnection kills all sessions of username by common name
+func (oAdmin *OvpnAdmin) mgmtKillUserConnection(username, serverName string) (bool, string) {
+	return oAdmin.mgmtKill(fmt.Sprintf("kill %s", username), serverName)
+}
+
+// mgmtKillByCID kills a single session by its client ID, it's reported by status versions 2 and 3 only
+func (oAdmin *OvpnAdmin) mgmtKillByCID(cid, serverName string) (bool, string) {
+	return oAdmin.mgmtKill(fmt.Sprintf("client-kill %s", cid), serverName)
+}
+
+// mgmtKill returns true if mgmt interface accepted the kill command
+// along with the reply of the mgmt interface
+func (oAdmin *OvpnAdmin) mgmtKill(command, serverName string) (bool, string) {
 	conn, err := net.Dial("tcp", oAdmin.mgmtInterfaces[serverName])
 	if err != nil {
 		log.Errorf("openvpn mgmt interface for %s is not reachable by addr %s", serverName, oAdmin.mgmtInterfaces[serverName])
-		return
+		return false, fmt.Sprintf("openvpn mgmt interface for %s is not reachable", serverName)
+	}
+	defer conn.Close()
+	if err = oAdmin.mgmtWelcome(conn); err != nil {
+		log.Errorf("openvpn mgmt interface for %s: %s", serverName, err)
+		return false, fmt.Sprintf("openvpn mgmt interface for %s: %s", serverName, err)
+	}
+	conn.Write([]byte(command + "\n"))
+	out := oAdmin.mgmtRead(conn)
+	log.Debugf("mgmtKill: %s: %s: %s", serverName, command, out)
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "SUCCESS:"):
+			return true, strings.TrimSpace(strings.TrimPrefix(line, "SUCCESS:"))
+		case strings.HasPrefix(line, "ERROR:"):
+			return false, strings.TrimSpace(strings.TrimPrefix(line, "ERROR:"))
+		}
 	}
-	oAdmin.mgmtRead(conn) // read welcome message
-	conn.Write([]byte(fmt.Sprintf("kill %s\n", username)))
-	fmt.Printf("%v", oAdmin.mgmtRead(conn))
-	conn.Close()
+	return false, "unexpected reply from openvpn mgmt interface"
 }
 
 func (oAdmin *OvpnAdmin) mgmtGetActiveClients() []clientStatus {
@@ -1337,9 +3548,13 @@ func (oAdmin *OvpnAdmin) mgmtGetActiveClients() []clientStatus {
 		conn, err := net.Dial("tcp", addr)
 		if err != nil {
 			log.Warnf("openvpn mgmt interface for %s is not reachable by addr %s", srv, addr)
-			break
+			continue
+		}
+		if err = oAdmin.mgmtWelcome(conn); err != nil {
+			log.Warnf("openvpn mgmt interface for %s: %s", srv, err)
+			conn.Close()
+			continue
 		}
-		oAdmin.mgmtRead(conn) // read welcome message
 		conn.Write([]byte("status\n"))
 		activeClients = append(activeClients, oAdmin.mgmtConnectedUsersParser(oAdmin.mgmtRead(conn), srv)...)
 		conn.Close()
@@ -1347,6 +3562,32 @@ func (oAdmin *OvpnAdmin) mgmtGetActiveClients() []clientStatus {
 	return activeClients
 }
 
+// mgmtGetRoutingTable returns ROUTING TABLE sections from status output of all mgmt interfaces
+func (oAdmin *OvpnAdmin) mgmtGetRoutingTable() []routingTableEntry {
+	routingTable := []routingTableEntry{}
+
+	for srv, addr := range oAdmin.mgmtInterfaces {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Warnf("openvpn mgmt interface for %s is not reachable by addr %s", srv, addr)
+			continue
+		}
+		if err = oAdmin.mgmtWelcome(conn); err != nil {
+			log.Warnf("openvpn mgmt interface for %s: %s", srv, err)
+			conn.Close()
+			continue
+		}
+		conn.Write([]byte("status\n"))
+		_, routes := mgmtStatusParser(oAdmin.mgmtRead(conn))
+		conn.Close()
+		for i := range routes {
+			routes[i].ConnectedTo = srv
+		}
+		routingTable = append(routingTable, routes...)
+	}
+	return routingTable
+}
+
 func (oAdmin *OvpnAdmin) mgmtSetTimeFormat() {
 	// time format for version 2.5 and may be newer
 	oAdmin.mgmtStatusTimeFormat = "2006-01-02 15:04:05"
@@ -1373,10 +3614,14 @@ func (oAdmin *OvpnAdmin) mgmtSetTimeFormat() {
 			time.Sleep(time.Duration(2) * time.Second)
 		}
 		if err != nil {
-			break
+			continue
 		}
 
-		oAdmin.mgmtRead(conn) // read welcome message
+		if err = oAdmin.mgmtWelcome(conn); err != nil {
+			log.Warnf("mgmtSetTimeFormat: openvpn mgmt interface for %s: %s", srv, err)
+			conn.Close()
+			continue
+		}
 		conn.Write([]byte("version\n"))
 		out := oAdmin.mgmtRead(conn)
 		conn.Close()
@@ -1431,7 +3676,9 @@ func isUserConnected(username string, connectedUsers []clientStatus) (bool, []st
 	return connected, connections
 }
 
-func (oAdmin *OvpnAdmin) downloadCerts() bool {
+// downloadCerts gets certs archive from m or from --sync.s3.bucket with s3 sync backend.
+// It returns whether download succeeded and whether archive changed since the previous one
+func (oAdmin *OvpnAdmin) downloadCerts(m masterServer) (bool, bool) {
 	if fExist(certsArchivePath) {
 		err := fDelete(certsArchivePath)
 		if err != nil {
@@ -1439,16 +3686,33 @@ func (oAdmin *OvpnAdmin) downloadCerts() bool {
 		}
 	}
 
-	err := fDownload(certsArchivePath, *masterHost+*listenBaseUrl+downloadCertsApiUrl+"?token="+oAdmin.masterSyncToken, oAdmin.masterHostBasicAuth)
+	oAdmin.stateMutex.RLock()
+	etag := oAdmin.certsArchiveEtag
+	oAdmin.stateMutex.RUnlock()
+
+	var changed bool
+	var err error
+	if oAdmin.s3 != nil {
+		etag, changed, err = oAdmin.s3.downloadIfChanged(oAdmin.fs, certsArchivePath, certsArchiveFileName, etag)
+	} else {
+		etag, changed, err = fDownloadIfChanged(oAdmin.fs, certsArchivePath, m.url+*listenBaseUrl+downloadCertsApiUrl+"?token="+oAdmin.masterSyncToken, etag, m.user, m.password)
+	}
 	if err != nil {
 		log.Error(err)
-		return false
+		oAdmin.setLastSyncError(fmt.Sprintf("certs download: %s", err))
+		ovpnSyncFailures.Inc()
+		return false, false
 	}
 
-	return true
+	oAdmin.stateMutex.Lock()
+	oAdmin.certsArchiveEtag = etag
+	oAdmin.stateMutex.Unlock()
+	return true, changed
 }
 
-func (oAdmin *OvpnAdmin) downloadCcd() bool {
+// downloadCcd gets ccd archive from m or from --sync.s3.bucket with s3 sync backend.
+// It returns whether download succeeded and whether archive changed since the previous one
+func (oAdmin *OvpnAdmin) downloadCcd(m masterServer) (bool, bool) {
 	if fExist(ccdArchivePath) {
 		err := fDelete(ccdArchivePath)
 		if err != nil {
@@ -1456,92 +3720,256 @@ func (oAdmin *OvpnAdmin) downloadCcd() bool {
 		}
 	}
 
-	err := fDownload(ccdArchivePath, *masterHost+*listenBaseUrl+downloadCcdApiUrl+"?token="+oAdmin.masterSyncToken, oAdmin.masterHostBasicAuth)
+	oAdmin.stateMutex.RLock()
+	etag := oAdmin.ccdArchiveEtag
+	oAdmin.stateMutex.RUnlock()
+
+	var changed bool
+	var err error
+	if oAdmin.s3 != nil {
+		etag, changed, err = oAdmin.s3.downloadIfChanged(oAdmin.fs, ccdArchivePath, ccdArchiveFileName, etag)
+	} else {
+		etag, changed, err = fDownloadIfChanged(oAdmin.fs, ccdArchivePath, m.url+*listenBaseUrl+downloadCcdApiUrl+"?token="+oAdmin.masterSyncToken, etag, m.user, m.password)
+	}
 	if err != nil {
 		log.Error(err)
-		return false
+		oAdmin.setLastSyncError(fmt.Sprintf("ccd download: %s", err))
+		ovpnSyncFailures.Inc()
+		return false, false
 	}
 
-	return true
+	oAdmin.stateMutex.Lock()
+	oAdmin.ccdArchiveEtag = etag
+	oAdmin.stateMutex.Unlock()
+	return true, changed
 }
 
-func archiveCerts() {
-	err := createArchiveFromDir(*easyrsaDirPath+"/pki", certsArchivePath)
+// serveArchive streams dir as tar.gz straight to the response, so concurrent slave syncs don't share any file on disk.
+// Slaves send ETag of their previous download in If-None-Match and get 304 if nothing changed since
+func (oAdmin *OvpnAdmin) serveArchive(w http.ResponseWriter, r *http.Request, dir, fileName string) {
+	files, err := listArchiveFiles(oAdmin.fs, dir)
 	if err != nil {
-		log.Warnf("archiveCerts(): %s", err)
+		log.Warnf("serveArchive(): %s", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to build archive")
+		return
 	}
-}
 
-func archiveCcd() {
-	err := createArchiveFromDir(*ccdDir, ccdArchivePath)
+	etag, err := filesChecksum(oAdmin.fs, dir, files)
 	if err != nil {
-		log.Warnf("archiveCcd(): %s", err)
+		log.Warnf("serveArchive(): %s", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to build archive")
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+fileName)
+	// headers are already sent at this point, so a failed write only truncates the archive
+	if err = writeArchive(oAdmin.fs, w, dir, files); err != nil {
+		log.Warnf("serveArchive(): error writing %s: %s", fileName, err)
 	}
 }
 
-func unArchiveCerts() {
-	if err := os.MkdirAll(*easyrsaDirPath+"/pki", 0755); err != nil {
+func (oAdmin *OvpnAdmin) unArchiveCerts() error {
+	if err := oAdmin.fs.MkdirAll(*easyrsaDirPath+"/pki", 0755); err != nil {
 		log.Warnf("unArchiveCerts(): error creating pki dir: %s", err)
 	}
 
-	err := extractFromArchive(certsArchivePath, *easyrsaDirPath+"/pki")
-	if err != nil {
-		log.Warnf("unArchiveCerts: extractFromArchive() %s", err)
-	}
+	return extractFromArchiveSafely(oAdmin.fs, certsArchivePath, *easyrsaDirPath+"/pki", "ca.crt", "index.txt")
 }
 
-func unArchiveCcd() {
-	if err := os.MkdirAll(*ccdDir, 0755); err != nil {
+func (oAdmin *OvpnAdmin) unArchiveCcd() error {
+	if err := oAdmin.fs.MkdirAll(*ccdDir, 0755); err != nil {
 		log.Warnf("unArchiveCcd(): error creating ccd dir: %s", err)
 	}
 
-	err := extractFromArchive(ccdArchivePath, *ccdDir)
-	if err != nil {
-		log.Warnf("unArchiveCcd: extractFromArchive() %s", err)
+	return extractFromArchiveSafely(oAdmin.fs, ccdArchivePath, *ccdDir)
+}
+
+// syncDataFromMaster tries --master.host URLs starting from the last good one till certs and ccd
+// are synced with one of them, it returns whether both are in sync with master
+func (oAdmin *OvpnAdmin) syncDataFromMaster(ctx context.Context) bool {
+	synced := false
+	var master masterServer
+	for _, m := range oAdmin.masterOrder() {
+		if ctx.Err() != nil {
+			break
+		}
+		if synced = oAdmin.syncDataFromMasterHost(ctx, m); synced {
+			master = m
+			break
+		}
+		log.Warnf("Sync with master %s failed", m.url)
+	}
+
+	now := time.Now()
+	oAdmin.stateMutex.Lock()
+	defer oAdmin.stateMutex.Unlock()
+	oAdmin.lastSyncTime = now.Format(stringDateFormat)
+	ovpnSyncLastAttempt.Set(float64(now.Unix()))
+	if synced {
+		if oAdmin.lastSuccessfulMaster != "" && oAdmin.lastSuccessfulMaster != master.url {
+			log.Warnf("Failed over from master %s to %s", oAdmin.lastSuccessfulMaster, master.url)
+		}
+		oAdmin.setCurrentMaster(master)
+		oAdmin.lastSuccessfulSyncTime = now.Format(stringDateFormat)
+		ovpnSyncLastSuccess.Set(float64(now.Unix()))
+		oAdmin.lastSyncError = ""
+		oAdmin.syncRetryCount = 0
+		return true
 	}
+	oAdmin.syncRetryCount += 1
+	return false
 }
 
-func (oAdmin *OvpnAdmin) syncDataFromMaster() {
+// syncDataFromMasterHost downloads certs and then ccd from m retrying failed downloads with backoff,
+// it returns whether both are in sync with m
+func (oAdmin *OvpnAdmin) syncDataFromMasterHost(ctx context.Context, m masterServer) bool {
 	retryCountMax := 3
 	certsDownloadFailed := true
 	ccdDownloadFailed := true
 
 	for certsDownloadRetries := 0; certsDownloadRetries < retryCountMax; certsDownloadRetries++ {
-		log.Infof("Downloading archive with certificates from master. Attempt %d", certsDownloadRetries)
-		if oAdmin.downloadCerts() {
-			certsDownloadFailed = false
+		if certsDownloadRetries > 0 && !sleepCtx(ctx, backoffDelay(syncRetryBaseDelay, syncRetryMaxDelay, certsDownloadRetries-1)) {
+			break
+		}
+		log.Infof("Downloading archive with certificates from master %s. Attempt %d", m.url, certsDownloadRetries)
+		if ok, changed := oAdmin.downloadCerts(m); ok {
+			if !changed {
+				certsDownloadFailed = false
+				log.Info("Certificates on master are unchanged since previous sync")
+				break
+			}
 			log.Info("Decompressing archive with certificates from master")
-			unArchiveCerts()
+			if err := oAdmin.unArchiveCerts(); err != nil {
+				log.Warnf("Archive with certificates from master is broken, pki is left untouched: %s", err)
+				oAdmin.setLastSyncError(fmt.Sprintf("certs unpack: %s", err))
+				ovpnSyncFailures.Inc()
+				oAdmin.stateMutex.Lock()
+				oAdmin.certsArchiveEtag = ""
+				oAdmin.stateMutex.Unlock()
+				continue
+			}
+			certsDownloadFailed = false
 			log.Info("Decompression archive with certificates from master completed")
 			break
 		} else {
-			log.Warnf("Something goes wrong during downloading archive with certificates from master. Attempt %d", certsDownloadRetries)
+			log.Warnf("Something goes wrong during downloading archive with certificates from master %s. Attempt %d", m.url, certsDownloadRetries)
 		}
 	}
+	if certsDownloadFailed {
+		return false
+	}
 
 	for ccdDownloadRetries := 0; ccdDownloadRetries < retryCountMax; ccdDownloadRetries++ {
-		log.Infof("Downloading archive with ccd from master. Attempt %d", ccdDownloadRetries)
-		if oAdmin.downloadCcd() {
-			ccdDownloadFailed = false
+		if ccdDownloadRetries > 0 && !sleepCtx(ctx, backoffDelay(syncRetryBaseDelay, syncRetryMaxDelay, ccdDownloadRetries-1)) {
+			break
+		}
+		log.Infof("Downloading archive with ccd from master %s. Attempt %d", m.url, ccdDownloadRetries)
+		if ok, changed := oAdmin.downloadCcd(m); ok {
+			if !changed {
+				ccdDownloadFailed = false
+				log.Info("Ccd on master is unchanged since previous sync")
+				break
+			}
 			log.Info("Decompressing archive with ccd from master")
-			unArchiveCcd()
+			if err := oAdmin.unArchiveCcd(); err != nil {
+				log.Warnf("Archive with ccd from master is broken, ccd is left untouched: %s", err)
+				oAdmin.setLastSyncError(fmt.Sprintf("ccd unpack: %s", err))
+				ovpnSyncFailures.Inc()
+				oAdmin.stateMutex.Lock()
+				oAdmin.ccdArchiveEtag = ""
+				oAdmin.stateMutex.Unlock()
+				continue
+			}
+			ccdDownloadFailed = false
 			log.Info("Decompression archive with ccd from master completed")
 			break
 		} else {
-			log.Warnf("Something goes wrong during downloading archive with ccd from master. Attempt %d", ccdDownloadRetries)
+			log.Warnf("Something goes wrong during downloading archive with ccd from master %s. Attempt %d", m.url, ccdDownloadRetries)
 		}
 	}
 
-	oAdmin.lastSyncTime = time.Now().Format(stringDateFormat)
-	if !ccdDownloadFailed && !certsDownloadFailed {
-		oAdmin.lastSuccessfulSyncTime = time.Now().Format(stringDateFormat)
-	}
+	return !certsDownloadFailed && !ccdDownloadFailed
 }
 
-func (oAdmin *OvpnAdmin) syncWithMaster() {
+// resetSyncState forgets results of previous syncs and removes downloaded archives,
+// so the next sync cycle downloads everything from master from scratch
+func (oAdmin *OvpnAdmin) resetSyncState() {
+	for _, archive := range []string{certsArchivePath, ccdArchivePath} {
+		if fExist(archive) {
+			err := fDelete(archive)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	oAdmin.stateMutex.Lock()
+	oAdmin.lastSyncTime = "unknown"
+	oAdmin.lastSuccessfulSyncTime = "unknown"
+	oAdmin.lastSuccessfulMaster = ""
+	oAdmin.lastSyncError = ""
+	oAdmin.syncRetryCount = 0
+	oAdmin.certsArchiveEtag = ""
+	oAdmin.ccdArchiveEtag = ""
+	oAdmin.stateMutex.Unlock()
+	log.Info("Sync state reset")
+}
+
+func (oAdmin *OvpnAdmin) setLastSyncError(msg string) {
+	oAdmin.stateMutex.Lock()
+	oAdmin.lastSyncError = msg
+	oAdmin.stateMutex.Unlock()
+}
+
+// syncWithMaster syncs every --master.sync-frequency seconds. After a failed sync the next one starts
+// sooner, with the interval growing from syncFailureBaseInterval up to the sync frequency
+func (oAdmin *OvpnAdmin) syncWithMaster(ctx context.Context, synced bool) {
+	frequency := time.Duration(*masterSyncFrequency) * time.Second
+	failures := 0
 	for {
-		time.Sleep(time.Duration(*masterSyncFrequency) * time.Second)
-		oAdmin.syncDataFromMaster()
+		interval := frequency
+		if !synced {
+			interval = backoffDelay(syncFailureBaseInterval, frequency, failures)
+			failures++
+		} else {
+			failures = 0
+		}
+		if !sleepCtx(ctx, interval) {
+			return
+		}
+		synced = oAdmin.syncDataFromMaster(ctx)
+	}
+}
+
+// syncJitter is seeded separately, so slaves restarted together don't retry in lockstep
+var syncJitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// backoffDelay returns base doubled attempt times, capped by max, with random half of it taken away as jitter
+func backoffDelay(base, max time.Duration, attempt int) time.Duration {
+	delay := max
+	if attempt < 30 && base<<uint(attempt) < max {
+		delay = base << uint(attempt)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(syncJitter.Int63n(int64(delay/2)+1))
+}
+
+// sleepCtx waits for d, it returns false if ctx is done earlier
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
 }
 
@@ -1592,23 +4020,62 @@ func getOvpnServerHostsFromKubeApi() ([]OpenvpnServer, error) {
 
 func getOvpnCaCertExpireDate() time.Time {
 	caCertPath := *easyrsaDirPath + "/pki/ca.crt"
-	caCert, err := ioutil.ReadFile(caCertPath)
+	caCert, err := pkiFS.ReadFile(caCertPath)
 	if err != nil {
-		log.Errorf("error read file %s: %s", caCertPath, err.Error())
+		log.Warnf("error read file %s: %s", caCertPath, err.Error())
+		return time.Now()
 	}
 
-	certPem, _ := pem.Decode(caCert)
-	certPemBytes := certPem.Bytes
-
-	cert, err := x509.ParseCertificate(certPemBytes)
+	cert, err := decodeCert(caCert)
 	if err != nil {
-		log.Errorf("error parse certificate ca.crt: %s", err.Error())
+		log.Warnf("error parse certificate ca.crt: %s", err.Error())
 		return time.Now()
 	}
 
 	return cert.NotAfter
 }
 
+// getCrlUpdateDates returns thisUpdate and nextUpdate of pki/crl.pem
+func getCrlUpdateDates() (time.Time, time.Time, error) {
+	crlPath := *easyrsaDirPath + "/pki/crl.pem"
+	crlBytes, err := pkiFS.ReadFile(crlPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	crl, err := x509.ParseCRL(crlBytes)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("error parse crl %s: %s", crlPath, err)
+	}
+
+	return crl.TBSCertList.ThisUpdate, crl.TBSCertList.NextUpdate, nil
+}
+
+// refreshCrl regenerates CRL when less than half of its validity period is left,
+// so CRL doesn't expire on deployments without revocations
+func (oAdmin *OvpnAdmin) refreshCrl(ctx context.Context) {
+	for {
+		thisUpdate, nextUpdate, err := getCrlUpdateDates()
+		if err != nil {
+			log.Warnf("refreshCrl: %s", err)
+		} else if time.Until(nextUpdate) < nextUpdate.Sub(thisUpdate)/2 {
+			log.Infof("CRL expires at %s, regenerating", nextUpdate.Format(stringDateFormat))
+			oAdmin.pkiMutex.Lock()
+			err = oAdmin.pki.GenCRL()
+			if err != nil {
+				log.Errorf("refreshCrl: %s", err)
+			}
+			crlFix()
+			oAdmin.pkiMutex.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
 // https://community.openvpn.net/openvpn/ticket/623
 func crlFix() {
 	err := os.Chmod(*easyrsaDirPath+"/pki", 0755)
@@ -0,0 +1,1188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// TestMain sets flags to their defaults the way main does, tests change them as they need
+func TestMain(m *testing.M) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		log.Fatal(err)
+	}
+	validUsername = regexp.MustCompile(*usernamePattern)
+	log.SetLevel(log.ErrorLevel)
+	os.Exit(m.Run())
+}
+
+// setFlag sets string flag for the test and restores it when the test finishes
+func setFlag(t testing.TB, flag *string, value string) {
+	previous := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = previous })
+}
+
+// newTestOvpnAdmin is OvpnAdmin with easyrsa dir /easyrsa and ccd dir /ccd kept in memory
+func newTestOvpnAdmin(t testing.TB, files map[string]string) (*OvpnAdmin, *memFileSystem) {
+	mem := newMemFileSystem(files)
+	setFlag(t, easyrsaDirPath, "/easyrsa")
+	setFlag(t, indexTxtPath, "/easyrsa/pki/index.txt")
+	setFlag(t, ccdDir, "/ccd")
+	previousFS := pkiFS
+	pkiFS = mem
+	t.Cleanup(func() { pkiFS = previousFS })
+
+	oAdmin := &OvpnAdmin{
+		pkiMutex:       &sync.Mutex{},
+		stateMutex:     &sync.RWMutex{},
+		fs:             mem,
+		users:          newUserStore(mem, userStoreIndexTxt),
+		pki:            &fakePKIBackend{fs: mem},
+		trackedClients: map[string][]clientStatus{},
+		missedPolls:    map[string]int{},
+		lastSeen:       map[string]time.Time{},
+	}
+	return oAdmin, mem
+}
+
+// fakePKIBackend appends lines to index.txt the way easyrsa does: read, issue, write back.
+// Overlapping calls would lose lines, so they are counted
+type fakePKIBackend struct {
+	fs       fileSystem
+	mutex    sync.Mutex
+	serial   int
+	inFlight int
+	overlaps int
+	// expiryChecks counts ServerCertExpiry calls, setState finishes with one
+	expiryChecks int
+}
+
+func (p *fakePKIBackend) CreateClient(username, passphrase string, opts clientCertOptions) error {
+	p.mutex.Lock()
+	p.inFlight++
+	if p.inFlight > 1 {
+		p.overlaps++
+	}
+	p.serial++
+	serial := p.serial
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		p.inFlight--
+		p.mutex.Unlock()
+	}()
+
+	index, err := p.fs.ReadFile(*indexTxtPath)
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Millisecond)
+	line := fmt.Sprintf("V\t310101000000Z\t\t%02X\tunknown\t/CN=%s\n", serial, username)
+	return p.fs.WriteFile(*indexTxtPath, append(index, line...), 0644)
+}
+
+func (p *fakePKIBackend) Revoke(username, reason string) error           { return nil }
+func (p *fakePKIBackend) RevokeActions(username, reason string) []string { return nil }
+func (p *fakePKIBackend) Unrevoke(username string) error                 { return nil }
+func (p *fakePKIBackend) GenCRL() error                                  { return nil }
+
+func (p *fakePKIBackend) ServerCertExpiry() (time.Time, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expiryChecks++
+	return time.Time{}, nil
+}
+
+func (p *fakePKIBackend) ServerCertificate() (*x509.Certificate, error) { return nil, nil }
+
+func (p *fakePKIBackend) expiryCheckCount() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.expiryChecks
+}
+
+// testCertificate is PEM of self-signed certificate of cn valid till notAfter
+func testCertificate(t *testing.T, cn string, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notAfter.AddDate(-1, 0, 0),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestCaCertExpire(t *testing.T) {
+	// an hour more than 30 days, so the test doesn't depend on how soon it is run after the certificate is made
+	notAfter := time.Now().Add(30*24*time.Hour + time.Hour)
+	oAdmin, _ := newTestOvpnAdmin(t, map[string]string{
+		"/easyrsa/pki/ca.crt":    testCertificate(t, "ca", notAfter),
+		"/easyrsa/pki/index.txt": testIndexTxt,
+	})
+
+	if got := getOvpnCaCertExpireDate(); got.Unix() != notAfter.Unix() {
+		t.Errorf("getOvpnCaCertExpireDate() = %s, want %s", got, notAfter)
+	}
+	oAdmin.setState()
+	if got := testutil.ToFloat64(ovpnServerCaCertExpire); got != 30 {
+		t.Errorf("ovpn_server_ca_cert_expire = %v, want 30", got)
+	}
+}
+
+// status outputs of OpenVPN 2.5 for status commands of versions 1, 2 and 3
+const (
+	testStatusV1Output = "OpenVPN CLIENT LIST\n" +
+		"Updated,2024-01-01 10:00:00\n" +
+		"Common Name,Real Address,Bytes Received,Bytes Sent,Connected Since\n" +
+		"alice,192.0.2.1:50000,1000,2000,2024-01-01 09:00:00\n" +
+		"bob,[2001:db8::1]:50001,3000,4000,2024-01-01 09:30:00\n" +
+		"ROUTING TABLE\n" +
+		"Virtual Address,Common Name,Real Address,Last Ref\n" +
+		"172.16.100.2,alice,192.0.2.1:50000,2024-01-01 09:59:00\n" +
+		"172.16.100.3,bob,[2001:db8::1]:50001,2024-01-01 09:58:00\n" +
+		"GLOBAL STATS\n" +
+		"Max bcast/mcast queue length,0\n" +
+		"END\n"
+	testStatusV2Output = "TITLE,OpenVPN 2.5.1 x86_64-pc-linux-gnu [SSL (OpenSSL)] [LZO] [LZ4] [EPOLL] [MH/PKTINFO] [AEAD]\n" +
+		"TIME,2024-01-01 10:00:00,1704103200\n" +
+		"HEADER,CLIENT_LIST,Common Name,Real Address,Virtual Address,Virtual IPv6 Address,Bytes Received,Bytes Sent,Connected Since,Connected Since (time_t),Username,Client ID,Peer ID,Data Channel Cipher\n" +
+		"CLIENT_LIST,alice,192.0.2.1:50000,172.16.100.2,,1000,2000,2024-01-01 09:00:00,1704099600,UNDEF,5,0,AES-256-GCM\n" +
+		"CLIENT_LIST,bob,[2001:db8::1]:50001,172.16.100.3,,3000,4000,2024-01-01 09:30:00,1704101400,UNDEF,7,1,AES-256-GCM\n" +
+		"HEADER,ROUTING_TABLE,Virtual Address,Common Name,Real Address,Last Ref,Last Ref (time_t)\n" +
+		"ROUTING_TABLE,172.16.100.2,alice,192.0.2.1:50000,2024-01-01 09:59:00,1704103140\n" +
+		"ROUTING_TABLE,172.16.100.3,bob,[2001:db8::1]:50001,2024-01-01 09:58:00,1704103080\n" +
+		"GLOBAL_STATS,Max bcast/mcast queue length,0\n" +
+		"END\n"
+)
+
+var testStatusV3Output = strings.ReplaceAll(testStatusV2Output, ",", "\t")
+
+func TestMgmtStatusFormats(t *testing.T) {
+	oAdmin := &OvpnAdmin{mgmtListeners: map[string]OpenvpnServer{"main": {Protocol: "udp", Port: "1194"}}}
+	for _, tc := range []struct {
+		name    string
+		status  string
+		version int
+		// client IDs are reported by versions 2 and 3 only
+		clientIds []string
+	}{
+		{"v1", testStatusV1Output, 1, []string{"", ""}},
+		{"v2", testStatusV2Output, 2, []string{"5", "7"}},
+		{"v3", testStatusV3Output, 3, []string{"5", "7"}},
+		{"v1 with mgmt notification", ">INFO:OpenVPN Management Interface Version 3 -- type 'help' for more info\n" + testStatusV1Output, 1, []string{"", ""}},
+		{"v2 with crlf", strings.ReplaceAll(testStatusV2Output, "\n", "\r\n"), 2, []string{"5", "7"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if version := mgmtStatusVersion(tc.status); version != tc.version {
+				t.Errorf("mgmtStatusVersion() = %d, want %d", version, tc.version)
+			}
+			want := []clientStatus{
+				{CommonName: "alice", ClientId: tc.clientIds[0], RealAddress: "192.0.2.1:50000", BytesReceived: "1000", BytesSent: "2000",
+					ConnectedSince: "2024-01-01 09:00:00", VirtualAddress: "172.16.100.2", LastRef: "2024-01-01 09:59:00", ConnectedTo: "main", Protocol: "udp", Port: "1194"},
+				{CommonName: "bob", ClientId: tc.clientIds[1], RealAddress: "[2001:db8::1]:50001", BytesReceived: "3000", BytesSent: "4000",
+					ConnectedSince: "2024-01-01 09:30:00", VirtualAddress: "172.16.100.3", LastRef: "2024-01-01 09:58:00", ConnectedTo: "main", Protocol: "udp", Port: "1194"},
+			}
+			if got := oAdmin.mgmtConnectedUsersParser(tc.status, "main"); !reflect.DeepEqual(got, want) {
+				t.Errorf("mgmtConnectedUsersParser() =\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestUserShowConfigNotFound(t *testing.T) {
+	oAdmin, _ := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": testIndexTxt})
+
+	if _, err := oAdmin.renderClientConfig("carol"); err != errUserNotFound {
+		t.Errorf("renderClientConfig(carol) error = %v, want errUserNotFound", err)
+	}
+	w := httptest.NewRecorder()
+	oAdmin.userShowConfigHandler(w, httptest.NewRequest("GET", "/api/user/config/show?username=carol", nil))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `not found`) {
+		t.Errorf("config of unknown user answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func BenchmarkUsersList(b *testing.B) {
+	var index strings.Builder
+	for i := 0; i < 5000; i++ {
+		flag, revocation := "V", ""
+		if i%10 == 0 {
+			flag, revocation = "R", "210101000000Z"
+		}
+		fmt.Fprintf(&index, "%s\t310101000000Z\t%s\t%04X\tunknown\t/CN=user%d\n", flag, revocation, i+1, i)
+	}
+	oAdmin, _ := newTestOvpnAdmin(b, map[string]string{"/easyrsa/pki/index.txt": index.String()})
+	if users, _ := oAdmin.usersList(); len(users) != 5000 {
+		b.Fatalf("usersList() returned %d users, want 5000", len(users))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		oAdmin.usersList()
+	}
+}
+
+// startFakeMgmt serves OpenVPN mgmt interface answering every status command with status(), it returns its address
+func startFakeMgmt(t *testing.T, status func() string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(">INFO:OpenVPN Management Interface Version 3 -- type 'help' for more info\n"))
+				reader := bufio.NewReader(conn)
+				for {
+					command, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.TrimSpace(command) == "status" {
+						conn.Write([]byte(status()))
+					} else {
+						conn.Write([]byte("ERROR: unknown command\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func testStatusV1(users ...string) string {
+	status := "OpenVPN CLIENT LIST\nUpdated,2024-01-01 10:00:00\nCommon Name,Real Address,Bytes Received,Bytes Sent,Connected Since\n"
+	for i, user := range users {
+		status += fmt.Sprintf("%s,192.0.2.%d:1194,100,200,2024-01-01 10:00:00\n", user, i+1)
+	}
+	status += "ROUTING TABLE\nVirtual Address,Common Name,Real Address,Last Ref\n"
+	for i, user := range users {
+		status += fmt.Sprintf("172.16.100.%d,%s,192.0.2.%d:1194,2024-01-01 10:00:00\n", i+2, user, i+1)
+	}
+	return status + "GLOBAL STATS\nMax bcast/mcast queue length,0\nEND\n"
+}
+
+// TestStateRace runs the updater and the sync of a slave with handlers reading the state they update,
+// it is meant to be run with go test -race
+func TestStateRace(t *testing.T) {
+	oAdmin, _ := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": testIndexTxt, "/ccd/alice": ""})
+
+	var polls int32
+	addr := startFakeMgmt(t, func() string {
+		if atomic.AddInt32(&polls, 1)%2 == 0 {
+			return testStatusV1("alice")
+		}
+		return testStatusV1("alice", "bob")
+	})
+
+	master := &OvpnAdmin{fs: newMemFileSystem(map[string]string{"/master/pki/ca.crt": "ca", "/master/pki/index.txt": testIndexTxt, "/master/ccd/alice": ""})}
+	masterHTTP := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, downloadCertsApiUrl) {
+			master.serveArchive(w, r, "/master/pki", certsArchiveFileName)
+		} else {
+			master.serveArchive(w, r, "/master/ccd", ccdArchiveFileName)
+		}
+	}))
+	defer masterHTTP.Close()
+
+	oAdmin.role = "slave"
+	oAdmin.masters = []masterServer{{url: masterHTTP.URL}}
+	oAdmin.lastSyncTime = "unknown"
+	oAdmin.lastSuccessfulSyncTime = "unknown"
+	oAdmin.mgmtInterfaces = map[string]string{"main": addr}
+	oAdmin.mgmtListeners = map[string]OpenvpnServer{"main": {Host: "vpn.example.com", Port: "1194", Protocol: "udp"}}
+	oAdmin.mgmtStatusTimeFormat = "2006-01-02 15:04:05"
+
+	handlers := []http.HandlerFunc{
+		oAdmin.userListHandler,
+		oAdmin.userStatisticHandler,
+		oAdmin.lastSyncTimeHandler,
+		oAdmin.lastSuccessfulSyncTimeHandler,
+		oAdmin.syncStatusHandler,
+	}
+
+	// handlers keep reading till the updaters are done, so they overlap every update
+	var updaters, readers sync.WaitGroup
+	done := make(chan struct{})
+	update := func(f func()) {
+		updaters.Add(1)
+		go func() {
+			defer updaters.Done()
+			for i := 0; i < 5; i++ {
+				f()
+			}
+		}()
+	}
+	read := func(f func()) {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					f()
+				}
+			}
+		}()
+	}
+	// updateState starts setState without waiting for the previous one, so they overlap too
+	update(oAdmin.setState)
+	update(oAdmin.setState)
+	update(func() { oAdmin.syncDataFromMaster(context.Background()) })
+	for _, handler := range handlers {
+		handler := handler
+		read(func() {
+			handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users/list?username=alice", nil))
+		})
+	}
+	updaters.Wait()
+	close(done)
+	readers.Wait()
+
+	if status := oAdmin.getSyncStatus(); status.LastSuccessfulSyncTime == "unknown" {
+		t.Errorf("slave never synced: %+v", status)
+	}
+	if clients := oAdmin.getActiveClients(); len(clients) == 0 {
+		t.Error("no active clients after polls of mgmt interface")
+	}
+}
+
+func TestIsNetmask(t *testing.T) {
+	for mask, want := range map[string]bool{
+		"255.255.255.255": true,
+		"255.255.255.0":   true,
+		"255.255.128.0":   true,
+		"0.0.0.0":         true,
+		"255.0.255.0":     false,
+		"255.255.255.1":   false,
+		"0.255.255.255":   false,
+		// host addresses sent as masks
+		"10.0.0.1":     false,
+		"172.16.100.5": false,
+		"ffff:ffff::":  false,
+		"255.255.255":  false,
+		"":             false,
+	} {
+		if got := isNetmask(mask); got != want {
+			t.Errorf("isNetmask(%q) = %t, want %t", mask, got, want)
+		}
+	}
+}
+
+func TestValidateCcdRouteMask(t *testing.T) {
+	for mask, wantErr := range map[string]string{
+		"255.255.255.0": "",
+		"255.255.0.255": "is not a valid contiguous netmask",
+		"10.0.0.1":      "is not a valid contiguous netmask",
+		"24":            "must be a valid IP address",
+	} {
+		ccd := Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: []ccdRoute{{Address: "10.0.0.0", Mask: mask}}}
+		ok, err := validateCcd(ccd)
+		if ok != (wantErr == "") || !strings.Contains(err, wantErr) {
+			t.Errorf("validateCcd() with mask %s = %t, %q, want error %q", mask, ok, err, wantErr)
+		}
+	}
+}
+
+func TestValidateCcdDualStack(t *testing.T) {
+	newTestOvpnAdmin(t, map[string]string{
+		"/ccd/bob":   "ifconfig-ipv6-push fd00:1::10/64\n",
+		"/ccd/carol": "ifconfig-push 172.16.100.10 255.255.255.0\n",
+	})
+	setFlag(t, openvpnNetwork, "172.16.100.0/24, fd00:1::/64")
+
+	for address, wantErr := range map[string]string{
+		"172.16.100.5":     "",
+		"fd00:1::5":        "",
+		"fd00:1:0:0::5":    "",
+		"fd00:2::5":        "not belongs to openvpn server network",
+		"172.16.101.5":     "not belongs to openvpn server network",
+		"fd00:1::10":       "already assigned to another user",
+		"fd00:1:0:0:0::10": "already assigned to another user",
+		"172.16.100.10":    "already assigned to another user",
+		"fd00:1::5/64":     "not a valid IP address",
+	} {
+		ok, err := validateCcd(Ccd{User: "alice", ClientAddress: address})
+		if ok != (wantErr == "") || !strings.Contains(err, wantErr) {
+			t.Errorf("validateCcd(%s) = %t, %q, want error %q", address, ok, err, wantErr)
+		}
+	}
+}
+
+func loadTestTemplate(t *testing.T, name string) *template.Template {
+	tpl, err := template.New(name).Funcs(templateFuncs).ParseFiles("templates/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tpl
+}
+
+func TestRenderCcdIPv6(t *testing.T) {
+	setFlag(t, openvpnNetwork, "172.16.100.0/24,fd00:1::/64")
+	oAdmin := &OvpnAdmin{ccdTemplate: loadTestTemplate(t, "ccd.tpl")}
+
+	rendered := oAdmin.renderCcd(Ccd{User: "alice", ClientAddress: "fd00:1::5"})
+	if want := "\nifconfig-ipv6-push fd00:1::5/64\n"; rendered != want {
+		t.Errorf("renderCcd() = %q, want %q", rendered, want)
+	}
+	if ccd := parseCcdText("alice", rendered); ccd.ClientAddress != "fd00:1::5" {
+		t.Errorf("ClientAddress of rendered ccd = %s", ccd.ClientAddress)
+	}
+}
+
+func TestStaticAddressIsFree(t *testing.T) {
+	ccdFiles := map[string]string{
+		"bob":   "ifconfig-push 10.0.0.10 255.255.255.0\n",
+		"carol": "push \"route 10.0.0.1 255.255.255.255\"\n",
+		"dave":  "ifconfig-ipv6-push fd00::1/64\n",
+	}
+	for _, tc := range []struct {
+		address  string
+		username string
+		want     bool
+	}{
+		// 10.0.0.1 is a prefix of bob's address and is in carol's route only
+		{"10.0.0.1", "alice", true},
+		{"10.0.0.10", "alice", false},
+		{"10.0.0.100", "alice", true},
+		{"10.0.0.10", "bob", true},
+		{"fd00::1", "alice", false},
+		{"fd00:0::1", "alice", false},
+		{"fd00::10", "alice", true},
+	} {
+		if got := staticAddressIsFree(ccdFiles, tc.address, tc.username); got != tc.want {
+			t.Errorf("staticAddressIsFree(%s, %s) = %t, want %t", tc.address, tc.username, got, tc.want)
+		}
+	}
+}
+
+func TestReadCcdDirSkipsHiddenFiles(t *testing.T) {
+	newTestOvpnAdmin(t, map[string]string{
+		"/ccd/bob":         "ifconfig-push 10.0.0.10 255.255.255.0\n",
+		"/ccd/.bob.swp":    "ifconfig-push 10.0.0.1 255.255.255.0\n",
+		"/ccd/archive/old": "ifconfig-push 10.0.0.2 255.255.255.0\n",
+	})
+	ccdFiles := readCcdDir()
+	if len(ccdFiles) != 1 || ccdFiles["bob"] == "" {
+		t.Errorf("readCcdDir() = %v, want bob only", ccdFiles)
+	}
+	if !staticAddressIsFree(ccdFiles, "10.0.0.1", "alice") {
+		t.Error("address of editor swap file is taken")
+	}
+}
+
+func TestUsersBulkCreateDuplicates(t *testing.T) {
+	oAdmin, _ := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": ""})
+
+	for _, target := range []string{"/api/users/create/bulk", "/api/users/create/bulk?best-effort=true"} {
+		w := httptest.NewRecorder()
+		oAdmin.usersBulkCreateHandler(w, httptest.NewRequest("POST", target, strings.NewReader(`["alice","bob","alice"]`)))
+		if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "duplicate in request") {
+			t.Errorf("%s answered %d: %s", target, w.Code, w.Body)
+		}
+	}
+	if index := fRead(*indexTxtPath); index != "" {
+		t.Errorf("users are created from rejected request:\n%s", index)
+	}
+
+	w := httptest.NewRecorder()
+	oAdmin.usersBulkCreateHandler(w, httptest.NewRequest("POST", "/api/users/create/bulk", strings.NewReader(`["alice","bob"]`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("bulk create answered %d: %s", w.Code, w.Body)
+	}
+	if users := indexTxtParser(fRead(*indexTxtPath)); len(users) != 2 {
+		t.Errorf("bulk create made %d users, want 2", len(users))
+	}
+}
+
+func TestUserListSearchIgnoresCase(t *testing.T) {
+	oAdmin, _ := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": testIndexTxt +
+		"V\t310101000000Z\t\t04\tunknown\t/CN=Alice.Smith\n"})
+	oAdmin.refreshClients()
+
+	for search, want := range map[string]int{"alice": 2, "ALICE": 2, "Smith": 1, "bob": 1, "carol": 0} {
+		w := httptest.NewRecorder()
+		oAdmin.userListHandler(w, httptest.NewRequest("GET", "/api/users/list?search="+search, nil))
+		var page struct {
+			Data struct {
+				Total int
+			}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Data.Total != want {
+			t.Errorf("search %q found %d users, want %d", search, page.Data.Total, want)
+		}
+	}
+}
+
+func TestRenderClientConfig(t *testing.T) {
+	oAdmin, _ := newTestOvpnAdmin(t, map[string]string{
+		"/easyrsa/pki/index.txt":         testIndexTxt,
+		"/easyrsa/pki/ca.crt":            "CA OF SERVER\n",
+		"/easyrsa/pki/ta.key":            "TA KEY\n",
+		"/easyrsa/pki/issued/alice.crt":  "CERT OF ALICE\n",
+		"/easyrsa/pki/private/alice.key": "PRIVATE KEY OF ALICE\n",
+	})
+	oAdmin.clientConfigTemplate = loadTestTemplate(t, "client.conf.tpl")
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	log.SetLevel(log.TraceLevel)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(log.ErrorLevel)
+	}()
+
+	config, err := oAdmin.renderClientConfig("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err = oAdmin.clientConfigTemplate.Execute(&want, newClientConfig("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if config != want.String() {
+		t.Errorf("renderClientConfig() =\n%q\nwant template output\n%q", config, want.String())
+	}
+	for _, part := range []string{"remote 127.0.0.1 7777 tcp\n", "<cert>\nCERT OF ALICE\n</cert>", "<key>\nPRIVATE KEY OF ALICE\n</key>", "<ca>\nCA OF SERVER\n</ca>"} {
+		if !strings.Contains(config, part) {
+			t.Errorf("config has no %q", part)
+		}
+	}
+	if strings.Contains(logs.String(), "PRIVATE KEY OF ALICE") {
+		t.Error("private key is logged")
+	}
+}
+
+func TestSummaryHandlerKeys(t *testing.T) {
+	oAdmin, _ := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": testIndexTxt})
+	oAdmin.refreshClients()
+
+	w := httptest.NewRecorder()
+	oAdmin.summaryHandler(w, httptest.NewRequest("GET", "/api/summary", nil))
+	var resp struct {
+		Data map[string]int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"totalCerts": 2, "validCerts": 1, "revokedCerts": 1, "expiredCerts": 0, "connectedUsers": 0, "activeConnections": 0}
+	if !reflect.DeepEqual(resp.Data, want) {
+		t.Errorf("api/summary = %v, want %v", resp.Data, want)
+	}
+}
+
+func TestMgmtReadMultipleReads(t *testing.T) {
+	var clients []string
+	for i := 0; i < 500; i++ {
+		clients = append(clients, fmt.Sprintf("user%d", i))
+	}
+	status := testStatusV1(clients...)
+	if len(status) <= 32768 {
+		t.Fatalf("status of %d bytes fits into a single read", len(status))
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		// reply comes in chunks, END line is split between the last two of them
+		for i := 0; i < len(status); i += 1000 {
+			end := i + 1000
+			if end > len(status)-2 {
+				end = len(status) - 2
+			}
+			if _, err := server.Write([]byte(status[i:end])); err != nil {
+				return
+			}
+			if end == len(status)-2 {
+				time.Sleep(10 * time.Millisecond)
+				server.Write([]byte(status[end:]))
+				return
+			}
+		}
+	}()
+
+	oAdmin := &OvpnAdmin{mgmtListeners: map[string]OpenvpnServer{"main": {}}, mgmtStatusTimeFormat: "2006-01-02 15:04:05"}
+	if got := oAdmin.mgmtRead(client); got != status {
+		t.Fatalf("mgmtRead() returned %d bytes of %d", len(got), len(status))
+	}
+	if users := oAdmin.mgmtConnectedUsersParser(status, "main"); len(users) != 500 {
+		t.Errorf("mgmtConnectedUsersParser() returned %d users, want 500", len(users))
+	}
+}
+
+func TestMgmtReadClosedConnection(t *testing.T) {
+	server, client := net.Pipe()
+	go func() {
+		server.Write([]byte("OpenVPN CLIENT LIST\nUpdated,2024-01-01 10:00:00\n"))
+		server.Close()
+	}()
+
+	oAdmin := &OvpnAdmin{}
+	if got := oAdmin.mgmtRead(client); got != "OpenVPN CLIENT LIST\nUpdated,2024-01-01 10:00:00\n" {
+		t.Errorf("mgmtRead() = %q", got)
+	}
+}
+
+func TestMgmtReplyComplete(t *testing.T) {
+	for text, want := range map[string]bool{
+		"":                        false,
+		"OpenVPN CLIENT LIST\n":   false,
+		"GLOBAL STATS\nEND":       false,
+		"GLOBAL STATS\nEND\n":     true,
+		"GLOBAL STATS\r\nEND\r\n": true,
+		"SUCCESS: common name 'alice' found, 1 client(s) killed\n":                    true,
+		"ERROR: common name 'carol' not found\n":                                      true,
+		">INFO:OpenVPN Management Interface Version 3 -- type 'help' for more info\n": true,
+		"ENTER PASSWORD:": true,
+	} {
+		if got := mgmtReplyComplete(text); got != want {
+			t.Errorf("mgmtReplyComplete(%q) = %t, want %t", text, got, want)
+		}
+	}
+}
+
+// fakeClock ticks its tickers only when it is advanced
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	started chan time.Duration
+}
+
+type fakeTicker struct {
+	interval time.Duration
+	next     time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), started: make(chan time.Duration, 1)}
+}
+
+func (c *fakeClock) newTicker(d time.Duration) (<-chan time.Time, func()) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ticker := &fakeTicker{interval: d, next: c.now.Add(d), c: make(chan time.Time)}
+	c.tickers = append(c.tickers, ticker)
+	c.started <- d
+	return ticker.c, func() {}
+}
+
+// advance moves the clock by d delivering every tick due meanwhile, it waits for each tick to be received
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	tickers := c.tickers
+	c.mutex.Unlock()
+	for _, ticker := range tickers {
+		for !ticker.next.After(end) {
+			ticker.c <- ticker.next
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+	}
+	c.mutex.Lock()
+	c.now = end
+	c.mutex.Unlock()
+}
+
+func TestUpdateStateInterval(t *testing.T) {
+	for _, tc := range []struct {
+		interval time.Duration
+		want     int
+	}{
+		{28 * time.Second, 2},
+		{10 * time.Second, 6},
+		{time.Minute, 1},
+	} {
+		t.Run(tc.interval.String(), func(t *testing.T) {
+			oAdmin, _ := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": testIndexTxt})
+			pki := oAdmin.pki.(*fakePKIBackend)
+			clock := newFakeClock()
+			oAdmin.newTicker = clock.newTicker
+			previous := *stateRefreshInterval
+			*stateRefreshInterval = tc.interval
+			defer func() { *stateRefreshInterval = previous }()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go oAdmin.updateState(ctx)
+			if d := <-clock.started; d != tc.interval {
+				t.Errorf("updateState() ticks every %s, want %s", d, tc.interval)
+			}
+
+			clock.advance(time.Minute)
+			// setState is started in background, the last one may still be running
+			deadline := time.Now().Add(5 * time.Second)
+			for pki.expiryCheckCount() < tc.want && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := pki.expiryCheckCount(); got != tc.want {
+				t.Errorf("state is refreshed %d times in a minute, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIndexTxtRoundTrip(t *testing.T) {
+	index := "V\t310101000000Z\t\t01\tunknown\t/CN=server\n" +
+		"V\t310101000000Z\t\t1A2B3C4D5E6F708192A3B4C5D6E7F801\tunknown\t/C=US/O=Example/OU=VPN/CN=alice/emailAddress=alice@example.com\n" +
+		"R\t310101000000Z\t210101000000Z\t03\tunknown\t/CN=bob\n" +
+		"R\t310101000000Z\t210101000000Z,keyCompromise\t04\tunknown\t/CN=REVOKED-carol-0123456789abcdef\n" +
+		"E\t210101000000Z\t\t05\tunknown\t/CN=dave smith\n"
+
+	if got := renderIndexTxt(indexTxtParser(index)); got != index {
+		t.Errorf("renderIndexTxt(indexTxtParser()) =\n%s\nwant\n%s", got, index)
+	}
+}
+
+func TestIndexTxtParserDistinguishedNames(t *testing.T) {
+	for _, tc := range []struct {
+		dn       string
+		identity string
+		email    string
+	}{
+		{"/CN=alice", "alice", ""},
+		{"/C=US/O=Acme/CN=user name", "user name", ""},
+		{"/C=US/ST=New York/L=New York City/O=Acme Inc/OU=IT Dept/CN=John Smith/emailAddress=john@example.com", "John Smith", "john@example.com"},
+		{"/CN=Acme CA/OU=VPN/CN=bob", "bob", ""},
+		{"/O=Acme/emailAddress=carol@example.com/CN=carol", "carol", "carol@example.com"},
+	} {
+		line := "V\t310101000000Z\t\t0A\tunknown\t" + tc.dn + "\n"
+		lines := indexTxtParser(line)
+		if len(lines) != 1 {
+			t.Errorf("indexTxtParser(%q) returned %d lines", line, len(lines))
+			continue
+		}
+		if lines[0].DistinguishedName != tc.dn || lines[0].Identity != tc.identity || lines[0].Email != tc.email {
+			t.Errorf("indexTxtParser(%q) = DN %q, identity %q, email %q, want identity %q, email %q",
+				line, lines[0].DistinguishedName, lines[0].Identity, lines[0].Email, tc.identity, tc.email)
+		}
+		if rendered := renderIndexTxt(lines); rendered != line {
+			t.Errorf("renderIndexTxt() = %q, want %q", rendered, line)
+		}
+	}
+}
+
+// truncateLine cuts line of status starting with prefix after n fields
+func truncateLine(status, prefix, separator string, n int) string {
+	lines := strings.Split(status, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			lines[i] = strings.Join(strings.Split(line, separator)[:n], separator)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestMgmtStatusShortLines(t *testing.T) {
+	oAdmin := &OvpnAdmin{mgmtListeners: map[string]OpenvpnServer{"main": {}}, mgmtStatusTimeFormat: "2006-01-02 15:04:05"}
+	for _, tc := range []struct {
+		name   string
+		status string
+		want   []string
+	}{
+		{"v1 short client", truncateLine(testStatusV1Output, "bob,", ",", 3), []string{"alice 172.16.100.2 2024-01-01 09:59:00"}},
+		{"v1 short route", truncateLine(testStatusV1Output, "172.16.100.3,bob", ",", 2), []string{"alice 172.16.100.2 2024-01-01 09:59:00", "bob  "}},
+		{"v2 short client", truncateLine(testStatusV2Output, "CLIENT_LIST,bob", ",", 4), []string{"alice 172.16.100.2 2024-01-01 09:59:00"}},
+		{"v2 short route", truncateLine(testStatusV2Output, "ROUTING_TABLE,172.16.100.3", ",", 3), []string{"alice 172.16.100.2 2024-01-01 09:59:00", "bob 172.16.100.3 "}},
+		{"v2 short header", truncateLine(testStatusV2Output, "HEADER,CLIENT_LIST", ",", 1), nil},
+		{"v3 short client", truncateLine(testStatusV3Output, "CLIENT_LIST\tbob", "\t", 4), []string{"alice 172.16.100.2 2024-01-01 09:59:00"}},
+		{"v3 short route", truncateLine(testStatusV3Output, "ROUTING_TABLE\t172.16.100.3", "\t", 3), []string{"alice 172.16.100.2 2024-01-01 09:59:00", "bob 172.16.100.3 "}},
+		{"v3 client before header", "TITLE\tOpenVPN\nCLIENT_LIST\talice\t192.0.2.1:50000\nEND\n", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, c := range oAdmin.mgmtConnectedUsersParser(tc.status, "main") {
+				got = append(got, c.CommonName+" "+c.VirtualAddress+" "+c.LastRef)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("mgmtConnectedUsersParser() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// status read may stop anywhere, e.g. on mgmt read timeout
+	for _, status := range []string{testStatusV1Output, testStatusV2Output, testStatusV3Output} {
+		for i := range status {
+			oAdmin.mgmtConnectedUsersParser(status[:i], "main")
+		}
+	}
+}
+
+func TestUserHandlersUnknownUser(t *testing.T) {
+	oAdmin, mem := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": testIndexTxt})
+
+	handlers := map[string]http.HandlerFunc{
+		"revoke":   oAdmin.userRevokeHandler,
+		"unrevoke": oAdmin.userUnrevokeHandler,
+		"rotate":   oAdmin.userRotateHandler,
+		"delete":   oAdmin.userDeleteHandler,
+	}
+	for name, handler := range handlers {
+		for _, tc := range []struct {
+			query string
+			want  int
+		}{
+			{"username=carol", http.StatusNotFound},
+			{"username=carol&dry_run=true", http.StatusNotFound},
+			{"username=../carol", http.StatusUnprocessableEntity},
+		} {
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("POST", "/api/user/"+name+"?"+tc.query, nil))
+			if w.Code != tc.want {
+				t.Errorf("%s with %s answered %d, want %d: %s", name, tc.query, w.Code, tc.want, w.Body)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	oAdmin.userRevokeHandler(w, httptest.NewRequest("POST", "/api/user/revoke?username=carol&reason=bored", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("revoke with invalid reason answered %d, want 400", w.Code)
+	}
+	if mem.writeCount(*indexTxtPath) != 0 {
+		t.Error("index.txt is written for unknown user")
+	}
+}
+
+func TestConcurrentUserCreate(t *testing.T) {
+	oAdmin, mem := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": ""})
+
+	var wg sync.WaitGroup
+	errors := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if ok, msg := oAdmin.userCreate(fmt.Sprintf("user%d", i), "", clientCertOptions{}); !ok {
+				errors <- msg
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errors)
+	for msg := range errors {
+		t.Errorf("userCreate() failed: %s", msg)
+	}
+
+	if overlaps := oAdmin.pki.(*fakePKIBackend).overlaps; overlaps != 0 {
+		t.Errorf("CreateClient() calls overlapped %d times", overlaps)
+	}
+	index, _ := mem.content(*indexTxtPath)
+	identities, serials := map[string]bool{}, map[string]bool{}
+	for _, line := range indexTxtParser(index) {
+		identities[line.Identity] = true
+		serials[line.SerialNumber] = true
+	}
+	if lines := strings.Count(index, "\n"); lines != 10 || len(identities) != 10 || len(serials) != 10 {
+		t.Errorf("index.txt has %d lines with %d identities and %d serials, want 10:\n%s", lines, len(identities), len(serials), index)
+	}
+}
+
+func TestHandlersRejectPathTraversal(t *testing.T) {
+	oAdmin, mem := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": testIndexTxt, "/ccd/alice": "", "/etc/passwd": "root"})
+
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+	}{
+		{"show ccd", oAdmin.userShowCcdHandler, "GET", "/api/user/ccd?username=../etc/passwd", ""},
+		{"show ccd of dot dot", oAdmin.userShowCcdHandler, "GET", "/api/user/ccd?username=..", ""},
+		{"show ccd escaped", oAdmin.userShowCcdHandler, "GET", "/api/user/ccd?username=..%2F..%2Fetc%2Fpasswd", ""},
+		{"apply ccd", oAdmin.userApplyCcdHandler, "POST", "/api/user/ccd/apply", `{"User":"../etc/passwd"}`},
+		{"preview ccd", oAdmin.userPreviewCcdHandler, "POST", "/api/user/ccd/preview", `{"User":"../etc/passwd"}`},
+		{"create", oAdmin.userCreateHandler, "POST", "/api/user/create?username=../etc/passwd", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.handler(w, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Errorf("%s %s answered %d, want 422: %s", tc.method, tc.target, w.Code, w.Body)
+			}
+		})
+	}
+
+	if got, _ := mem.content("/etc/passwd"); got != "root" {
+		t.Errorf("/etc/passwd = %q", got)
+	}
+	if got, _ := mem.content(*indexTxtPath); got != testIndexTxt {
+		t.Errorf("index.txt is changed:\n%s", got)
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		pattern  string
+		limit    int
+		username string
+		wantErr  string
+	}{
+		{"default", usernameRegexp, usernameMaxLength, "alice.smith-1_2", ""},
+		{"default rejects slash", usernameRegexp, usernameMaxLength, "alice/bob", "Username can only contains"},
+		{"default rejects space", usernameRegexp, usernameMaxLength, "alice smith", "Username can only contains"},
+		{"empty", usernameRegexp, usernameMaxLength, "", "Username can only contains"},
+		{"dot", usernameRegexp, usernameMaxLength, ".", "Username can only contains"},
+		{"dot dot", usernameRegexp, usernameMaxLength, "..", "Username can only contains"},
+		{"at limit", usernameRegexp, 64, strings.Repeat("a", 64), ""},
+		{"over limit", usernameRegexp, 64, strings.Repeat("a", 65), "at most 64 characters"},
+		{"huge", usernameRegexp, 64, strings.Repeat("a", 10000), "at most 64 characters"},
+		{"limit counts characters", `^.+$`, 4, "äöüß", ""},
+		{"custom limit", usernameRegexp, 8, "alice.smith", "at most 8 characters"},
+		{"email pattern", `^[a-z0-9._-]+@[a-z0-9.-]+$`, usernameMaxLength, "alice@example.com", ""},
+		{"email pattern rejects plain", `^[a-z0-9._-]+@[a-z0-9.-]+$`, usernameMaxLength, "alice", "Username can only contains"},
+		{"pattern without dots", `^[a-zA-Z0-9_-]+$`, usernameMaxLength, "alice.smith", "Username can only contains"},
+		{"dot dot with custom pattern", `^.+$`, usernameMaxLength, "..", "Username can only contains"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlag(t, usernamePattern, tc.pattern)
+			previousLimit, previousRegexp := *usernameLengthLimit, validUsername
+			*usernameLengthLimit = tc.limit
+			validUsername = regexp.MustCompile(tc.pattern)
+			defer func() { *usernameLengthLimit, validUsername = previousLimit, previousRegexp }()
+
+			err := validateUsername(tc.username)
+			if (err == nil) != (tc.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("validateUsername(%q) = %v, want error %q", tc.username, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseOpenvpnServerProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    OpenvpnServer
+		wantErr bool
+	}{
+		{"vpn.example.com:1194:tcp", OpenvpnServer{Host: "vpn.example.com", Port: "1194", Protocol: "tcp"}, false},
+		{"vpn.example.com:443:TCP", OpenvpnServer{Host: "vpn.example.com", Port: "443", Protocol: "tcp"}, false},
+		{"vpn.example.com:1194", OpenvpnServer{Host: "vpn.example.com", Port: "1194", Protocol: "udp"}, false},
+		{"vpn.example.com:tcp6", OpenvpnServer{Host: "vpn.example.com", Port: "1194", Protocol: "tcp6"}, false},
+		{"192.0.2.1:1194:udp4", OpenvpnServer{Host: "192.0.2.1", Port: "1194", Protocol: "udp4"}, false},
+		{"[2001:db8::1]:1194:udp6", OpenvpnServer{Host: "2001:db8::1", Port: "1194", Protocol: "udp6"}, false},
+		{"[2001:db8::1]:tcp", OpenvpnServer{Host: "2001:db8::1", Port: "1194", Protocol: "tcp"}, false},
+		{"vpn.example.com:1194:sctp", OpenvpnServer{}, true},
+	} {
+		got, err := parseOpenvpnServer(tc.value)
+		if (err != nil) != tc.wantErr || (!tc.wantErr && got != tc.want) {
+			t.Errorf("parseOpenvpnServer(%q) = %+v, %v, want %+v, error %t", tc.value, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestClientConfigRemoteProtocol(t *testing.T) {
+	oAdmin, _ := newTestOvpnAdmin(t, map[string]string{"/easyrsa/pki/index.txt": testIndexTxt})
+	oAdmin.clientConfigTemplate = loadTestTemplate(t, "client.conf.tpl")
+	previous := *openvpnServer
+	*openvpnServer = []string{"192.0.2.1:1194:udp", "[2001:db8::1]:443:tcp6", "vpn.example.com"}
+	defer func() { *openvpnServer = previous }()
+
+	config, err := oAdmin.renderClientConfig("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\nremote 192.0.2.1 1194 udp\nremote 2001:db8::1 443 tcp6\nremote vpn.example.com 1194 udp\n"; !strings.HasPrefix(config, want) {
+		t.Errorf("config starts with %q, want %q", config[:len(want)], want)
+	}
+}
+
+func TestParseOpenvpnServerHost(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    OpenvpnServer
+		wantErr bool
+	}{
+		{"192.0.2.1:1194", OpenvpnServer{Host: "192.0.2.1", Port: "1194", Protocol: "udp"}, false},
+		{"192.0.2.1", OpenvpnServer{Host: "192.0.2.1", Port: "1194", Protocol: "udp"}, false},
+		{"vpn.example.com:8443", OpenvpnServer{Host: "vpn.example.com", Port: "8443", Protocol: "udp"}, false},
+		{"vpn.example.com", OpenvpnServer{Host: "vpn.example.com", Port: "1194", Protocol: "udp"}, false},
+		{"[2001:db8::1]:1194", OpenvpnServer{Host: "2001:db8::1", Port: "1194", Protocol: "udp"}, false},
+		{"[2001:db8::1]", OpenvpnServer{Host: "2001:db8::1", Port: "1194", Protocol: "udp"}, false},
+		// unbracketed IPv6 address can't be told from HOST:PORT
+		{"2001:db8::1", OpenvpnServer{}, true},
+		{"2001:db8::1:1194", OpenvpnServer{}, true},
+		{"[vpn.example.com]:1194", OpenvpnServer{}, true},
+		{"vpn.example.com:0", OpenvpnServer{}, true},
+		{"vpn.example.com:65536", OpenvpnServer{}, true},
+		{"vpn.example.com:port", OpenvpnServer{}, true},
+		{":1194", OpenvpnServer{}, true},
+		{"", OpenvpnServer{}, true},
+	} {
+		got, err := parseOpenvpnServer(tc.value)
+		if (err != nil) != tc.wantErr || (!tc.wantErr && got != tc.want) {
+			t.Errorf("parseOpenvpnServer(%q) = %+v, %v, want %+v, error %t", tc.value, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateCcdWith(t *testing.T) {
+	networks := parseOpenvpnNetworks("172.16.100.0/24")
+	ccdFiles := map[string]string{"bob": "ifconfig-push 172.16.100.10 255.255.255.0\n"}
+	route := func(address, mask, routeType string) []ccdRoute {
+		return []ccdRoute{{Address: address, Mask: mask, Type: routeType}}
+	}
+
+	for _, tc := range []struct {
+		name          string
+		ccd           Ccd
+		allowedRoutes []string
+		wantErr       string
+	}{
+		{"dynamic", Ccd{User: "alice", ClientAddress: "dynamic"}, nil, ""},
+		{"static", Ccd{User: "alice", ClientAddress: "172.16.100.5"}, nil, ""},
+		{"not an address", Ccd{User: "alice", ClientAddress: "172.16.100"}, nil, "not a valid IP address"},
+		{"outside of network", Ccd{User: "alice", ClientAddress: "10.0.0.5"}, nil, "not belongs to openvpn server network"},
+		{"taken", Ccd{User: "alice", ClientAddress: "172.16.100.10"}, nil, "already assigned to another user"},
+		{"own address", Ccd{User: "bob", ClientAddress: "172.16.100.10"}, nil, ""},
+		{"push route", Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: route("10.0.0.0", "255.0.0.0", "")}, nil, ""},
+		{"iroute", Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: route("192.168.1.0", "255.255.255.0", "iroute")}, nil, ""},
+		{"unknown route type", Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: route("10.0.0.0", "255.0.0.0", "static")}, nil, "must be either push or iroute"},
+		{"route address", Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: route("10.0.0", "255.0.0.0", "")}, nil, "CustomRoute.Address"},
+		{"route mask", Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: route("10.0.0.0", "/8", "")}, nil, "CustomRoute.Mask"},
+		{"allowed route", Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: route("10.1.0.0", "255.255.0.0", "")}, []string{"10.0.0.0/8"}, ""},
+		{"wider than allowed", Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: route("10.0.0.0", "254.0.0.0", "")}, []string{"10.0.0.0/8"}, "is not within allowed networks"},
+		{"outside of allowed", Ccd{User: "alice", ClientAddress: "dynamic", CustomRoutes: route("192.168.0.0", "255.255.0.0", "")}, []string{"10.0.0.0/8"}, "is not within allowed networks"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := validateCcdWith(tc.ccd, networks, tc.allowedRoutes, ccdFiles)
+			if ok != (tc.wantErr == "") || !strings.Contains(err, tc.wantErr) {
+				t.Errorf("validateCcdWith() = %t, %q, want error %q", ok, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestIpv4Netmask(t *testing.T) {
+	networks := parseOpenvpnNetworks("10.8.0.0/16,172.16.100.0/24,fd00:1::/64")
+	for address, want := range map[string]string{
+		"10.8.3.4":     "255.255.0.0",
+		"172.16.100.5": "255.255.255.0",
+		"192.0.2.1":    "255.255.255.0",
+		"fd00:1::5":    "255.255.255.0",
+	} {
+		if got := ipv4Netmask(networks, address); got != want {
+			t.Errorf("ipv4Netmask(%s) = %s, want %s", address, got, want)
+		}
+	}
+}
+
+func TestRenderCcdNetmask(t *testing.T) {
+	setFlag(t, openvpnNetwork, "10.8.0.0/16")
+	oAdmin := &OvpnAdmin{ccdTemplate: loadTestTemplate(t, "ccd.tpl")}
+
+	got := oAdmin.renderCcd(Ccd{User: "alice", ClientAddress: "10.8.3.4"})
+	if want := "\nifconfig-push 10.8.3.4 255.255.0.0\n"; got != want {
+		t.Errorf("renderCcd() = %q, want %q", got, want)
+	}
+}
+
+func TestParseConnectedUsers(t *testing.T) {
+	listener := OpenvpnServer{Host: "vpn.example.com", Port: "1194", Protocol: "udp"}
+	for _, tc := range []struct {
+		name   string
+		status string
+		want   []string
+	}{
+		{"empty", "", nil},
+		{"no clients", testStatusV1(), nil},
+		{"clients", testStatusV1("alice", "bob"), []string{"alice 192.0.2.1:1194 172.16.100.2", "bob 192.0.2.2:1194 172.16.100.3"}},
+		{"same user twice", testStatusV1("alice", "alice"), []string{"alice 192.0.2.1:1194 172.16.100.2", "alice 192.0.2.2:1194 172.16.100.3"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, c := range parseConnectedUsers(tc.status, "main", listener) {
+				if c.ConnectedTo != "main" || c.Protocol != "udp" || c.Port != "1194" {
+					t.Errorf("client %s isn't bound to listener: %+v", c.CommonName, c)
+				}
+				got = append(got, c.CommonName+" "+c.RealAddress+" "+c.VirtualAddress)
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("parseConnectedUsers() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIndexTxtParser(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		txt  string
+		want []indexTxtLine
+	}{
+		{"empty", "", nil},
+		{"valid", "V\t310101000000Z\t\t02\tunknown\t/CN=alice\n", []indexTxtLine{
+			{Flag: "V", ExpirationDate: "310101000000Z", SerialNumber: "02", Filename: "unknown", DistinguishedName: "/CN=alice", Identity: "alice"},
+		}},
+		{"revoked with reason", "R\t310101000000Z\t210101000000Z,keyCompromise\t03\tunknown\t/CN=bob\n", []indexTxtLine{
+			{Flag: "R", ExpirationDate: "310101000000Z", RevocationDate: "210101000000Z", RevocationReason: "keyCompromise", SerialNumber: "03", Filename: "unknown", DistinguishedName: "/CN=bob", Identity: "bob"},
+		}},
+		{"revoked without reason", "R\t310101000000Z\t210101000000Z\t03\tunknown\t/CN=bob\n", []indexTxtLine{
+			{Flag: "R", ExpirationDate: "310101000000Z", RevocationDate: "210101000000Z", SerialNumber: "03", Filename: "unknown", DistinguishedName: "/CN=bob", Identity: "bob"},
+		}},
+		{"expired", "E\t210101000000Z\t\t04\tunknown\t/CN=carol/emailAddress=carol@example.com\n", []indexTxtLine{
+			{Flag: "E", ExpirationDate: "210101000000Z", SerialNumber: "04", Filename: "unknown", DistinguishedName: "/CN=carol/emailAddress=carol@example.com", Identity: "carol", Email: "carol@example.com"},
+		}},
+		{"crlf", "V\t310101000000Z\t\t02\tunknown\t/CN=alice\r\n", []indexTxtLine{
+			{Flag: "V", ExpirationDate: "310101000000Z", SerialNumber: "02", Filename: "unknown", DistinguishedName: "/CN=alice", Identity: "alice"},
+		}},
+		{"malformed and unknown flag", "V\t310101000000Z\t02\n\nX\t310101000000Z\t\t05\tunknown\t/CN=dave\n", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := indexTxtParser(tc.txt); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("indexTxtParser() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
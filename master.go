@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// masterServer is one of --master.host URLs, credentials from the URL take precedence
+// over --master.basic-auth.user and --master.basic-auth.password
+type masterServer struct {
+	url      string
+	user     string
+	password string
+}
+
+// parseMasterHosts strips credentials from hosts, so they never show up in logs, API or metrics
+func parseMasterHosts(hosts []string) ([]masterServer, error) {
+	masters := []masterServer{}
+	for _, host := range hosts {
+		u, err := url.Parse(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master host %q: %s", host, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid master host %q: scheme must be http or https", host)
+		}
+
+		m := masterServer{}
+		if u.User != nil {
+			m.user = u.User.Username()
+			m.password, _ = u.User.Password()
+			u.User = nil
+		} else if *masterBasicAuthUser != "" && *masterBasicAuthPassword != "" {
+			m.user = *masterBasicAuthUser
+			m.password = *masterBasicAuthPassword
+		}
+		m.url = u.String()
+		masters = append(masters, m)
+	}
+	if len(masters) == 0 {
+		return nil, fmt.Errorf("at least one master host is required")
+	}
+	return masters, nil
+}
+
+// masterOrder returns masters starting from the last one synced successfully, the rest follow in flag order
+func (oAdmin *OvpnAdmin) masterOrder() []masterServer {
+	oAdmin.stateMutex.RLock()
+	current := oAdmin.currentMaster
+	oAdmin.stateMutex.RUnlock()
+
+	order := make([]masterServer, 0, len(oAdmin.masters))
+	for i := range oAdmin.masters {
+		order = append(order, oAdmin.masters[(current+i)%len(oAdmin.masters)])
+	}
+	return order
+}
+
+// setCurrentMaster remembers m for the next sync cycle and marks it in ovpn_sync_master, caller holds stateMutex
+func (oAdmin *OvpnAdmin) setCurrentMaster(m masterServer) {
+	for i, master := range oAdmin.masters {
+		if master.url == m.url {
+			oAdmin.currentMaster = i
+			ovpnSyncMaster.WithLabelValues(master.url).Set(1)
+		} else {
+			ovpnSyncMaster.WithLabelValues(master.url).Set(0)
+		}
+	}
+	oAdmin.lastSuccessfulMaster = m.url
+}
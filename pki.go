@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PKIBackend performs all PKI mutations for OvpnAdmin.
+type PKIBackend interface {
+	CreateClient(username, passphrase string, opts clientCertOptions) error
+	Revoke(username, reason string) error
+	// RevokeActions describes what Revoke would do for dry runs
+	RevokeActions(username, reason string) []string
+	Unrevoke(username string) error
+	GenCRL() error
+	ServerCertExpiry() (time.Time, error)
+	// ServerCertificate is the certificate of OpenVPN server itself
+	ServerCertificate() (*x509.Certificate, error)
+}
+
+// easyrsaBackend runs easyrsa script from *easyrsaDirPath, files of pki are read and written through fs
+type easyrsaBackend struct {
+	fs fileSystem
+}
+
+const (
+	easyrsaVersion2 = "2"
+	easyrsaVersion3 = "3"
+
+	easyrsaOpBuildClient     = "build-client"
+	easyrsaOpBuildClientPass = "build-client-pass"
+	easyrsaOpRevoke          = "revoke"
+	easyrsaOpGenCRL          = "gen-crl"
+)
+
+// buildEasyrsaCmd returns argv performing op with easyrsa of --easyrsa.version, it runs from *easyrsaDirPath.
+// easyrsa v2 is a set of scripts sharing ./vars, so they are run by bash with args passed as positional
+// parameters, never as part of the script, and *easyrsaBinPath isn't used for them
+func buildEasyrsaCmd(op string, args ...string) ([]string, error) {
+	if *easyrsaVersion == easyrsaVersion2 {
+		switch op {
+		case easyrsaOpBuildClient:
+			if len(args) > 1 {
+				return nil, fmt.Errorf("certificate options are not supported with easyrsa v2")
+			}
+			return append([]string{"bash", "-c", `. ./vars && ./build-key --batch "$1"`, "bash"}, args[0]), nil
+		case easyrsaOpRevoke:
+			// revoke-full takes no reason and regenerates crl.pem itself. It ends with openssl verify
+			// of the revoked certificate, which fails with "error 23" when revocation succeeded
+			return append([]string{"bash", "-c", `. ./vars && ./revoke-full "$1" 2>&1 | grep -q "error 23"`, "bash"}, args[0]), nil
+		case easyrsaOpGenCRL:
+			return []string{"bash", "-c", `. ./vars && openssl ca -gencrl -out "$KEY_DIR/crl.pem" -config "$KEY_CONFIG"`}, nil
+		}
+		return nil, fmt.Errorf("%s is not supported with easyrsa v2", op)
+	}
+
+	bin := *easyrsaBinPath
+	switch op {
+	case easyrsaOpBuildClient:
+		// args after the name are options of easyrsa, they go before the command
+		return append(append([]string{bin}, args[1:]...), "build-client-full", args[0], "nopass"), nil
+	case easyrsaOpBuildClientPass:
+		return append(append([]string{bin, "--passout=stdin"}, args[1:]...), "build-client-full", args[0]), nil
+	case easyrsaOpRevoke:
+		return append([]string{bin, "revoke"}, args...), nil
+	case easyrsaOpGenCRL:
+		return []string{bin, "gen-crl"}, nil
+	}
+	return nil, fmt.Errorf("unknown easyrsa operation %s", op)
+}
+
+// runEasyrsa runs op in *easyrsaDirPath with stdin written to easyrsa
+func runEasyrsa(stdin, op string, args ...string) error {
+	argv, err := buildEasyrsaCmd(op, args...)
+	if err != nil {
+		return err
+	}
+	o, err := runCommand(*easyrsaDirPath, stdin, argv...)
+	log.Debug(o)
+	if err != nil {
+		return fmt.Errorf("easyrsa %s failed: %s", op, err)
+	}
+	return nil
+}
+
+// CreateClient builds client certificate with private key protected by passphrase if it's not empty.
+// Passphrase is piped to easyrsa and never written to disk.
+func (e *easyrsaBackend) CreateClient(username, passphrase string, opts clientCertOptions) error {
+	args := append([]string{username}, opts.easyrsaArgs()...)
+	if passphrase != "" {
+		return runEasyrsa(passphrase+"\n", easyrsaOpBuildClientPass, args...)
+	}
+	return runEasyrsa("", easyrsaOpBuildClient, args...)
+}
+
+// clientCertOptions are optional fields of client certificate requested with api/user/create
+type clientCertOptions struct {
+	Email string
+	// SAN are subjectAltName entries in openssl format, e.g. DNS:host.example.com or email:user@example.com
+	SAN []string
+}
+
+func (opts clientCertOptions) empty() bool {
+	return opts.Email == "" && len(opts.SAN) == 0
+}
+
+// easyrsaArgs returns easyrsa v3 options setting opts. Email is added to subjectAltName as well,
+// as easyrsa puts it to DN only with EASYRSA_DN=org
+func (opts clientCertOptions) easyrsaArgs() []string {
+	var args []string
+	san := opts.SAN
+	if opts.Email != "" {
+		args = append(args, "--req-email="+opts.Email)
+		emailSAN := "email:" + opts.Email
+		found := false
+		for _, entry := range san {
+			found = found || entry == emailSAN
+		}
+		if !found {
+			san = append([]string{emailSAN}, san...)
+		}
+	}
+	if len(san) > 0 {
+		args = append(args, "--subject-alt-name="+strings.Join(san, ","))
+	}
+	return args
+}
+
+var sanDNSRegexp = regexp.MustCompile(`^(\*\.)?[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)*$`)
+
+// parseClientCertOptions validates email and comma separated san form values of api/user/create
+func parseClientCertOptions(email, san string) (clientCertOptions, error) {
+	opts := clientCertOptions{Email: strings.TrimSpace(email)}
+	if opts.Email != "" {
+		if err := validateEmail(opts.Email); err != nil {
+			return opts, err
+		}
+	}
+
+	for _, entry := range strings.Split(san, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kind, value := entry, ""
+		if i := strings.Index(entry, ":"); i > 0 {
+			kind, value = entry[:i], entry[i+1:]
+		}
+		valid := false
+		switch kind {
+		case "DNS":
+			valid = sanDNSRegexp.MatchString(value)
+		case "IP":
+			valid = net.ParseIP(value) != nil
+		case "email":
+			valid = validateEmail(value) == nil
+		case "URI":
+			u, err := url.Parse(value)
+			valid = err == nil && u.Scheme != "" && !strings.ContainsAny(value, " ,")
+		}
+		if !valid {
+			return opts, fmt.Errorf("SAN \"%s\" must be one of DNS:<name>, IP:<address>, email:<address> or URI:<uri>", entry)
+		}
+		opts.SAN = append(opts.SAN, entry)
+	}
+	return opts, nil
+}
+
+// validateEmail accepts bare addresses only, e.g. user@example.com but not "User <user@example.com>"
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || strings.ContainsAny(email, " ,/") {
+		return fmt.Errorf("Email \"%s\" is not a valid address", email)
+	}
+	return nil
+}
+
+// Revoke confirms revocation on stdin, easyrsa v3 asks for it
+func (e *easyrsaBackend) Revoke(username, reason string) error {
+	if err := runEasyrsa("yes\n", easyrsaOpRevoke, username, reason); err != nil {
+		return err
+	}
+	return e.GenCRL()
+}
+
+func (e *easyrsaBackend) RevokeActions(username, reason string) []string {
+	var actions []string
+	for _, op := range [][]string{{easyrsaOpRevoke, username, reason}, {easyrsaOpGenCRL}} {
+		argv, err := buildEasyrsaCmd(op[0], op[1:]...)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		actions = append(actions, fmt.Sprintf("cd %s && %s", *easyrsaDirPath, strings.Join(argv, " ")))
+	}
+	return actions
+}
+
+// unrevokeFile is a file of revoked certificate restored by Unrevoke
+type unrevokeFile struct {
+	src  string
+	dsts []string
+}
+
+func (e *easyrsaBackend) Unrevoke(username string) error {
+	if err := e.restoreRevoked(username); err != nil {
+		return err
+	}
+	return e.GenCRL()
+}
+
+// restoreRevoked restores certificate, key and request of the user from pki/revoked and marks it valid in index.txt.
+// Nothing is changed unless all of them are present in pki/revoked and copied back
+func (e *easyrsaBackend) restoreRevoked(username string) error {
+	unlock := lockIndexTxt()
+	defer unlock()
+
+	content, err := e.fs.ReadFile(*indexTxtPath)
+	if err != nil {
+		return err
+	}
+	usersFromIndexTxt := indexTxtParser(string(content))
+	index := -1
+	for i := range usersFromIndexTxt {
+		// check certificate revoked flag 'R'
+		if usersFromIndexTxt[i].Identity == username && usersFromIndexTxt[i].Flag == "R" {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return fmt.Errorf("certificate of user \"%s\" is not revoked", username)
+	}
+
+	pki := *easyrsaDirPath + "/pki/"
+	serial := usersFromIndexTxt[index].SerialNumber
+	files := []unrevokeFile{
+		{pki + "revoked/certs_by_serial/" + serial + ".crt", []string{pki + "issued/" + username + ".crt", pki + "certs_by_serial/" + serial + ".pem"}},
+		{pki + "revoked/private_by_serial/" + serial + ".key", []string{pki + "private/" + username + ".key"}},
+		{pki + "revoked/reqs_by_serial/" + serial + ".req", []string{pki + "reqs/" + username + ".req"}},
+	}
+
+	var missing []string
+	for _, f := range files {
+		if _, err := e.fs.Stat(f.src); err != nil {
+			missing = append(missing, strings.TrimPrefix(f.src, pki))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("can't unrevoke user \"%s\", missing in pki: %s", username, strings.Join(missing, ", "))
+	}
+
+	var copied []string
+	for _, f := range files {
+		for _, dst := range f.dsts {
+			if err := copyFile(e.fs, f.src, dst); err != nil {
+				for _, c := range copied {
+					_ = e.fs.Remove(c)
+				}
+				return fmt.Errorf("can't unrevoke user \"%s\", failed to restore %s: %s", username, strings.TrimPrefix(dst, pki), err)
+			}
+			copied = append(copied, dst)
+		}
+	}
+
+	usersFromIndexTxt[index].Flag = "V"
+	usersFromIndexTxt[index].RevocationDate = ""
+	usersFromIndexTxt[index].RevocationReason = ""
+	if err := e.fs.WriteFile(*indexTxtPath, []byte(renderIndexTxt(usersFromIndexTxt)), 0644); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := e.fs.Remove(f.src); err != nil {
+			log.Warn(err)
+		}
+	}
+	return nil
+}
+
+func (e *easyrsaBackend) GenCRL() error {
+	return runEasyrsa("", easyrsaOpGenCRL)
+}
+
+func (e *easyrsaBackend) ServerCertExpiry() (time.Time, error) {
+	content, err := e.fs.ReadFile(*indexTxtPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range indexTxtParser(string(content)) {
+		if line.Identity == *serverCertCN {
+			return parseDate(indexTxtDateLayout, line.ExpirationDate), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("server certificate %q not found in index.txt", *serverCertCN)
+}
+
+func (e *easyrsaBackend) ServerCertificate() (*x509.Certificate, error) {
+	path := *serverCertPath
+	if path == "" {
+		path = *easyrsaDirPath + "/pki/issued/" + *serverCertCN + ".crt"
+	}
+	data, err := e.fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := decodeCert(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parse certificate %s: %s", path, err)
+	}
+	return cert, nil
+}
+
+// revocationReasons maps revocation reasons accepted by easyrsa (openssl -crl_reason) to RFC 5280 reason codes
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"CACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"certificateHold":      6,
+}
+
+const defaultRevocationReason = "unspecified"
+
+func validateRevocationReason(reason string) error {
+	if _, ok := revocationReasons[reason]; !ok {
+		return fmt.Errorf("revocation reason \"%s\" must be one of %s", reason, strings.Join(sortedRevocationReasons(), ", "))
+	}
+	return nil
+}
+
+func sortedRevocationReasons() []string {
+	reasons := make([]string, 0, len(revocationReasons))
+	for reason := range revocationReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool { return revocationReasons[reasons[i]] < revocationReasons[reasons[j]] })
+	return reasons
+}
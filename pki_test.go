@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRestoreRevoked(t *testing.T) {
+	revoked := map[string]string{
+		"/easyrsa/pki/revoked/certs_by_serial/03.crt":   "cert of bob",
+		"/easyrsa/pki/revoked/private_by_serial/03.key": "key of bob",
+		"/easyrsa/pki/revoked/reqs_by_serial/03.req":    "req of bob",
+	}
+	files := map[string]string{"/easyrsa/pki/index.txt": testIndexTxt}
+	for name, content := range revoked {
+		files[name] = content
+	}
+	_, mem := newTestOvpnAdmin(t, files)
+	backend := &easyrsaBackend{fs: mem}
+
+	if err := backend.restoreRevoked("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.writeCount(*indexTxtPath); n != 1 {
+		t.Errorf("index.txt is written %d times, want once", n)
+	}
+	index, _ := mem.content(*indexTxtPath)
+	if line, ok := findUser(indexTxtParser(index), "bob"); !ok || line.Flag != "V" || line.RevocationDate != "" {
+		t.Errorf("bob in index.txt = %+v", line)
+	}
+	for name, want := range map[string]string{
+		"/easyrsa/pki/issued/bob.crt":         "cert of bob",
+		"/easyrsa/pki/certs_by_serial/03.pem": "cert of bob",
+		"/easyrsa/pki/private/bob.key":        "key of bob",
+		"/easyrsa/pki/reqs/bob.req":           "req of bob",
+	} {
+		if got, _ := mem.content(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for name := range revoked {
+		if _, ok := mem.content(name); ok {
+			t.Errorf("%s is left in pki/revoked", name)
+		}
+	}
+}
+
+func TestRestoreRevokedMissingFiles(t *testing.T) {
+	_, mem := newTestOvpnAdmin(t, map[string]string{
+		"/easyrsa/pki/index.txt":                      testIndexTxt,
+		"/easyrsa/pki/revoked/certs_by_serial/03.crt": "cert of bob",
+	})
+	backend := &easyrsaBackend{fs: mem}
+
+	err := backend.restoreRevoked("bob")
+	if err == nil || !strings.Contains(err.Error(), "private_by_serial/03.key") {
+		t.Fatalf("restoreRevoked() = %v, want error naming missing key", err)
+	}
+	if n := mem.writeCount(*indexTxtPath); n != 0 {
+		t.Errorf("index.txt is written %d times, want none", n)
+	}
+	if _, ok := mem.content("/easyrsa/pki/issued/bob.crt"); ok {
+		t.Error("certificate is restored without key and request")
+	}
+}
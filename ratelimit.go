@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// limiters of addresses idle for rateLimitIdleTimeout are dropped, a full bucket is the same as a new one
+const rateLimitIdleTimeout = 10 * time.Minute
+
+type rateLimitVisitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ipRateLimiter keeps token bucket per remote IP, it refills at perMinute tokens per minute
+// and holds up to perMinute tokens, so a client can send perMinute requests at once
+type ipRateLimiter struct {
+	perMinute   int
+	mutex       sync.Mutex
+	visitors    map[string]*rateLimitVisitor
+	lastCleanup time.Time
+}
+
+func newIpRateLimiter(perMinute int) *ipRateLimiter {
+	return &ipRateLimiter{perMinute: perMinute, visitors: make(map[string]*rateLimitVisitor), lastCleanup: time.Now()}
+}
+
+// reserve takes a token of ip, it returns how long to wait if there is none
+func (l *ipRateLimiter) reserve(ip string, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastCleanup) > rateLimitIdleTimeout {
+		for addr, v := range l.visitors {
+			if now.Sub(v.lastSeen) > rateLimitIdleTimeout {
+				delete(l.visitors, addr)
+			}
+		}
+		l.lastCleanup = now
+	}
+
+	v, ok := l.visitors[ip]
+	if !ok {
+		v = &rateLimitVisitor{limiter: rate.NewLimiter(rate.Limit(float64(l.perMinute)/60), l.perMinute)}
+		l.visitors[ip] = v
+	}
+	v.lastSeen = now
+
+	reservation := v.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+	}
+	return delay
+}
+
+// withRateLimit answers 429 with Retry-After once remote IP runs out of --rate-limit requests per minute.
+// The limit is shared by all endpoints it wraps
+func (oAdmin *OvpnAdmin) withRateLimit(h http.HandlerFunc) http.HandlerFunc {
+	if oAdmin.rateLimiter == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if delay := oAdmin.rateLimiter.reserve(ip, time.Now()); delay > 0 {
+			log.Warnf("rate limit exceeded by %s on %s", ip, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ccdRule maps user metadata to ccd directives.
+// A rule matches when every key/value pair from Match is present in the user's metadata.
+type ccdRule struct {
+	Name          string            `json:"Name"`
+	Match         map[string]string `json:"Match"`
+	ClientAddress string            `json:"ClientAddress"`
+	CustomRoutes  []ccdRoute        `json:"CustomRoutes"`
+}
+
+func loadCcdRules(path string) ([]ccdRule, error) {
+	var rules []ccdRule
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (rule ccdRule) matches(metadata map[string]string) bool {
+	if len(rule.Match) == 0 {
+		return false
+	}
+	for k, v := range rule.Match {
+		if metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// applyCcdRules returns ccd with directives from all matching rules merged in.
+// Values from ccd itself are per-user overrides: a static ClientAddress wins over
+// the one from rules and a route with the same Address, Mask and Type replaces the rule route.
+func (oAdmin *OvpnAdmin) applyCcdRules(ccd Ccd) Ccd {
+	if len(oAdmin.ccdRules) == 0 || len(ccd.Metadata) == 0 {
+		return ccd
+	}
+
+	result := Ccd{User: ccd.User, ClientAddress: ccd.ClientAddress, CustomRoutes: []ccdRoute{}, Metadata: ccd.Metadata}
+
+	for _, rule := range oAdmin.ccdRules {
+		if !rule.matches(ccd.Metadata) {
+			continue
+		}
+		log.Tracef("ccd rule %q matched for user %s", rule.Name, ccd.User)
+
+		if result.ClientAddress == "dynamic" && rule.ClientAddress != "" {
+			result.ClientAddress = rule.ClientAddress
+		}
+		result.CustomRoutes = mergeCcdRoutes(result.CustomRoutes, rule.CustomRoutes)
+	}
+
+	result.CustomRoutes = mergeCcdRoutes(result.CustomRoutes, ccd.CustomRoutes)
+
+	return result
+}
+
+func mergeCcdRoutes(routes, overrides []ccdRoute) []ccdRoute {
+	for _, override := range overrides {
+		replaced := false
+		for i := range routes {
+			if routes[i].Address == override.Address && routes[i].Mask == override.Mask && routes[i].routeType() == override.routeType() {
+				routes[i] = override
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			routes = append(routes, override)
+		}
+	}
+	return routes
+}
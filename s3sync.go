@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	syncBackendHttp = "http"
+	syncBackendS3   = "s3"
+)
+
+// s3Client puts and gets sync archives as objects of one bucket, requests are signed with AWS Signature Version 4,
+// so it works with AWS S3 as well as with S3 compatible storages like MinIO or Ceph RGW
+type s3Client struct {
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	pathStyle    bool
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	// checksums of the last uploaded archives keyed by object name, unchanged archives aren't uploaded again
+	uploaded map[string]string
+}
+
+// newS3Client builds client from --sync.s3.* flags, credentials missing in flags are taken from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func newS3Client() (*s3Client, error) {
+	if *syncS3Bucket == "" {
+		return nil, fmt.Errorf("--sync.s3.bucket is required with --sync.backend=%s", syncBackendS3)
+	}
+
+	endpoint := *syncS3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + *syncS3Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --sync.s3.endpoint %q: %s", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid --sync.s3.endpoint %q: must be http(s)://HOST[:PORT]", endpoint)
+	}
+
+	c := &s3Client{
+		endpoint:     u,
+		bucket:       *syncS3Bucket,
+		prefix:       *syncS3Prefix,
+		region:       *syncS3Region,
+		pathStyle:    *syncS3PathStyle,
+		accessKey:    *syncS3AccessKey,
+		secretKey:    *syncS3SecretKey,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		uploaded:     make(map[string]string),
+	}
+	if c.accessKey == "" {
+		c.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if c.secretKey == "" {
+		c.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("--sync.s3.access-key and --sync.s3.secret-key are required with --sync.backend=%s", syncBackendS3)
+	}
+	return c, nil
+}
+
+// location is shown in place of master URL in logs, sync status and ovpn_sync_master metric
+func (c *s3Client) location() string {
+	return "s3://" + c.bucket + "/" + c.prefix
+}
+
+func (c *s3Client) objectURL(name string) string {
+	u := *c.endpoint
+	base := strings.TrimRight(u.Path, "/")
+	if c.pathStyle {
+		base += "/" + c.bucket
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	u.Path = base + "/" + c.prefix + name
+	u.RawPath = s3EscapePath(u.Path)
+	return u.String()
+}
+
+// s3EscapePath escapes everything but unreserved characters and "/", as Signature Version 4 canonical URI wants
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds Signature Version 4 Authorization to req. Host and all headers already set on req are signed,
+// so headers set afterwards, e.g. If-None-Match, are sent unsigned
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+func (c *s3Client) putObject(name string, body []byte, contentType string) error {
+	req, err := http.NewRequest("PUT", c.objectURL(name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	payloadHash := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(payloadHash[:]), time.Now())
+
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("upload of %s finished with status code %d: %s", c.location()+name, resp.StatusCode, strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// downloadIfChanged is fDownloadIfChanged for object name of the bucket
+func (c *s3Client) downloadIfChanged(fsys fileSystem, path, name, etag string) (string, bool, error) {
+	req, err := http.NewRequest("GET", c.objectURL(name), nil)
+	if err != nil {
+		return etag, false, err
+	}
+	emptyPayloadHash := sha256.Sum256(nil)
+	c.sign(req, hex.EncodeToString(emptyPayloadHash[:]), time.Now())
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		return etag, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return etag, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return etag, false, fmt.Errorf("download of %s finished with status code %d", c.location()+name, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return etag, false, err
+	}
+
+	// etag of a body which isn't saved must not be kept, otherwise it would never be downloaded again
+	if err = fsys.WriteFile(path, body, 0644); err != nil {
+		return etag, false, err
+	}
+
+	return resp.Header.Get("ETag"), true, nil
+}
+
+// uploadArchive puts dir as tar.gz to object name unless the files are the same as in the last upload
+func (c *s3Client) uploadArchive(fsys fileSystem, dir, name string) error {
+	files, err := listArchiveFiles(fsys, dir)
+	if err != nil {
+		return err
+	}
+	checksum, err := filesChecksum(fsys, dir, files)
+	if err != nil {
+		return err
+	}
+	if c.uploaded[name] == checksum {
+		return nil
+	}
+
+	var archive bytes.Buffer
+	if err = writeArchive(fsys, &archive, dir, files); err != nil {
+		return err
+	}
+	if err = c.putObject(name, archive.Bytes(), "application/gzip"); err != nil {
+		return err
+	}
+	c.uploaded[name] = checksum
+	log.Infof("Uploaded %s to %s", name, c.location())
+	return nil
+}
+
+// uploadToS3 puts certs and ccd archives to the bucket at start and then every --state.refresh-interval
+// if they changed since, slaves with --sync.backend=s3 pull them from there instead of the master
+func (oAdmin *OvpnAdmin) uploadToS3(ctx context.Context) {
+	for {
+		if err := oAdmin.s3.uploadArchive(oAdmin.fs, *easyrsaDirPath+"/pki", certsArchiveFileName); err != nil {
+			log.Warnf("uploadToS3(): certs: %s", err)
+		}
+		if err := oAdmin.s3.uploadArchive(oAdmin.fs, *ccdDir, ccdArchiveFileName); err != nil {
+			log.Warnf("uploadToS3(): ccd: %s", err)
+		}
+		if !sleepCtx(ctx, *stateRefreshInterval) {
+			return
+		}
+	}
+}
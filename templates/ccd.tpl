@@ -1,6 +1,17 @@
 {{- if (ne .ClientAddress "dynamic") }}
-ifconfig-push {{ .ClientAddress }} 255.255.255.0
+{{- if (isIPv6 .ClientAddress) }}
+ifconfig-ipv6-push {{ .ClientAddress }}/{{ ipv6PrefixLen }}
+{{- else }}
+ifconfig-push {{ .ClientAddress }} {{ ipv4Netmask .ClientAddress }}
+{{- end }}
 {{- end }}
 {{- range $route := .CustomRoutes }}
+{{- if (eq $route.Type "iroute") }}
+iroute {{ $route.Address }} {{ $route.Mask }} # {{ $route.Description }}
+{{- else }}
 push "route {{ $route.Address }} {{ $route.Mask }}" # {{ $route.Description }}
 {{- end }}
+{{- end }}
+{{- range $key, $value := .Metadata }}
+# meta {{ $key }}={{ $value }}
+{{- end }}
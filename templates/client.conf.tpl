@@ -7,8 +7,14 @@ client
 nobind
 dev tun
 cipher AES-128-CBC
+{{- if eq .TLSMode "tls-auth" }}
 key-direction 1
+{{- end }}
+{{- if .RedirectGateway }}
+redirect-gateway {{ .RedirectGateway }}
+{{- else }}
 #redirect-gateway def1
+{{- end }}
 tls-client
 remote-cert-tls server
 # uncomment below lines for use with linux
@@ -20,10 +26,19 @@ remote-cert-tls server
 #up /etc/openvpn/update-systemd-resolved
 #down /etc/openvpn/update-systemd-resolved
 
+{{- range $dns := .DNS }}
+dhcp-option DNS {{ $dns }}
+{{- end }}
+{{- range $option := .ExtraOptions }}
+{{ $option }}
+{{- end }}
+
 {{- if .PasswdAuth }}
 auth-user-pass
 {{- end }}
 
+{{- if .Inline }}
+
 <cert>
 {{ .Cert -}}
 </cert>
@@ -33,6 +48,13 @@ auth-user-pass
 <ca>
 {{ .CA -}}
 </ca>
-<tls-auth>
+<{{ .TLSMode }}>
 {{ .TLS -}}
-</tls-auth>
+</{{ .TLSMode }}>
+{{- else }}
+
+cert {{ .CertFile }}
+key {{ .KeyFile }}
+ca {{ .CAFile }}
+{{ .TLSMode }} {{ .TLSFile }}
+{{- end }}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	userStoreIndexTxt = "index.txt"
+	userStoreJSON     = "json"
+)
+
+// UserStore provides read access to certificates known to PKI. PKI mutations still go to
+// index.txt through PKIBackend, stores only have to notice them
+type UserStore interface {
+	List() []indexTxtLine
+	Exists(username string) bool
+	Get(username string) (indexTxtLine, bool)
+}
+
+func newUserStore(fsys fileSystem, kind string) UserStore {
+	index := &indexTxtStore{fs: fsys, path: *indexTxtPath}
+	if kind == userStoreJSON {
+		path := *userStoreJSONPath
+		if path == "" {
+			path = *easyrsaDirPath + "/pki/index.json"
+		}
+		return &jsonUserStore{fs: fsys, path: path, index: index}
+	}
+	return index
+}
+
+// findUser returns the line of username, certificates of deleted and rotated users are renamed
+// to REVOKED-<username>-<hash> so only one line may match
+func findUser(lines []indexTxtLine, username string) (indexTxtLine, bool) {
+	for _, line := range lines {
+		if line.Identity == username {
+			return line, true
+		}
+	}
+	return indexTxtLine{}, false
+}
+
+// findBySerial returns the line with serial, it's compared in normalized form, see normalizeSerial
+func findBySerial(lines []indexTxtLine, serial string) (indexTxtLine, bool) {
+	for _, line := range lines {
+		if lineSerial, err := normalizeSerial(line.SerialNumber); err == nil && lineSerial == serial {
+			return line, true
+		}
+	}
+	return indexTxtLine{}, false
+}
+
+// normalizeSerial turns hex serial as printed by openssl or x509 tools, e.g. 0x0a1b, 0A:1B or 0a1b,
+// into uppercase hex without separators and leading zeros, the way index.txt would have it without padding
+func normalizeSerial(serial string) (string, error) {
+	s := strings.TrimSpace(serial)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+	}
+	s = strings.ToUpper(strings.ReplaceAll(s, ":", ""))
+	if s == "" {
+		return "", fmt.Errorf("serial %q is empty", serial)
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return "", fmt.Errorf("serial %q is not a hex number", serial)
+		}
+	}
+	if s = strings.TrimLeft(s, "0"); s == "" {
+		s = "0"
+	}
+	return s, nil
+}
+
+// indexTxtStore keeps parsed index.txt until its modtime or size changes
+type indexTxtStore struct {
+	fs      fileSystem
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	lines   []indexTxtLine
+}
+
+func (s *indexTxtStore) List() []indexTxtLine {
+	lines, _ := s.load()
+	return lines
+}
+
+func (s *indexTxtStore) Exists(username string) bool {
+	_, ok := s.Get(username)
+	return ok
+}
+
+func (s *indexTxtStore) Get(username string) (indexTxtLine, bool) {
+	return findUser(s.List(), username)
+}
+
+// load returns parsed index.txt and whether it was parsed again since the previous call
+func (s *indexTxtStore) load() ([]indexTxtLine, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	info, err := s.fs.Stat(s.path)
+	if err != nil {
+		log.Warning(err)
+		changed := s.lines != nil
+		s.lines = nil
+		return nil, changed
+	}
+
+	if s.lines == nil || !info.ModTime().Equal(s.modTime) || info.Size() != s.size {
+		content, err := s.fs.ReadFile(s.path)
+		if err != nil {
+			log.Warning(err)
+		}
+		s.lines = indexTxtParser(string(content))
+		s.modTime = info.ModTime()
+		s.size = info.Size()
+		return s.lines, true
+	}
+
+	return s.lines, false
+}
+
+// jsonUserStore reads users from JSON sidecar of index.txt, the sidecar is rewritten
+// every time index.txt changes, so other tools can read it without parsing index.txt
+type jsonUserStore struct {
+	fs    fileSystem
+	path  string
+	index *indexTxtStore
+	mutex sync.Mutex
+	lines []indexTxtLine
+}
+
+func (s *jsonUserStore) List() []indexTxtLine {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	indexLines, changed := s.index.load()
+	if changed || s.lines == nil {
+		if err := s.save(indexLines); err != nil {
+			log.Errorf("jsonUserStore: failed to write %s: %s", s.path, err)
+			return indexLines
+		}
+		lines, err := s.read()
+		if err != nil {
+			log.Errorf("jsonUserStore: failed to read %s: %s", s.path, err)
+			return indexLines
+		}
+		s.lines = lines
+	}
+
+	return s.lines
+}
+
+func (s *jsonUserStore) Exists(username string) bool {
+	_, ok := s.Get(username)
+	return ok
+}
+
+func (s *jsonUserStore) Get(username string) (indexTxtLine, bool) {
+	return findUser(s.List(), username)
+}
+
+func (s *jsonUserStore) read() ([]indexTxtLine, error) {
+	data, err := s.fs.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	lines := []indexTxtLine{}
+	err = json.Unmarshal(data, &lines)
+	return lines, err
+}
+
+// save writes lines to a temp file first, readers never see a partially written sidecar
+func (s *jsonUserStore) save(lines []indexTxtLine) error {
+	if lines == nil {
+		lines = []indexTxtLine{}
+	}
+	data, err := json.MarshalIndent(lines, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.fs, s.path, data, 0600)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	webhookQueueSize       = 100
+	webhookSignatureHeader = "X-Ovpn-Admin-Signature"
+
+	webhookEventUserCreated   = "user.created"
+	webhookEventUserRevoked   = "user.revoked"
+	webhookEventUserUnrevoked = "user.unrevoked"
+)
+
+type webhookEvent struct {
+	Event     string `json:"event"`
+	Username  string `json:"username"`
+	Timestamp string `json:"timestamp"`
+	Actor     string `json:"actor"`
+}
+
+// notifyWebhook queues event for --webhook.url, event is dropped if the queue is full
+// so a slow receiver never blocks API calls
+func (oAdmin *OvpnAdmin) notifyWebhook(event, username string, r *http.Request) {
+	if oAdmin.webhooks == nil {
+		return
+	}
+	e := webhookEvent{Event: event, Username: username, Timestamp: time.Now().UTC().Format(time.RFC3339), Actor: requestActor(r)}
+	select {
+	case oAdmin.webhooks <- e:
+	default:
+		log.WithField("username", username).Warnf("webhook queue is full, %s event dropped", event)
+	}
+}
+
+// requestActor is the basic auth user set by a proxy in front of ovpn-admin, or remote address of the request
+func requestActor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return r.RemoteAddr
+}
+
+// deliverWebhooks posts queued events to --webhook.url one by one till ctx is done
+func (oAdmin *OvpnAdmin) deliverWebhooks(ctx context.Context) {
+	client := &http.Client{Timeout: *webhookTimeout}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-oAdmin.webhooks:
+			if err := postWebhook(client, e); err != nil {
+				log.WithField("username", e.Username).Warnf("webhook delivery of %s event failed: %s", e.Event, err)
+			}
+		}
+	}
+}
+
+func postWebhook(client *http.Client, e webhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", *webhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *webhookSecret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(body, *webhookSecret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered with status code %d", *webhookUrl, resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookSignature is hex encoded HMAC-SHA256 of body, receivers compute it with the same secret to verify the event
+func webhookSignature(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}